@@ -2,11 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
 
 	"github.com/tmdgusya/do-more/internal/config"
+	"github.com/tmdgusya/do-more/internal/gate"
+	"github.com/tmdgusya/do-more/internal/history"
 	"github.com/tmdgusya/do-more/internal/loop"
 	"github.com/tmdgusya/do-more/internal/provider"
 )
@@ -45,7 +48,7 @@ func TestE2EFullLoop(t *testing.T) {
 	cfg := &config.Config{
 		Name:          "e2e-test",
 		Provider:      "mock",
-		Gates:         []string{"test -f hello.txt"},
+		Gates:         gate.Commands("test -f hello.txt"),
 		MaxIterations: 3,
 		Tasks: []config.Task{
 			{ID: "1", Title: "First task", Description: "Do first thing", Status: config.StatusPending},
@@ -85,7 +88,7 @@ func TestE2EInitCreatesConfig(t *testing.T) {
 		Name:          "new-project",
 		Provider:      "claude",
 		Branch:        "feat/do-more",
-		Gates:         []string{},
+		Gates:         gate.Commands(),
 		MaxIterations: 10,
 		Tasks: []config.Task{
 			{ID: "1", Title: "Example task", Description: "Describe what needs to be done", Status: config.StatusPending},
@@ -106,3 +109,113 @@ func TestE2EInitCreatesConfig(t *testing.T) {
 		t.Errorf("Provider = %q, want %q", loaded.Provider, "claude")
 	}
 }
+
+func TestE2ERecordAndReplay(t *testing.T) {
+	cassette := t.TempDir()
+	setup := func() (string, string) {
+		dir := t.TempDir()
+		cfgPath := filepath.Join(dir, "do-more.json")
+		cfg := &config.Config{
+			Name:          "replay-test",
+			Provider:      "writer",
+			Gates:         gate.Commands("grep -q hello hello.txt"),
+			MaxIterations: 2,
+			Tasks: []config.Task{
+				{ID: "1", Title: "Write hello", Description: "Create hello.txt", Status: config.StatusPending},
+			},
+		}
+		if err := config.SaveConfig(cfgPath, cfg); err != nil {
+			t.Fatal(err)
+		}
+		return dir, cfgPath
+	}
+
+	dir, cfgPath := setup()
+	registry := provider.NewProviderRegistry()
+	registry.Register(provider.NewCommandProvider("writer", provider.CommandSpec{
+		Command: "sh",
+		Args:    []string{"-c", "echo hello > hello.txt; echo wrote it", "sh"},
+	}))
+	if err := recordProviders(registry, cassette, cfgPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := loop.RunLoop(context.Background(), cfgPath, "writer", registry, dir, &logRecorder{}); err != nil {
+		t.Fatalf("recording run failed: %v", err)
+	}
+
+	dir, cfgPath = setup()
+	registry = provider.NewProviderRegistry()
+	registry.Register(&mockProvider{name: "writer", err: errors.New("the real provider ran")})
+	if err := replayProviders(registry, cassette); err != nil {
+		t.Fatal(err)
+	}
+	if err := loop.RunLoop(context.Background(), cfgPath, "writer", registry, dir, &logRecorder{}); err != nil {
+		t.Fatalf("replay run failed: %v", err)
+	}
+
+	reloaded, err := config.LoadConfig(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Tasks[0].Status != config.StatusDone {
+		t.Errorf("status = %q, want done after replay", reloaded.Tasks[0].Status)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "hello.txt")); err != nil || string(data) != "hello\n" {
+		t.Errorf("hello.txt = %q, %v, want the recorded content", data, err)
+	}
+}
+
+func TestE2EFakeProvider(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "do-more.json")
+	script := `{"steps": [
+		{"files": {"hello.txt": "helo\n"}, "output": "first try\n"},
+		{"files": {"hello.txt": "hello\n"}, "output": "fixed the typo\n"}
+	]}`
+	if err := os.WriteFile(filepath.Join(dir, provider.DefaultFakeScript), []byte(script), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		Name:          "fake-test",
+		Provider:      "fake",
+		Gates:         gate.Commands("grep -qx hello hello.txt"),
+		MaxIterations: 3,
+		Tasks: []config.Task{
+			{ID: "1", Title: "Write hello", Description: "Create hello.txt", Status: config.StatusPending},
+			{ID: "2", Title: "Write hello again", Description: "Create hello.txt", Status: config.StatusPending},
+		},
+	}
+	if err := config.SaveConfig(cfgPath, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each task, and each run of the loop, starts from the first step, as
+	// it would when serve runs the loop again with the same registry.
+	registry := defaultRegistry()
+	for run := 1; run <= 2; run++ {
+		if run == 2 {
+			if err := config.SaveConfig(cfgPath, cfg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := loop.RunLoop(context.Background(), cfgPath, "fake", registry, dir, &logRecorder{}); err != nil {
+			t.Fatalf("RunLoop failed: %v", err)
+		}
+		reloaded, err := config.LoadConfig(cfgPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, task := range reloaded.Tasks {
+			if task.Status != config.StatusDone {
+				t.Errorf("run %d: task %s status = %q, want done on the second iteration", run, task.ID, task.Status)
+			}
+			attempts, err := history.Load(cfgPath, task.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(attempts) != 2*run {
+				t.Errorf("run %d: task %s attempts = %d, want %d", run, task.ID, len(attempts), 2*run)
+			}
+		}
+	}
+}
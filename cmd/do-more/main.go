@@ -12,6 +12,8 @@ import (
 
 	"github.com/spf13/cobra"
 	"github.com/tmdgusya/do-more/internal/config"
+	"github.com/tmdgusya/do-more/internal/gate"
+	"github.com/tmdgusya/do-more/internal/history"
 	"github.com/tmdgusya/do-more/internal/loop"
 	"github.com/tmdgusya/do-more/internal/provider"
 	"github.com/tmdgusya/do-more/internal/server"
@@ -22,12 +24,50 @@ func defaultRegistry() *provider.ProviderRegistry {
 	registry.Register(&provider.ClaudeProvider{})
 	registry.Register(&provider.OpenCodeProvider{})
 	registry.Register(&provider.KimiProvider{})
+	registry.Register(provider.NewFakeProvider())
 	return registry
 }
 
-func main() {
+// configRegistry returns the built-in providers plus any defined in the
+// config at cfgPath. A missing or invalid config leaves just the built-ins.
+func configRegistry(cfgPath string) *provider.ProviderRegistry {
 	registry := defaultRegistry()
+	if cfg, err := config.LoadConfig(cfgPath); err == nil {
+		cfg.RegisterProviders(registry)
+	}
+	return registry
+}
 
+// recordProviders wraps every provider in registry so that its runs are
+// recorded to the cassette in dir. Changes to the config at cfgPath, which
+// sits in the work directory, are not recorded.
+func recordProviders(registry *provider.ProviderRegistry, dir, cfgPath string) error {
+	rec, err := provider.NewRecorder(dir, filepath.Base(cfgPath))
+	if err != nil {
+		return err
+	}
+	for _, name := range registry.List() {
+		p, _ := registry.Get(name)
+		registry.Register(rec.Wrap(p))
+	}
+	return nil
+}
+
+// replayProviders replaces every provider in registry, and any other
+// provider the cassette in dir has runs for, with a replay of that
+// cassette, so that no real provider runs.
+func replayProviders(registry *provider.ProviderRegistry, dir string) error {
+	cassette, err := provider.LoadCassette(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range append(registry.List(), cassette.Providers()...) {
+		registry.Register(cassette.Provider(name))
+	}
+	return nil
+}
+
+func main() {
 	rootCmd := &cobra.Command{
 		Use:   "do-more",
 		Short: "Autonomous AI coding loop orchestrator",
@@ -46,7 +86,7 @@ func main() {
 				Name:          filepath.Base(mustGetwd()),
 				Provider:      "claude",
 				Branch:        "feat/do-more",
-				Gates:         []string{},
+				Gates:         []gate.Gate{},
 				MaxIterations: 10,
 				Tasks: []config.Task{
 					{
@@ -70,11 +110,19 @@ func main() {
 	var providerFlag string
 	var maxIterationsFlag int
 	var configFlag string
+	var parallelFlag int
+	var forceFlag bool
+	var resumeFlag string
+	var recordFlag string
+	var replayFlag string
 
 	runCmd := &cobra.Command{
 		Use:   "run",
 		Short: "Start the autonomous loop",
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if recordFlag != "" && replayFlag != "" {
+				return fmt.Errorf("--record and --replay cannot be used together")
+			}
 			cfgPath := configFlag
 			cfg, err := config.LoadConfig(cfgPath)
 			if err != nil {
@@ -98,13 +146,34 @@ func main() {
 				workDir = mustGetwd()
 			}
 
+			registry := defaultRegistry()
+			cfg.RegisterProviders(registry)
+			if recordFlag != "" {
+				if err := recordProviders(registry, recordFlag, cfgPath); err != nil {
+					return err
+				}
+				fmt.Printf("[do-more] Recording provider runs to %s\n", recordFlag)
+			}
+			if replayFlag != "" {
+				if err := replayProviders(registry, replayFlag); err != nil {
+					return err
+				}
+				fmt.Printf("[do-more] Replaying provider runs from %s\n", replayFlag)
+			}
+
 			logger := &loop.StdoutLogger{}
-			return loop.RunLoop(context.Background(), cfgPath, providerName, registry, workDir, logger)
+			opts := loop.Options{Parallel: parallelFlag, Force: forceFlag, Resume: resumeFlag}
+			return loop.RunLoopWithOptions(context.Background(), cfgPath, providerName, registry, workDir, logger, opts)
 		},
 	}
 	runCmd.Flags().StringVar(&providerFlag, "provider", "", "Override provider from config")
 	runCmd.Flags().IntVar(&maxIterationsFlag, "max-iterations", 0, "Override max iterations per task")
 	runCmd.Flags().StringVar(&configFlag, "config", "do-more.json", "Path to config file")
+	runCmd.Flags().IntVar(&parallelFlag, "parallel", 1, "Number of tasks to run at once in separate git worktrees")
+	runCmd.Flags().BoolVar(&forceFlag, "force", false, "Run even if the git working tree has uncommitted changes")
+	runCmd.Flags().StringVar(&resumeFlag, "resume", loop.ResumeContinue, "What to do with tasks left in_progress by an interrupted run: continue, reset or fail")
+	runCmd.Flags().StringVar(&recordFlag, "record", "", "Record every provider run, with the files it changed, to this cassette directory")
+	runCmd.Flags().StringVar(&replayFlag, "replay", "", "Replay the provider runs recorded in this cassette directory instead of running providers")
 
 	// --- status ---
 	statusCmd := &cobra.Command{
@@ -119,7 +188,11 @@ func main() {
 			fmt.Printf("Project: %s\n", cfg.Name)
 			fmt.Printf("Provider: %s\n", cfg.Provider)
 			fmt.Printf("Branch: %s\n", cfg.Branch)
-			fmt.Printf("Gates: %s\n", strings.Join(cfg.Gates, ", "))
+			gateLabels := make([]string, len(cfg.Gates))
+			for i, g := range cfg.Gates {
+				gateLabels[i] = g.Label()
+			}
+			fmt.Printf("Gates: %s\n", strings.Join(gateLabels, ", "))
 			fmt.Println()
 
 			for _, t := range cfg.Tasks {
@@ -131,23 +204,42 @@ func main() {
 					marker = "✗"
 				case config.StatusInProgress:
 					marker = "→"
+				case config.StatusBlocked:
+					marker = "⊘"
 				}
 				fmt.Printf("  [%s] #%s %s (%s)\n", marker, t.ID, t.Title, t.Status)
+				if t.Usage != (provider.Usage{}) {
+					fmt.Printf("        %s\n", t.Usage)
+				}
+			}
+
+			fmt.Println()
+			fmt.Printf("Usage: %s\n", cfg.TotalUsage())
+			runs, err := history.LoadRuns("do-more.json")
+			if err != nil {
+				return err
+			}
+			if len(runs) > 0 {
+				last := runs[len(runs)-1]
+				fmt.Printf("Last run: %s (%d tasks, started %s)\n", last.Usage, len(last.Tasks), last.StartedAt.Format(time.RFC3339))
 			}
 			return nil
 		},
 	}
 
 	// --- providers ---
+	var providersConfigFlag string
+
 	providersCmd := &cobra.Command{
 		Use:   "providers",
 		Short: "List available providers",
 		Run: func(cmd *cobra.Command, args []string) {
-			for _, name := range registry.List() {
+			for _, name := range configRegistry(providersConfigFlag).List() {
 				fmt.Printf("  - %s\n", name)
 			}
 		},
 	}
+	providersCmd.Flags().StringVar(&providersConfigFlag, "config", "do-more.json", "Path to config file")
 
 	// --- models ---
 	var modelsConfigFlag string
@@ -156,16 +248,53 @@ func main() {
 		Use:   "models",
 		Short: "Show available and configured models",
 		Run: func(cmd *cobra.Command, args []string) {
-			var configured string
+			var configured, configuredModel string
 			cfg, err := config.LoadConfig(modelsConfigFlag)
 			if err == nil {
-				configured = cfg.Provider
+				configured, configuredModel = cfg.Provider, cfg.Model
 			}
-			fmt.Print(provider.FormatModels(registry.List(), configured))
+			fmt.Print(provider.FormatProviderModels(configRegistry(modelsConfigFlag).Models(), configured, configuredModel))
 		},
 	}
 	modelsCmd.Flags().StringVar(&modelsConfigFlag, "config", "do-more.json", "Path to config file")
 
+	// --- history ---
+	var historyConfigFlag string
+
+	historyCmd := &cobra.Command{
+		Use:   "history <task-id>",
+		Short: "Show the recorded attempts for a task",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := config.LoadConfig(historyConfigFlag)
+			if err != nil {
+				return err
+			}
+			var task *config.Task
+			for i := range cfg.Tasks {
+				if cfg.Tasks[i].ID == args[0] {
+					task = &cfg.Tasks[i]
+				}
+			}
+			if task == nil {
+				return fmt.Errorf("task %q not found", args[0])
+			}
+
+			attempts, err := history.Load(historyConfigFlag, task.ID)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Task #%s: %s (%s)\n", task.ID, task.Title, task.Status)
+			if len(attempts) == 0 {
+				fmt.Println("  No attempts recorded")
+				return nil
+			}
+			fmt.Print(history.Format(attempts))
+			return nil
+		},
+	}
+	historyCmd.Flags().StringVar(&historyConfigFlag, "config", "do-more.json", "Path to config file")
+
 	// --- serve ---
 	var portFlag int
 	var serveConfigFlag string
@@ -183,7 +312,7 @@ func main() {
 			if !filepath.IsAbs(workDir) {
 				workDir = mustGetwd()
 			}
-			srv := server.NewServer(cfgPath, workDir, registry)
+			srv := server.NewServer(cfgPath, workDir, configRegistry(cfgPath))
 
 			addr := fmt.Sprintf("localhost:%d", portFlag)
 			fmt.Printf("[do-more] Dashboard: http://%s\n", addr)
@@ -209,7 +338,7 @@ func main() {
 	serveCmd.Flags().IntVar(&portFlag, "port", 8585, "Port to serve on")
 	serveCmd.Flags().StringVar(&serveConfigFlag, "config", "do-more.json", "Path to config file")
 
-	rootCmd.AddCommand(initCmd, runCmd, statusCmd, providersCmd, modelsCmd, serveCmd)
+	rootCmd.AddCommand(initCmd, runCmd, statusCmd, providersCmd, modelsCmd, historyCmd, serveCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
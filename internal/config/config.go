@@ -4,6 +4,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tmdgusya/do-more/internal/gate"
+	"github.com/tmdgusya/do-more/internal/provider"
 )
 
 const (
@@ -11,24 +18,215 @@ const (
 	StatusInProgress = "in_progress"
 	StatusDone       = "done"
 	StatusFailed     = "failed"
+	StatusBlocked    = "blocked"
+)
+
+// Baseline modes decide when gates are run before the provider starts, so
+// failures that were already there do not count against a task.
+const (
+	BaselineOff  = "off"
+	BaselineTask = "task"
+	BaselineRun  = "run"
+)
+
+// Gate modes decide how a task's gates combine with the config's gates.
+const (
+	GatesExtend  = "extend"
+	GatesReplace = "replace"
+)
+
+// OnFailure policies decide what happens to a failed task's changes.
+const (
+	OnFailureKeep          = "keep"
+	OnFailureRevert        = "revert"
+	OnFailureStashToBranch = "stash-to-branch"
 )
 
+// StateDirName is the directory, next to the config file, where do-more
+// keeps run state that is not part of the config itself.
+const StateDirName = ".do-more"
+
+// StateDir returns the state directory for the config at cfgPath.
+func StateDir(cfgPath string) string {
+	return filepath.Join(filepath.Dir(cfgPath), StateDirName)
+}
+
 type Task struct {
-	ID          string `json:"id"`
-	Title       string `json:"title"`
-	Description string `json:"description"`
-	Status      string `json:"status"`
-	Learnings   string `json:"learnings"`
-	Provider    string `json:"provider,omitempty"`
+	ID          string       `json:"id"`
+	Title       string       `json:"title"`
+	Description string       `json:"description"`
+	Status      string       `json:"status"`
+	Learnings   string       `json:"learnings"`
+	Provider    ProviderList `json:"provider,omitempty"`
+	DependsOn   []string     `json:"dependsOn,omitempty"`
+	Gates       []gate.Gate  `json:"gates,omitempty"`
+	GatesMode   string       `json:"gatesMode,omitempty"`
+	Model       string       `json:"model,omitempty"`
+	ExtraArgs   []string     `json:"extraArgs,omitempty"`
+	// Session is the provider conversation the next iteration continues.
+	Session *Session `json:"session,omitempty"`
+	// FreshSession makes every iteration start a new conversation.
+	FreshSession bool `json:"freshSession,omitempty"`
+	// Usage totals what the providers consumed working on the task.
+	Usage provider.Usage `json:"usage,omitzero"`
+}
+
+// Session identifies a provider conversation that a task can continue.
+type Session struct {
+	Provider string `json:"provider"`
+	ID       string `json:"id"`
+}
+
+// ProviderList names a provider, or an ordered list of providers to fall
+// back through. In JSON it is a single name or an array of names.
+type ProviderList []string
+
+func (l *ProviderList) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*l = nil
+		if name != "" {
+			*l = ProviderList{name}
+		}
+		return nil
+	}
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return fmt.Errorf("provider must be a name or a list of names: %w", err)
+	}
+	*l = names
+	return nil
+}
+
+// MarshalJSON writes a single provider as a plain name so existing config
+// files keep their shape.
+func (l ProviderList) MarshalJSON() ([]byte, error) {
+	if len(l) == 1 {
+		return json.Marshal(l[0])
+	}
+	return json.Marshal([]string(l))
+}
+
+// ProviderSwitch decides when a task moves on to the next provider in its
+// fallback list.
+type ProviderSwitch struct {
+	// OnError switches after a provider error. Defaults to true.
+	OnError *bool `json:"onError,omitempty"`
+	// AfterFailures switches once this many iterations in a row with one
+	// provider end in gate failures. Zero never switches on gate failures.
+	AfterFailures int `json:"afterFailures,omitempty"`
+	// OnStagnation switches instead of failing the task when iterations
+	// stop making progress. Defaults to true.
+	OnStagnation *bool `json:"onStagnation,omitempty"`
+}
+
+// SwitchOnError reports whether a provider error moves to the next provider.
+func (s *ProviderSwitch) SwitchOnError() bool {
+	return s == nil || s.OnError == nil || *s.OnError
+}
+
+// SwitchOnStagnation reports whether stagnation moves to the next provider.
+func (s *ProviderSwitch) SwitchOnStagnation() bool {
+	return s == nil || s.OnStagnation == nil || *s.OnStagnation
+}
+
+// SwitchAfterFailures returns how many gate-failing iterations in a row
+// move to the next provider, or 0 for never.
+func (s *ProviderSwitch) SwitchAfterFailures() int {
+	if s == nil {
+		return 0
+	}
+	return s.AfterFailures
+}
+
+// Budget caps what one run may consume. Zero fields are unlimited.
+type Budget struct {
+	// MaxCostUSD caps the providers' cost over one run.
+	MaxCostUSD float64 `json:"maxCostUsd,omitempty"`
+	// MaxTokens caps input plus output tokens over one run.
+	MaxTokens int `json:"maxTokens,omitempty"`
+	// MaxTaskDuration caps the wall-clock time of each task, e.g. "30m".
+	MaxTaskDuration string `json:"maxTaskDuration,omitempty"`
+	// MaxRunDuration caps the wall-clock time of one run, e.g. "8h".
+	MaxRunDuration string `json:"maxRunDuration,omitempty"`
+}
+
+// TaskDuration returns the per-task time limit, or 0 for none. It assumes
+// the config has been validated.
+func (b *Budget) TaskDuration() time.Duration {
+	if b == nil {
+		return 0
+	}
+	d, _ := time.ParseDuration(b.MaxTaskDuration)
+	return d
+}
+
+// RunDuration returns the per-run time limit, or 0 for none. It assumes
+// the config has been validated.
+func (b *Budget) RunDuration() time.Duration {
+	if b == nil {
+		return 0
+	}
+	d, _ := time.ParseDuration(b.MaxRunDuration)
+	return d
+}
+
+// Exceeded describes the cap that a run having consumed used has reached,
+// or returns "" when it may go on.
+func (b *Budget) Exceeded(used provider.Usage) string {
+	switch {
+	case b == nil:
+		return ""
+	case b.MaxCostUSD > 0 && used.CostUSD >= b.MaxCostUSD:
+		return fmt.Sprintf("cost $%.2f of $%.2f", used.CostUSD, b.MaxCostUSD)
+	case b.MaxTokens > 0 && used.Tokens() >= b.MaxTokens:
+		return fmt.Sprintf("%d of %d tokens", used.Tokens(), b.MaxTokens)
+	}
+	return ""
+}
+
+func (b *Budget) validate() error {
+	if b.MaxCostUSD < 0 {
+		return fmt.Errorf("maxCostUsd must not be negative")
+	}
+	if b.MaxTokens < 0 {
+		return fmt.Errorf("maxTokens must not be negative")
+	}
+	durations := []struct{ field, value string }{
+		{"maxTaskDuration", b.MaxTaskDuration},
+		{"maxRunDuration", b.MaxRunDuration},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d.value); err != nil || v <= 0 {
+			return fmt.Errorf("invalid %s %q: want a duration such as \"2h\"", d.field, d.value)
+		}
+	}
+	return nil
 }
 
 type Config struct {
-	Name          string   `json:"name"`
-	Provider      string   `json:"provider"`
-	Branch        string   `json:"branch"`
-	Gates         []string `json:"gates"`
-	MaxIterations int      `json:"maxIterations"`
-	Tasks         []Task   `json:"tasks"`
+	Name            string                          `json:"name"`
+	Provider        string                          `json:"provider"`
+	Providers       map[string]provider.CommandSpec `json:"providers,omitempty"`
+	HTTPProviders   map[string]provider.HTTPSpec    `json:"httpProviders,omitempty"`
+	Model           string                          `json:"model,omitempty"`
+	ExtraArgs       []string                        `json:"extraArgs,omitempty"`
+	Branch          string                          `json:"branch"`
+	Gates           []gate.Gate                     `json:"gates"`
+	MaxIterations   int                             `json:"maxIterations"`
+	GateTimeout     string                          `json:"gateTimeout,omitempty"`
+	GateConcurrency int                             `json:"gateConcurrency,omitempty"`
+	GateFailFast    bool                            `json:"gateFailFast,omitempty"`
+	OutputBudget    int                             `json:"outputBudget,omitempty"`
+	Baseline        string                          `json:"baseline,omitempty"`
+	StagnationLimit int                             `json:"stagnationLimit,omitempty"`
+	ProviderSwitch  *ProviderSwitch                 `json:"providerSwitch,omitempty"`
+	Budget          *Budget                         `json:"budget,omitempty"`
+	OnFailure       string                          `json:"onFailure,omitempty"`
+	Tasks           []Task                          `json:"tasks"`
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -40,6 +238,9 @@ func LoadConfig(path string) (*Config, error) {
 	if err := json.Unmarshal(data, &cfg); err != nil {
 		return nil, fmt.Errorf("parsing config: %w", err)
 	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("validating config: %w", err)
+	}
 	return &cfg, nil
 }
 
@@ -54,18 +255,364 @@ func SaveConfig(path string, cfg *Config) error {
 	return nil
 }
 
+// Validate reports settings that would make the config unusable.
+func (c *Config) Validate() error {
+	switch c.OnFailure {
+	case "", OnFailureKeep, OnFailureRevert, OnFailureStashToBranch:
+	default:
+		return fmt.Errorf("unknown onFailure policy %q", c.OnFailure)
+	}
+	if c.GateTimeout != "" {
+		if d, err := time.ParseDuration(c.GateTimeout); err != nil || d < 0 {
+			return fmt.Errorf("invalid gateTimeout %q: want a duration such as \"10m\"", c.GateTimeout)
+		}
+	}
+	if c.GateConcurrency < 0 {
+		return fmt.Errorf("gateConcurrency must not be negative")
+	}
+	if c.OutputBudget < 0 {
+		return fmt.Errorf("outputBudget must not be negative")
+	}
+	for name, spec := range c.Providers {
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("providers: name is required")
+		}
+		if err := commandSpec(name, spec).Validate(); err != nil {
+			return fmt.Errorf("provider %q: %w", name, err)
+		}
+	}
+	for name, spec := range c.HTTPProviders {
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("httpProviders: name is required")
+		}
+		if _, ok := c.Providers[name]; ok {
+			return fmt.Errorf("provider %q is defined in both providers and httpProviders", name)
+		}
+		if err := spec.Validate(); err != nil {
+			return fmt.Errorf("provider %q: %w", name, err)
+		}
+	}
+	if c.ProviderSwitch != nil && c.ProviderSwitch.AfterFailures < 0 {
+		return fmt.Errorf("providerSwitch.afterFailures must not be negative")
+	}
+	if c.Budget != nil {
+		if err := c.Budget.validate(); err != nil {
+			return fmt.Errorf("budget: %w", err)
+		}
+	}
+	if c.StagnationLimit < 0 || c.StagnationLimit == 1 {
+		return fmt.Errorf("stagnationLimit must be at least 2")
+	}
+	switch c.Baseline {
+	case "", BaselineOff, BaselineTask, BaselineRun:
+	default:
+		return fmt.Errorf("unknown baseline mode %q", c.Baseline)
+	}
+	for _, g := range c.Gates {
+		if err := g.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, t := range c.Tasks {
+		switch t.GatesMode {
+		case "", GatesExtend, GatesReplace:
+		default:
+			return fmt.Errorf("task %q: unknown gatesMode %q", t.ID, t.GatesMode)
+		}
+		for _, g := range t.Gates {
+			if err := g.Validate(); err != nil {
+				return fmt.Errorf("task %q: %w", t.ID, err)
+			}
+		}
+		for _, name := range t.Provider {
+			if name == "" {
+				return fmt.Errorf("task %q: empty provider name", t.ID)
+			}
+		}
+	}
+	return ValidateDependencies(c.Tasks)
+}
+
+// GateTimeoutDuration returns the per-gate time limit, or 0 for none.
+// It assumes the config has been validated.
+func (c *Config) GateTimeoutDuration() time.Duration {
+	d, _ := time.ParseDuration(c.GateTimeout)
+	return d
+}
+
+// GateOptions returns how the config's gate settings apply to a gate run.
+func (c *Config) GateOptions() gate.Options {
+	return gate.Options{
+		Timeout:     c.GateTimeoutDuration(),
+		Concurrency: c.GateConcurrency,
+		FailFast:    c.GateFailFast,
+	}
+}
+
+// EffectiveOutputBudget returns how many bytes of gate and provider output
+// are fed back into a prompt, defaulting to gate.DefaultOutputBudget.
+func (c *Config) EffectiveOutputBudget() int {
+	if c.OutputBudget == 0 {
+		return gate.DefaultOutputBudget
+	}
+	return c.OutputBudget
+}
+
+// DefaultStagnationLimit is how many iterations in a row may end with the
+// same changes and the same failures before a task is given up on.
+const DefaultStagnationLimit = 3
+
+// EffectiveStagnationLimit returns the configured stagnation limit,
+// defaulting to DefaultStagnationLimit.
+func (c *Config) EffectiveStagnationLimit() int {
+	if c.StagnationLimit == 0 {
+		return DefaultStagnationLimit
+	}
+	return c.StagnationLimit
+}
+
+// EffectiveOnFailure returns the configured failure policy, defaulting to keep.
+func (c *Config) EffectiveOnFailure() string {
+	if c.OnFailure == "" {
+		return OnFailureKeep
+	}
+	return c.OnFailure
+}
+
+// EffectiveGates returns the gates that decide whether t is done: the
+// config's gates followed by the task's own, or only the task's gates when
+// its mode is replace.
+func (c *Config) EffectiveGates(t *Task) []gate.Gate {
+	if t.GatesMode == GatesReplace {
+		return t.Gates
+	}
+	gates := make([]gate.Gate, 0, len(c.Gates)+len(t.Gates))
+	gates = append(gates, c.Gates...)
+	return append(gates, t.Gates...)
+}
+
 func (t *Task) EffectiveProvider(fallback string) string {
-	if t.Provider != "" {
-		return t.Provider
+	return t.ProviderChain(fallback)[0]
+}
+
+// ResumeSession returns the session a run of provider should continue for
+// t, or "" to start a new one.
+func (t *Task) ResumeSession(provider string) string {
+	if t.FreshSession || t.Session == nil || t.Session.Provider != provider {
+		return ""
 	}
-	return fallback
+	return t.Session.ID
 }
 
+// ProviderChain returns the providers to try for t in order: its own list,
+// or just fallback when it names none.
+func (t *Task) ProviderChain(fallback string) []string {
+	if len(t.Provider) == 0 {
+		return []string{fallback}
+	}
+	return slices.Clone(t.Provider)
+}
+
+// RunOptions returns the model and extra arguments to run t with provider
+// name. Each setting belongs to the provider it is set next to: the
+// project's to the project's provider, and the task's, which override the
+// model and follow the project's arguments, to the first provider in the
+// task's chain. Other providers, such as fallbacks, get neither.
+func (c *Config) RunOptions(t *Task, name string) provider.RunOptions {
+	var opts provider.RunOptions
+	if name == c.Provider {
+		opts.Model = c.Model
+		opts.ExtraArgs = slices.Clone(c.ExtraArgs)
+	}
+	if name == t.ProviderChain(c.Provider)[0] {
+		if t.Model != "" {
+			opts.Model = t.Model
+		}
+		opts.ExtraArgs = append(opts.ExtraArgs, t.ExtraArgs...)
+	}
+	return opts
+}
+
+// RegisterProviders adds the command and HTTP providers defined in c to
+// registry. A definition with a built-in provider's name replaces it.
+func (c *Config) RegisterProviders(registry *provider.ProviderRegistry) {
+	for name, spec := range c.Providers {
+		registry.Register(provider.NewCommandProvider(name, commandSpec(name, spec)))
+	}
+	for name, spec := range c.HTTPProviders {
+		registry.Register(provider.NewHTTPProvider(name, spec))
+	}
+}
+
+// commandSpec resolves a providers entry. An entry without a command
+// adjusts the built-in provider of the same name, e.g. its promptVia.
+func commandSpec(name string, spec provider.CommandSpec) provider.CommandSpec {
+	if spec.Command == "" {
+		if builtin, ok := provider.BuiltinCommand(name); ok {
+			return builtin.With(spec)
+		}
+	}
+	return spec
+}
+
+// TotalUsage returns what the providers consumed across all tasks.
+func (c *Config) TotalUsage() provider.Usage {
+	var total provider.Usage
+	for _, t := range c.Tasks {
+		total.Add(t.Usage)
+	}
+	return total
+}
+
+// NextPendingTask returns the first pending task whose dependencies are
+// all done, or nil if no task is ready to run.
 func (c *Config) NextPendingTask() *Task {
 	for i := range c.Tasks {
-		if c.Tasks[i].Status == StatusPending {
+		if c.Tasks[i].Status == StatusPending && c.dependenciesDone(&c.Tasks[i]) {
 			return &c.Tasks[i]
 		}
 	}
 	return nil
 }
+
+// TasksWithStatus returns pointers to every task with the given status.
+func (c *Config) TasksWithStatus(status string) []*Task {
+	var tasks []*Task
+	for i := range c.Tasks {
+		if c.Tasks[i].Status == status {
+			tasks = append(tasks, &c.Tasks[i])
+		}
+	}
+	return tasks
+}
+
+func (c *Config) findTask(id string) *Task {
+	for i := range c.Tasks {
+		if c.Tasks[i].ID == id {
+			return &c.Tasks[i]
+		}
+	}
+	return nil
+}
+
+func (c *Config) dependenciesDone(t *Task) bool {
+	for _, dep := range t.DependsOn {
+		d := c.findTask(dep)
+		if d == nil || d.Status != StatusDone {
+			return false
+		}
+	}
+	return true
+}
+
+// BlockUnreachableTasks marks every pending task that depends on a failed
+// or blocked task as blocked, and returns the tasks it changed. Blocking
+// propagates transitively through the dependency graph.
+func (c *Config) BlockUnreachableTasks() []*Task {
+	var blocked []*Task
+	for changed := true; changed; {
+		changed = false
+		for i := range c.Tasks {
+			t := &c.Tasks[i]
+			if t.Status != StatusPending {
+				continue
+			}
+			for _, dep := range t.DependsOn {
+				d := c.findTask(dep)
+				if d != nil && (d.Status == StatusFailed || d.Status == StatusBlocked) {
+					t.Status = StatusBlocked
+					t.Learnings += fmt.Sprintf("\nBlocked: dependency #%s %s", d.ID, d.Status)
+					blocked = append(blocked, t)
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	return blocked
+}
+
+// UnblockReachableTasks puts every blocked task none of whose dependencies
+// is failed or blocked back to pending, for example after a failed
+// dependency was reset, and returns the tasks it changed. Unblocking
+// propagates transitively through the dependency graph.
+func (c *Config) UnblockReachableTasks() []*Task {
+	var unblocked []*Task
+	for changed := true; changed; {
+		changed = false
+		for i := range c.Tasks {
+			t := &c.Tasks[i]
+			if t.Status != StatusBlocked || !c.dependenciesReachable(t) {
+				continue
+			}
+			t.Status = StatusPending
+			unblocked = append(unblocked, t)
+			changed = true
+		}
+	}
+	return unblocked
+}
+
+// dependenciesReachable reports whether no dependency of t is failed or
+// blocked.
+func (c *Config) dependenciesReachable(t *Task) bool {
+	for _, dep := range t.DependsOn {
+		d := c.findTask(dep)
+		if d != nil && (d.Status == StatusFailed || d.Status == StatusBlocked) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateDependencies checks that every dependency refers to an existing
+// task and that the dependency graph contains no cycles.
+func ValidateDependencies(tasks []Task) error {
+	byID := make(map[string]*Task, len(tasks))
+	for i := range tasks {
+		byID[tasks[i].ID] = &tasks[i]
+	}
+	for _, t := range tasks {
+		for _, dep := range t.DependsOn {
+			if _, ok := byID[dep]; !ok {
+				return fmt.Errorf("task %q depends on unknown task %q", t.ID, dep)
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(tasks))
+	var visit func(id string, path []string) error
+	visit = func(id string, path []string) error {
+		switch state[id] {
+		case visiting:
+			for i, p := range path {
+				if p == id {
+					path = path[i:]
+					break
+				}
+			}
+			return fmt.Errorf("dependency cycle: %s", strings.Join(append(path, id), " -> "))
+		case visited:
+			return nil
+		}
+		state[id] = visiting
+		for _, dep := range byID[id].DependsOn {
+			if err := visit(dep, append(path, id)); err != nil {
+				return err
+			}
+		}
+		state[id] = visited
+		return nil
+	}
+	for _, t := range tasks {
+		if err := visit(t.ID, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,9 +1,16 @@
 package config
 
 import (
+	"encoding/json"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/tmdgusya/do-more/internal/gate"
+	"github.com/tmdgusya/do-more/internal/provider"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -43,7 +50,7 @@ func TestLoadConfig(t *testing.T) {
 	if cfg.Branch != "feat/test" {
 		t.Errorf("Branch = %q, want %q", cfg.Branch, "feat/test")
 	}
-	if len(cfg.Gates) != 1 || cfg.Gates[0] != "go test ./..." {
+	if len(cfg.Gates) != 1 || cfg.Gates[0].Run != "go test ./..." {
 		t.Errorf("Gates = %v, want [go test ./...]", cfg.Gates)
 	}
 	if cfg.MaxIterations != 10 {
@@ -65,7 +72,7 @@ func TestSaveConfig(t *testing.T) {
 		Name:          "test-project",
 		Provider:      "claude",
 		Branch:        "feat/test",
-		Gates:         []string{"go test ./..."},
+		Gates:         gate.Commands("go test ./..."),
 		MaxIterations: 10,
 		Tasks: []Task{
 			{ID: "1", Title: "Test task", Description: "desc", Status: StatusPending},
@@ -161,8 +168,8 @@ func TestBackwardCompat(t *testing.T) {
 	if len(cfg.Tasks) != 1 {
 		t.Fatalf("len(Tasks) = %d, want 1", len(cfg.Tasks))
 	}
-	if cfg.Tasks[0].Provider != "" {
-		t.Errorf("Tasks[0].Provider = %q, want empty string", cfg.Tasks[0].Provider)
+	if len(cfg.Tasks[0].Provider) != 0 {
+		t.Errorf("Tasks[0].Provider = %q, want empty", cfg.Tasks[0].Provider)
 	}
 }
 
@@ -174,10 +181,10 @@ func TestProviderRoundTrip(t *testing.T) {
 		Name:          "test-project",
 		Provider:      "claude",
 		Branch:        "feat/test",
-		Gates:         []string{"go test ./..."},
+		Gates:         gate.Commands("go test ./..."),
 		MaxIterations: 10,
 		Tasks: []Task{
-			{ID: "1", Title: "Test task", Description: "desc", Status: StatusPending, Provider: "opencode"},
+			{ID: "1", Title: "Test task", Description: "desc", Status: StatusPending, Provider: ProviderList{"opencode"}},
 		},
 	}
 
@@ -193,7 +200,7 @@ func TestProviderRoundTrip(t *testing.T) {
 	if len(loaded.Tasks) != 1 {
 		t.Fatalf("len(Tasks) = %d, want 1", len(loaded.Tasks))
 	}
-	if loaded.Tasks[0].Provider != "opencode" {
+	if loaded.Tasks[0].EffectiveProvider("") != "opencode" {
 		t.Errorf("Tasks[0].Provider = %q, want %q", loaded.Tasks[0].Provider, "opencode")
 	}
 
@@ -210,7 +217,7 @@ func TestProviderRoundTrip(t *testing.T) {
 		Name:     "test-project",
 		Provider: "claude",
 		Tasks: []Task{
-			{ID: "2", Title: "Test task 2", Description: "desc", Status: StatusPending, Provider: ""},
+			{ID: "2", Title: "Test task 2", Description: "desc", Status: StatusPending},
 		},
 	}
 	path2 := filepath.Join(dir, "do-more2.json")
@@ -240,19 +247,19 @@ func TestEffectiveProvider(t *testing.T) {
 	}{
 		{
 			name:     "task provider set",
-			task:     &Task{ID: "1", Provider: "kimi"},
+			task:     &Task{ID: "1", Provider: ProviderList{"kimi"}},
 			fallback: "claude",
 			want:     "kimi",
 		},
 		{
 			name:     "task provider empty, use fallback",
-			task:     &Task{ID: "2", Provider: ""},
+			task:     &Task{ID: "2"},
 			fallback: "opencode",
 			want:     "opencode",
 		},
 		{
 			name:     "task provider empty, fallback empty",
-			task:     &Task{ID: "3", Provider: ""},
+			task:     &Task{ID: "3"},
 			fallback: "",
 			want:     "",
 		},
@@ -285,3 +292,540 @@ func findIndex(s, substr string) int {
 	}
 	return -1
 }
+
+func TestNextPendingTaskRespectsDependencies(t *testing.T) {
+	cfg := &Config{
+		Tasks: []Task{
+			{ID: "1", Title: "Needs two", Status: StatusPending, DependsOn: []string{"2"}},
+			{ID: "2", Title: "Needs three", Status: StatusPending, DependsOn: []string{"3"}},
+			{ID: "3", Title: "Independent", Status: StatusPending},
+		},
+	}
+
+	task := cfg.NextPendingTask()
+	if task == nil || task.ID != "3" {
+		t.Fatalf("NextPendingTask = %v, want task 3", task)
+	}
+
+	cfg.Tasks[2].Status = StatusDone
+	task = cfg.NextPendingTask()
+	if task == nil || task.ID != "2" {
+		t.Fatalf("NextPendingTask = %v, want task 2", task)
+	}
+}
+
+func TestNextPendingTaskDependencyNotDone(t *testing.T) {
+	cfg := &Config{
+		Tasks: []Task{
+			{ID: "1", Status: StatusInProgress},
+			{ID: "2", Status: StatusPending, DependsOn: []string{"1"}},
+		},
+	}
+
+	if task := cfg.NextPendingTask(); task != nil {
+		t.Errorf("expected nil, got task %q", task.ID)
+	}
+}
+
+func TestBlockUnreachableTasks(t *testing.T) {
+	cfg := &Config{
+		Tasks: []Task{
+			{ID: "1", Status: StatusFailed},
+			{ID: "2", Status: StatusPending, DependsOn: []string{"1"}},
+			{ID: "3", Status: StatusPending, DependsOn: []string{"2"}},
+			{ID: "4", Status: StatusPending},
+		},
+	}
+
+	blocked := cfg.BlockUnreachableTasks()
+	if len(blocked) != 2 {
+		t.Fatalf("len(blocked) = %d, want 2", len(blocked))
+	}
+	if cfg.Tasks[1].Status != StatusBlocked || cfg.Tasks[2].Status != StatusBlocked {
+		t.Errorf("statuses = %q, %q, want blocked", cfg.Tasks[1].Status, cfg.Tasks[2].Status)
+	}
+	if cfg.Tasks[3].Status != StatusPending {
+		t.Errorf("Tasks[3].Status = %q, want pending", cfg.Tasks[3].Status)
+	}
+	if !contains(cfg.Tasks[1].Learnings, "dependency #1 failed") {
+		t.Errorf("Tasks[1].Learnings = %q", cfg.Tasks[1].Learnings)
+	}
+}
+
+func TestUnblockReachableTasks(t *testing.T) {
+	cfg := &Config{
+		Tasks: []Task{
+			{ID: "1", Status: StatusPending},
+			{ID: "2", Status: StatusBlocked, DependsOn: []string{"1"}},
+			{ID: "3", Status: StatusBlocked, DependsOn: []string{"2"}},
+			{ID: "4", Status: StatusFailed},
+			{ID: "5", Status: StatusBlocked, DependsOn: []string{"1", "4"}},
+		},
+	}
+
+	unblocked := cfg.UnblockReachableTasks()
+	if len(unblocked) != 2 {
+		t.Fatalf("len(unblocked) = %d, want 2", len(unblocked))
+	}
+	if cfg.Tasks[1].Status != StatusPending || cfg.Tasks[2].Status != StatusPending {
+		t.Errorf("statuses = %q, %q, want pending", cfg.Tasks[1].Status, cfg.Tasks[2].Status)
+	}
+	if cfg.Tasks[4].Status != StatusBlocked {
+		t.Errorf("Tasks[4].Status = %q, want blocked while #4 is failed", cfg.Tasks[4].Status)
+	}
+}
+
+func TestValidateDependencies(t *testing.T) {
+	tests := []struct {
+		name    string
+		tasks   []Task
+		wantErr string
+	}{
+		{
+			name: "valid chain",
+			tasks: []Task{
+				{ID: "1"},
+				{ID: "2", DependsOn: []string{"1"}},
+				{ID: "3", DependsOn: []string{"1", "2"}},
+			},
+		},
+		{
+			name:    "unknown dependency",
+			tasks:   []Task{{ID: "1", DependsOn: []string{"9"}}},
+			wantErr: `task "1" depends on unknown task "9"`,
+		},
+		{
+			name:    "self dependency",
+			tasks:   []Task{{ID: "1", DependsOn: []string{"1"}}},
+			wantErr: "dependency cycle: 1 -> 1",
+		},
+		{
+			name: "cycle",
+			tasks: []Task{
+				{ID: "1", DependsOn: []string{"3"}},
+				{ID: "2", DependsOn: []string{"1"}},
+				{ID: "3", DependsOn: []string{"2"}},
+			},
+			wantErr: "dependency cycle: 1 -> 3 -> 2 -> 1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateDependencies(tt.tasks)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfigRejectsCycle(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "do-more.json")
+	data := []byte(`{
+		"name": "test-project",
+		"tasks": [
+			{"id": "1", "title": "A", "status": "pending", "dependsOn": ["2"]},
+			{"id": "2", "title": "B", "status": "pending", "dependsOn": ["1"]}
+		]
+	}`)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("expected error for dependency cycle")
+	}
+}
+
+func TestValidateOnFailure(t *testing.T) {
+	for _, policy := range []string{"", OnFailureKeep, OnFailureRevert, OnFailureStashToBranch} {
+		cfg := &Config{OnFailure: policy}
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("Validate(%q) = %v, want nil", policy, err)
+		}
+	}
+
+	cfg := &Config{OnFailure: "explode"}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for unknown onFailure policy")
+	}
+}
+
+func TestEffectiveOnFailure(t *testing.T) {
+	if got := (&Config{}).EffectiveOnFailure(); got != OnFailureKeep {
+		t.Errorf("EffectiveOnFailure() = %q, want %q", got, OnFailureKeep)
+	}
+	if got := (&Config{OnFailure: OnFailureRevert}).EffectiveOnFailure(); got != OnFailureRevert {
+		t.Errorf("EffectiveOnFailure() = %q, want %q", got, OnFailureRevert)
+	}
+}
+
+func TestEffectiveGates(t *testing.T) {
+	cfg := &Config{Gates: gate.Commands("go test ./...")}
+
+	tests := []struct {
+		name string
+		task *Task
+		want []string
+	}{
+		{
+			name: "no task gates",
+			task: &Task{ID: "1"},
+			want: []string{"go test ./..."},
+		},
+		{
+			name: "extend by default",
+			task: &Task{ID: "2", Gates: gate.Commands("markdownlint docs")},
+			want: []string{"go test ./...", "markdownlint docs"},
+		},
+		{
+			name: "replace",
+			task: &Task{ID: "3", Gates: gate.Commands("npm test"), GatesMode: GatesReplace},
+			want: []string{"npm test"},
+		},
+		{
+			name: "replace with nothing",
+			task: &Task{ID: "4", GatesMode: GatesReplace},
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, g := range cfg.EffectiveGates(tt.task) {
+				got = append(got, g.Run)
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("EffectiveGates() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateGatesMode(t *testing.T) {
+	cfg := &Config{Tasks: []Task{{ID: "1", GatesMode: "merge"}}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for unknown gatesMode")
+	}
+}
+
+func TestValidateGateTimeout(t *testing.T) {
+	for _, timeout := range []string{"", "30s", "10m"} {
+		cfg := &Config{GateTimeout: timeout}
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("Validate(%q) = %v, want nil", timeout, err)
+		}
+	}
+	for _, timeout := range []string{"soon", "10", "-5s"} {
+		cfg := &Config{GateTimeout: timeout}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Validate(%q) = nil, want error", timeout)
+		}
+	}
+
+	if got := (&Config{GateTimeout: "90s"}).GateTimeoutDuration(); got != 90*time.Second {
+		t.Errorf("GateTimeoutDuration() = %v, want 90s", got)
+	}
+	if got := (&Config{}).GateTimeoutDuration(); got != 0 {
+		t.Errorf("GateTimeoutDuration() = %v, want 0", got)
+	}
+}
+
+func TestLoadConfigStructuredGates(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "do-more.json")
+	data := `{
+		"name": "test",
+		"gates": [
+			"go build ./...",
+			{"name": "unit", "run": "go test ./...", "dir": "api", "env": {"CGO_ENABLED": "0"}, "timeout": "5m", "retries": 2},
+			{"run": "golangci-lint run", "required": false}
+		],
+		"maxIterations": 3,
+		"tasks": []
+	}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if len(cfg.Gates) != 3 {
+		t.Fatalf("len(Gates) = %d, want 3", len(cfg.Gates))
+	}
+	if cfg.Gates[0].Run != "go build ./..." || !cfg.Gates[0].IsRequired() {
+		t.Errorf("Gates[0] = %+v", cfg.Gates[0])
+	}
+	unit := cfg.Gates[1]
+	if unit.Name != "unit" || unit.Dir != "api" || unit.Env["CGO_ENABLED"] != "0" || unit.Timeout != "5m" || unit.Retries != 2 {
+		t.Errorf("Gates[1] = %+v", unit)
+	}
+	if cfg.Gates[2].IsRequired() {
+		t.Error("Gates[2] should be advisory")
+	}
+
+	if err := SaveConfig(path, cfg); err != nil {
+		t.Fatal(err)
+	}
+	saved, _ := os.ReadFile(path)
+	if !strings.Contains(string(saved), `"go build ./..."`) || !strings.Contains(string(saved), `"name": "unit"`) {
+		t.Errorf("saved gates lost their shape:\n%s", saved)
+	}
+}
+
+func TestValidateGates(t *testing.T) {
+	bad := []gate.Gate{
+		{Name: "empty"},
+		{Run: "make", Timeout: "forever"},
+		{Run: "make", Retries: -1},
+	}
+	for _, g := range bad {
+		if err := (&Config{Gates: []gate.Gate{g}}).Validate(); err == nil {
+			t.Errorf("Validate(%+v) = nil, want error", g)
+		}
+		cfg := &Config{Tasks: []Task{{ID: "1", Gates: []gate.Gate{g}}}}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Validate(task gate %+v) = nil, want error", g)
+		}
+	}
+}
+
+func TestGateOptions(t *testing.T) {
+	cfg := &Config{GateTimeout: "1m", GateConcurrency: 4, GateFailFast: true}
+	opts := cfg.GateOptions()
+	if opts.Timeout != time.Minute || opts.Concurrency != 4 || !opts.FailFast {
+		t.Errorf("GateOptions() = %+v", opts)
+	}
+	if err := (&Config{GateConcurrency: -1}).Validate(); err == nil {
+		t.Error("expected error for negative gateConcurrency")
+	}
+}
+
+func TestEffectiveOutputBudget(t *testing.T) {
+	if got := (&Config{}).EffectiveOutputBudget(); got != gate.DefaultOutputBudget {
+		t.Errorf("EffectiveOutputBudget() = %d, want %d", got, gate.DefaultOutputBudget)
+	}
+	if got := (&Config{OutputBudget: 500}).EffectiveOutputBudget(); got != 500 {
+		t.Errorf("EffectiveOutputBudget() = %d, want 500", got)
+	}
+	if err := (&Config{OutputBudget: -1}).Validate(); err == nil {
+		t.Error("expected error for negative outputBudget")
+	}
+}
+
+func TestValidateBaseline(t *testing.T) {
+	for _, mode := range []string{"", BaselineOff, BaselineTask, BaselineRun} {
+		if err := (&Config{Baseline: mode}).Validate(); err != nil {
+			t.Errorf("Validate(%q) = %v, want nil", mode, err)
+		}
+	}
+	if err := (&Config{Baseline: "always"}).Validate(); err == nil {
+		t.Error("expected error for unknown baseline mode")
+	}
+}
+
+func TestEffectiveStagnationLimit(t *testing.T) {
+	if got := (&Config{}).EffectiveStagnationLimit(); got != DefaultStagnationLimit {
+		t.Errorf("EffectiveStagnationLimit() = %d, want %d", got, DefaultStagnationLimit)
+	}
+	if got := (&Config{StagnationLimit: 5}).EffectiveStagnationLimit(); got != 5 {
+		t.Errorf("EffectiveStagnationLimit() = %d, want 5", got)
+	}
+	for _, limit := range []int{-1, 1} {
+		if err := (&Config{StagnationLimit: limit}).Validate(); err == nil {
+			t.Errorf("Validate(stagnationLimit=%d) = nil, want error", limit)
+		}
+	}
+}
+
+func TestProviderChain(t *testing.T) {
+	var task Task
+	if err := json.Unmarshal([]byte(`{"id": "1", "provider": ["claude", "opencode"]}`), &task); err != nil {
+		t.Fatal(err)
+	}
+	if got := task.ProviderChain("kimi"); !slices.Equal(got, []string{"claude", "opencode"}) {
+		t.Errorf("ProviderChain = %v, want [claude opencode]", got)
+	}
+	if got := (&Task{}).ProviderChain("kimi"); !slices.Equal(got, []string{"kimi"}) {
+		t.Errorf("ProviderChain = %v, want [kimi]", got)
+	}
+
+	single, _ := json.Marshal(Task{ID: "2", Provider: ProviderList{"claude"}})
+	if !strings.Contains(string(single), `"provider":"claude"`) {
+		t.Errorf("single provider should marshal as a string: %s", single)
+	}
+	if err := (&Config{Tasks: []Task{{ID: "1", Provider: ProviderList{"claude", ""}}}}).Validate(); err == nil {
+		t.Error("expected error for empty provider name")
+	}
+}
+
+func TestProviderSwitchDefaults(t *testing.T) {
+	var s *ProviderSwitch
+	if !s.SwitchOnError() || !s.SwitchOnStagnation() || s.SwitchAfterFailures() != 0 {
+		t.Errorf("nil ProviderSwitch defaults = %v/%v/%d", s.SwitchOnError(), s.SwitchOnStagnation(), s.SwitchAfterFailures())
+	}
+	off := false
+	s = &ProviderSwitch{OnError: &off, AfterFailures: 2}
+	if s.SwitchOnError() || !s.SwitchOnStagnation() || s.SwitchAfterFailures() != 2 {
+		t.Errorf("ProviderSwitch = %+v", s)
+	}
+	if err := (&Config{ProviderSwitch: &ProviderSwitch{AfterFailures: -1}}).Validate(); err == nil {
+		t.Error("expected error for negative afterFailures")
+	}
+}
+
+func TestCommandProviders(t *testing.T) {
+	var cfg Config
+	data := `{"provider": "aider", "providers": {"aider": {"command": "aider", "args": ["--message", "{{prompt}}"]}}}`
+	if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate = %v", err)
+	}
+
+	registry := provider.NewProviderRegistry()
+	cfg.RegisterProviders(registry)
+	if _, ok := registry.Get("aider"); !ok {
+		t.Error("aider provider was not registered")
+	}
+
+	cfg.Providers["claude"] = provider.CommandSpec{PromptVia: provider.PromptStdin}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate = %v, want a built-in override without a command to be valid", err)
+	}
+
+	cfg.Providers["broken"] = provider.CommandSpec{}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for provider without a command")
+	}
+}
+
+func TestHTTPProviders(t *testing.T) {
+	var cfg Config
+	data := `{"provider": "local", "httpProviders": {"local": {"baseUrl": "http://localhost:8080/v1", "model": "qwen", "timeout": "2m"}}}`
+	if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate = %v", err)
+	}
+
+	registry := provider.NewProviderRegistry()
+	cfg.RegisterProviders(registry)
+	if _, ok := registry.Get("local"); !ok {
+		t.Error("local provider was not registered")
+	}
+
+	cfg.HTTPProviders["broken"] = provider.HTTPSpec{Model: "qwen"}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for HTTP provider without a baseUrl")
+	}
+	delete(cfg.HTTPProviders, "broken")
+
+	cfg.Providers = map[string]provider.CommandSpec{"local": {Command: "local"}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for a name defined as both kinds of provider")
+	}
+}
+
+func TestResumeSession(t *testing.T) {
+	task := &Task{ID: "1", Session: &Session{Provider: "claude", ID: "abc"}}
+	if got := task.ResumeSession("claude"); got != "abc" {
+		t.Errorf("ResumeSession(claude) = %q, want abc", got)
+	}
+	if got := task.ResumeSession("opencode"); got != "" {
+		t.Errorf("ResumeSession(opencode) = %q, want empty for another provider's session", got)
+	}
+	task.FreshSession = true
+	if got := task.ResumeSession("claude"); got != "" {
+		t.Errorf("ResumeSession with freshSession = %q, want empty", got)
+	}
+}
+
+func TestRunOptions(t *testing.T) {
+	cfg := &Config{Provider: "claude", Model: "sonnet", ExtraArgs: []string{"--verbose"}}
+	opts := cfg.RunOptions(&Task{ID: "1"}, "claude")
+	if opts.Model != "sonnet" || !slices.Equal(opts.ExtraArgs, []string{"--verbose"}) {
+		t.Errorf("RunOptions = %+v, want the project's settings", opts)
+	}
+	task := &Task{ID: "2", Model: "opus", ExtraArgs: []string{"--permission-mode", "acceptEdits"}}
+	opts = cfg.RunOptions(task, "claude")
+	if opts.Model != "opus" || !slices.Equal(opts.ExtraArgs, []string{"--verbose", "--permission-mode", "acceptEdits"}) {
+		t.Errorf("RunOptions = %+v, want the task's model and both sets of args", opts)
+	}
+
+	// A chain starting with kimi: the task's settings go to kimi, the
+	// project's stay with claude, and other fallbacks get neither.
+	task = &Task{ID: "3", Provider: ProviderList{"kimi", "claude", "local"}, Model: "k2"}
+	if opts := cfg.RunOptions(task, "kimi"); opts.Model != "k2" || len(opts.ExtraArgs) != 0 {
+		t.Errorf("RunOptions(kimi) = %+v, want only the task's model", opts)
+	}
+	if opts := cfg.RunOptions(task, "claude"); opts.Model != "sonnet" || !slices.Equal(opts.ExtraArgs, []string{"--verbose"}) {
+		t.Errorf("RunOptions(claude) = %+v, want only the project's settings", opts)
+	}
+	if opts := cfg.RunOptions(task, "local"); opts.Model != "" || len(opts.ExtraArgs) != 0 {
+		t.Errorf("RunOptions(local) = %+v, want no settings", opts)
+	}
+}
+
+func TestTotalUsage(t *testing.T) {
+	cfg := &Config{Tasks: []Task{
+		{ID: "1", Usage: provider.Usage{InputTokens: 10, OutputTokens: 2, CostUSD: 0.25, DurationMs: 100}},
+		{ID: "2"},
+		{ID: "3", Usage: provider.Usage{InputTokens: 5, CostUSD: 0.5, DurationMs: 50}},
+	}}
+	want := provider.Usage{InputTokens: 15, OutputTokens: 2, CostUSD: 0.75, DurationMs: 150}
+	if got := cfg.TotalUsage(); got != want {
+		t.Errorf("TotalUsage = %+v, want %+v", got, want)
+	}
+
+	data, err := json.Marshal(Task{ID: "4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "usage") {
+		t.Errorf("task without usage marshaled as %s, want the field left out", data)
+	}
+}
+
+func TestBudget(t *testing.T) {
+	var none *Budget
+	if none.Exceeded(provider.Usage{CostUSD: 100}) != "" || none.TaskDuration() != 0 || none.RunDuration() != 0 {
+		t.Error("a missing budget should be unlimited")
+	}
+
+	b := &Budget{MaxCostUSD: 5, MaxTokens: 1000, MaxTaskDuration: "30m", MaxRunDuration: "8h"}
+	if got := b.Exceeded(provider.Usage{CostUSD: 4.99, InputTokens: 900, OutputTokens: 99}); got != "" {
+		t.Errorf("Exceeded = %q, want nothing under the caps", got)
+	}
+	if got := b.Exceeded(provider.Usage{CostUSD: 5.02}); got != "cost $5.02 of $5.00" {
+		t.Errorf("Exceeded = %q, want the cost cap", got)
+	}
+	if got := b.Exceeded(provider.Usage{InputTokens: 900, OutputTokens: 100}); got != "1000 of 1000 tokens" {
+		t.Errorf("Exceeded = %q, want the token cap", got)
+	}
+	if b.TaskDuration() != 30*time.Minute || b.RunDuration() != 8*time.Hour {
+		t.Errorf("durations = %v, %v", b.TaskDuration(), b.RunDuration())
+	}
+
+	cfg := &Config{Budget: &Budget{MaxRunDuration: "soon"}}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "maxRunDuration") {
+		t.Errorf("Validate = %v, want an invalid maxRunDuration error", err)
+	}
+	cfg.Budget = &Budget{MaxCostUSD: -1}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for negative maxCostUsd")
+	}
+}
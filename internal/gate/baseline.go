@@ -0,0 +1,72 @@
+package gate
+
+import "strings"
+
+// ApplyBaseline compares results with a baseline run of the same gates
+// taken before the task started, and marks what was already failing. A
+// failed gate whose failures all appear in the baseline is marked
+// PreExisting and no longer blocks AllGatesPassed. When neither run's
+// output could be parsed into failures, the gate is pre-existing only if it
+// failed the same way in both, as told by FailureFingerprint; any
+// difference in the normalized output counts as a new failure.
+func ApplyBaseline(results, baseline []GateResult) []GateResult {
+	before := make(map[string]GateResult, len(baseline))
+	for _, b := range baseline {
+		before[resultKey(b)] = b
+	}
+
+	out := make([]GateResult, len(results))
+	for i, r := range results {
+		out[i] = r
+		b, ok := before[resultKey(r)]
+		if r.Passed || r.Skipped || !ok || b.Passed || b.Skipped || (r.TimedOut && !b.TimedOut) {
+			continue
+		}
+		if len(r.Failures) == 0 || len(b.Failures) == 0 {
+			out[i].PreExisting = len(r.Failures) == 0 && len(b.Failures) == 0 &&
+				FailureFingerprint([]GateResult{r}) == FailureFingerprint([]GateResult{b})
+			continue
+		}
+
+		known := make(map[string]bool, len(b.Failures))
+		for _, f := range b.Failures {
+			known[failureKey(f)] = true
+		}
+		failures := make([]Failure, len(r.Failures))
+		allKnown := true
+		for j, f := range r.Failures {
+			f.PreExisting = known[failureKey(f)]
+			allKnown = allKnown && f.PreExisting
+			failures[j] = f
+		}
+		out[i].Failures = failures
+		out[i].PreExisting = allKnown
+	}
+	return out
+}
+
+// BaselineSummary describes the gates that failed in a baseline run, or
+// returns "" if none did.
+func BaselineSummary(baseline []GateResult, budget int) string {
+	var failing []GateResult
+	for _, r := range baseline {
+		if !r.Passed && !r.Skipped {
+			failing = append(failing, r)
+		}
+	}
+	if len(failing) == 0 {
+		return ""
+	}
+	return GateFailureSummaryWithBudget(failing, budget)
+}
+
+func resultKey(r GateResult) string {
+	return r.Name + "\x00" + r.Command
+}
+
+// failureKey identifies a failure across runs. Line numbers are left out
+// because unrelated edits move them.
+func failureKey(f Failure) string {
+	msg, _, _ := strings.Cut(f.Message, "\n")
+	return f.Test + "\x00" + f.File + "\x00" + msg
+}
@@ -0,0 +1,73 @@
+package gate
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApplyBaseline(t *testing.T) {
+	baseline := []GateResult{
+		{Command: "go test ./...", Failures: []Failure{{Test: "TestLegacy", File: "legacy_test.go", Line: 10, Message: "flaky"}}},
+		{Command: "make lint", Output: "lint: 3 issues (took 1.2s)"},
+		{Command: "go vet ./...", Passed: true},
+		{Command: "go build ./...", Output: "main.go:3: undefined: x"},
+	}
+
+	results := ApplyBaseline([]GateResult{
+		// Same failure, moved to another line: still pre-existing.
+		{Command: "go test ./...", Failures: []Failure{{Test: "TestLegacy", File: "legacy_test.go", Line: 12, Message: "flaky"}}},
+		// Unparsed output that failed the same way before.
+		{Command: "make lint", Output: "lint: 3 issues (took 2.5s)"},
+		// Passed before, fails now.
+		{Command: "go vet ./...", Output: "vet: oops"},
+		// Unparsed output with a new failure added.
+		{Command: "go build ./...", Output: "main.go:3: undefined: x\nlogin.go:9: undefined: y"},
+	}, baseline)
+	if !results[0].PreExisting || !results[0].Failures[0].PreExisting {
+		t.Errorf("results[0] = %+v, want pre-existing", results[0])
+	}
+	if !results[1].PreExisting {
+		t.Errorf("results[1] = %+v, want pre-existing", results[1])
+	}
+	if results[2].PreExisting {
+		t.Errorf("results[2] = %+v, want a new failure", results[2])
+	}
+	if results[3].PreExisting {
+		t.Errorf("results[3] = %+v, want a new failure in an already failing gate", results[3])
+	}
+	if AllGatesPassed(results) {
+		t.Error("the new go vet failure should block")
+	}
+	if !AllGatesPassed(results[:2]) {
+		t.Error("pre-existing failures should not block")
+	}
+}
+
+func TestApplyBaselineNewTestFailure(t *testing.T) {
+	baseline := []GateResult{
+		{Command: "go test ./...", Failures: []Failure{{Test: "TestLegacy", Message: "flaky"}}},
+	}
+	results := ApplyBaseline([]GateResult{
+		{Command: "go test ./...", Failures: []Failure{
+			{Test: "TestLegacy", Message: "flaky"},
+			{Test: "TestLogin", File: "login_test.go", Line: 5, Message: "got 500"},
+		}},
+	}, baseline)
+	if results[0].PreExisting {
+		t.Fatal("a gate with a new failing test must not be pre-existing")
+	}
+	summary := GateFailureSummary(results)
+	if !strings.Contains(summary, "- [pre-existing] TestLegacy: flaky") || !strings.Contains(summary, "- TestLogin at login_test.go:5: got 500") {
+		t.Errorf("summary should tell old and new failures apart:\n%s", summary)
+	}
+}
+
+func TestBaselineSummary(t *testing.T) {
+	if got := BaselineSummary([]GateResult{{Command: "true", Passed: true}}, 0); got != "" {
+		t.Errorf("BaselineSummary = %q, want empty when nothing failed", got)
+	}
+	got := BaselineSummary([]GateResult{{Command: "make lint", ExitCode: 2, Output: "3 issues\n"}}, 0)
+	if !strings.Contains(got, "FAIL: make lint (exit 2)") {
+		t.Errorf("BaselineSummary = %q", got)
+	}
+}
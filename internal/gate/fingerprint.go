@@ -0,0 +1,52 @@
+package gate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// volatile matches output that changes between otherwise identical runs:
+// timestamps, durations, memory addresses, goroutine numbers and temporary
+// directories.
+var volatile = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:?\d{2})?`), "<time>"},
+	{regexp.MustCompile(`\b\d+(\.\d+)?(ns|µs|us|ms|s|m|h)\b`), "<dur>"},
+	{regexp.MustCompile(`0x[0-9a-fA-F]+`), "<addr>"},
+	{regexp.MustCompile(`goroutine \d+`), "goroutine <n>"},
+	{regexp.MustCompile(`/tmp/[^\s/:]+`), "<tmp>"},
+}
+
+// NormalizeOutput removes the parts of gate output that vary from run to
+// run, so two runs that failed the same way compare equal.
+func NormalizeOutput(s string) string {
+	s = StripANSI(s)
+	for _, v := range volatile {
+		s = v.re.ReplaceAllString(s, v.repl)
+	}
+	return strings.TrimSpace(s)
+}
+
+// FailureFingerprint hashes the normalized failures in results. Results
+// that failed the same way produce the same fingerprint; it is empty when
+// nothing failed.
+func FailureFingerprint(results []GateResult) string {
+	h := sha256.New()
+	failed := false
+	for _, r := range results {
+		if r.Passed {
+			continue
+		}
+		failed = true
+		fmt.Fprintf(h, "%s\x00%d\x00%t\x00%s\x00", r.Label(), r.ExitCode, r.TimedOut, NormalizeOutput(failureDetail(r)))
+	}
+	if !failed {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
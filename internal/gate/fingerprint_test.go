@@ -0,0 +1,19 @@
+package gate
+
+import "testing"
+
+func TestFailureFingerprint(t *testing.T) {
+	a := []GateResult{{Command: "go test ./...", ExitCode: 1, Output: "--- FAIL: TestX (0.03s)\npanic at 0xc000123456 in goroutine 7\nFAIL\tpkg\t0.512s\n"}}
+	b := []GateResult{{Command: "go test ./...", ExitCode: 1, Output: "--- FAIL: TestX (0.05s)\npanic at 0xc000999999 in goroutine 12\nFAIL\tpkg\t0.498s\n"}}
+	c := []GateResult{{Command: "go test ./...", ExitCode: 1, Output: "--- FAIL: TestY (0.05s)\n"}}
+
+	if FailureFingerprint(a) != FailureFingerprint(b) {
+		t.Error("runs that differ only in timings and addresses should match")
+	}
+	if FailureFingerprint(a) == FailureFingerprint(c) {
+		t.Error("different failures should not match")
+	}
+	if got := FailureFingerprint([]GateResult{{Command: "true", Passed: true}}); got != "" {
+		t.Errorf("FailureFingerprint of passing gates = %q, want empty", got)
+	}
+}
@@ -2,48 +2,361 @@ package gate
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/tmdgusya/do-more/internal/proc"
 )
 
+// Gate is a check that decides whether a task is done. In config files a
+// gate is either a plain command string or an object with these fields.
+type Gate struct {
+	Name     string            `json:"name,omitempty"`
+	Run      string            `json:"run"`
+	Dir      string            `json:"dir,omitempty"`
+	Env      map[string]string `json:"env,omitempty"`
+	Timeout  string            `json:"timeout,omitempty"`
+	Required *bool             `json:"required,omitempty"`
+	Retries  int               `json:"retries,omitempty"`
+	Parser   string            `json:"parser,omitempty"`
+	Report   string            `json:"report,omitempty"`
+}
+
+// Commands returns plain gates for the given shell commands.
+func Commands(commands ...string) []Gate {
+	gates := make([]Gate, len(commands))
+	for i, c := range commands {
+		gates[i] = Gate{Run: c}
+	}
+	return gates
+}
+
+func (g *Gate) UnmarshalJSON(data []byte) error {
+	var run string
+	if err := json.Unmarshal(data, &run); err == nil {
+		*g = Gate{Run: run}
+		return nil
+	}
+	type plain Gate
+	var p plain
+	if err := json.Unmarshal(data, &p); err != nil {
+		return fmt.Errorf("gate must be a command string or an object: %w", err)
+	}
+	*g = Gate(p)
+	return nil
+}
+
+// MarshalJSON writes gates that only set a command as plain strings so
+// existing config files keep their shape.
+func (g Gate) MarshalJSON() ([]byte, error) {
+	if g.Name == "" && g.Dir == "" && len(g.Env) == 0 && g.Timeout == "" && g.Required == nil && g.Retries == 0 && g.Parser == "" && g.Report == "" {
+		return json.Marshal(g.Run)
+	}
+	type plain Gate
+	return json.Marshal(plain(g))
+}
+
+// Label returns the gate's name, or its command if it has none.
+func (g Gate) Label() string {
+	if g.Name != "" {
+		return g.Name
+	}
+	return g.Run
+}
+
+// IsRequired reports whether a failure of g blocks task completion. Gates
+// are required unless they set "required": false.
+func (g Gate) IsRequired() bool {
+	return g.Required == nil || *g.Required
+}
+
+func (g Gate) Validate() error {
+	if strings.TrimSpace(g.Run) == "" {
+		return fmt.Errorf("gate %q has no command to run", g.Name)
+	}
+	if g.Timeout != "" {
+		if d, err := time.ParseDuration(g.Timeout); err != nil || d < 0 {
+			return fmt.Errorf("gate %q: invalid timeout %q", g.Label(), g.Timeout)
+		}
+	}
+	if g.Retries < 0 {
+		return fmt.Errorf("gate %q: retries must not be negative", g.Label())
+	}
+	if !knownParser(g.Parser) {
+		return fmt.Errorf("gate %q: unknown parser %q", g.Label(), g.Parser)
+	}
+	return nil
+}
+
 type GateResult struct {
-	Command string
-	Passed  bool
-	Output  string
+	Name        string        `json:"name,omitempty"`
+	Command     string        `json:"command"`
+	Passed      bool          `json:"passed"`
+	Advisory    bool          `json:"advisory,omitempty"`
+	ExitCode    int           `json:"exitCode"`
+	Duration    time.Duration `json:"duration"`
+	Attempts    int           `json:"attempts,omitempty"`
+	Output      string        `json:"output"`
+	TimedOut    bool          `json:"timedOut,omitempty"`
+	Skipped     bool          `json:"skipped,omitempty"`
+	Failures    []Failure     `json:"failures,omitempty"`
+	PreExisting bool          `json:"preExisting,omitempty"`
+}
+
+// Label returns the gate's name, or its command if it has none.
+func (r GateResult) Label() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.Command
+}
+
+// Options control how a set of gates is run.
+type Options struct {
+	// Timeout limits each gate that does not set its own. Zero means no limit.
+	Timeout time.Duration
+	// Concurrency is the number of gates run at once. Values below 2 run
+	// gates one after another.
+	Concurrency int
+	// FailFast cancels the remaining gates once a required gate fails.
+	FailFast bool
 }
 
-func RunGates(ctx context.Context, gates []string, workDir string) ([]GateResult, error) {
-	results := make([]GateResult, 0, len(gates))
-	for _, gate := range gates {
-		cmd := exec.CommandContext(ctx, "sh", "-c", gate)
-		cmd.Dir = workDir
-		output, err := cmd.CombinedOutput()
-		result := GateResult{
-			Command: gate,
-			Passed:  err == nil,
-			Output:  string(output),
+// errFailFast is the cancellation cause once a required gate has failed in
+// fail-fast mode.
+var errFailFast = errors.New("a required gate failed")
+
+func RunGates(ctx context.Context, gates []Gate, workDir string) ([]GateResult, error) {
+	return RunGatesWithOptions(ctx, gates, workDir, Options{})
+}
+
+// RunGatesWithOptions runs gates as configured by opts. Results are in the
+// same order as gates regardless of which gate finishes first. A gate that
+// runs out of time has its whole process group killed and is reported as
+// timed out with whatever output it produced.
+func RunGatesWithOptions(ctx context.Context, gates []Gate, workDir string, opts Options) ([]GateResult, error) {
+	timeouts := make([]time.Duration, len(gates))
+	for i, g := range gates {
+		timeouts[i] = opts.Timeout
+		if g.Timeout != "" {
+			d, err := time.ParseDuration(g.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("gate %q: invalid timeout: %w", g.Label(), err)
+			}
+			timeouts[i] = d
 		}
-		results = append(results, result)
 	}
+
+	runCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	workers := min(max(opts.Concurrency, 1), len(gates))
+	next := make(chan int, len(gates))
+	for i := range gates {
+		next <- i
+	}
+	close(next)
+
+	results := make([]GateResult, len(gates))
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				g := gates[i]
+				if context.Cause(runCtx) == errFailFast {
+					results[i] = GateResult{Name: g.Name, Command: g.Run, Advisory: !g.IsRequired(), ExitCode: -1, Skipped: true}
+					continue
+				}
+				res := runGateWithRetries(runCtx, g, workDir, timeouts[i])
+				// A gate killed because another one failed did not fail on
+				// its own.
+				if !res.Passed && res.ExitCode == -1 && context.Cause(runCtx) == errFailFast {
+					res.Skipped = true
+				}
+				results[i] = res
+				if opts.FailFast && !res.Passed && !res.Advisory && !res.Skipped {
+					cancel(errFailFast)
+				}
+			}
+		}()
+	}
+	wg.Wait()
 	return results, nil
 }
 
+// runGateWithRetries runs g until it passes or its retries are used up.
+func runGateWithRetries(ctx context.Context, g Gate, workDir string, timeout time.Duration) GateResult {
+	start := time.Now()
+	var res GateResult
+	for attempt := 1; attempt <= g.Retries+1; attempt++ {
+		res = runGate(ctx, g, workDir, timeout)
+		res.Attempts = attempt
+		if res.Passed || ctx.Err() != nil {
+			break
+		}
+	}
+	res.Duration = time.Since(start)
+	return res
+}
+
+func runGate(ctx context.Context, g Gate, workDir string, timeout time.Duration) GateResult {
+	gateCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		gateCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(gateCtx, "sh", "-c", g.Run)
+	cmd.Dir = workDir
+	if g.Dir != "" {
+		cmd.Dir = g.Dir
+		if !filepath.IsAbs(g.Dir) {
+			cmd.Dir = filepath.Join(workDir, g.Dir)
+		}
+	}
+	if len(g.Env) > 0 {
+		cmd.Env = os.Environ()
+		keys := make([]string, 0, len(g.Env))
+		for k := range g.Env {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			cmd.Env = append(cmd.Env, k+"="+g.Env[k])
+		}
+	}
+	proc.KillGroupOnCancel(cmd)
+
+	output, err := cmd.CombinedOutput()
+	exitCode := 0
+	if err != nil {
+		exitCode = -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
+		} else {
+			output = append(output, []byte(err.Error()+"\n")...)
+		}
+	}
+	res := GateResult{
+		Name:     g.Name,
+		Command:  g.Run,
+		Passed:   err == nil,
+		Advisory: !g.IsRequired(),
+		ExitCode: exitCode,
+		Output:   string(output),
+		TimedOut: errors.Is(gateCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil,
+	}
+	if !res.Passed {
+		report := output
+		if g.Report != "" {
+			path := g.Report
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(cmd.Dir, path)
+			}
+			if data, err := os.ReadFile(path); err == nil {
+				report = data
+			}
+		}
+		res.Failures = ParseFailures(g.Parser, report)
+	}
+	return res
+}
+
+// AllGatesPassed reports whether every required gate passed. Advisory and
+// pre-existing gate failures do not count.
 func AllGatesPassed(results []GateResult) bool {
 	for _, r := range results {
-		if !r.Passed {
+		if !r.Passed && !r.Advisory && !r.PreExisting {
 			return false
 		}
 	}
 	return true
 }
 
+// GateFailureSummary describes the failed gates in results for the next
+// prompt, keeping gate output within DefaultOutputBudget.
 func GateFailureSummary(results []GateResult) string {
-	var sb strings.Builder
+	return GateFailureSummaryWithBudget(results, DefaultOutputBudget)
+}
+
+// GateFailureSummaryWithBudget is like GateFailureSummary but keeps about
+// budget bytes of gate output, shared fairly between the failed gates. A
+// budget of 0 or less means no limit.
+func GateFailureSummaryWithBudget(results []GateResult, budget int) string {
+	var failed []GateResult
+	var details []string
 	for _, r := range results {
-		if !r.Passed {
-			fmt.Fprintf(&sb, "FAIL: %s\n%s\n", r.Command, r.Output)
+		if r.Passed {
+			continue
+		}
+		detail := ""
+		if !r.Skipped {
+			detail = CleanOutput(failureDetail(r))
+		}
+		failed = append(failed, r)
+		details = append(details, detail)
+	}
+	if budget > 0 {
+		sizes := make([]int, len(details))
+		for i, d := range details {
+			sizes[i] = len(d)
+		}
+		for i, share := range shareBudget(sizes, budget) {
+			details[i] = Clip(details[i], share)
+		}
+	}
+
+	var sb strings.Builder
+	for i, r := range failed {
+		title := r.Command
+		if r.Name != "" {
+			title = fmt.Sprintf("%s (%s)", r.Name, r.Command)
+		}
+		switch {
+		case r.Skipped:
+			fmt.Fprintf(&sb, "SKIPPED: %s (cancelled because a required gate failed)\n", title)
+		case r.TimedOut:
+			fmt.Fprintf(&sb, "TIMEOUT: %s\nThe gate did not finish within its time limit and was killed. It may be waiting for input or running in watch mode. Partial output:\n%s\n", title, details[i])
+		case r.PreExisting:
+			fmt.Fprintf(&sb, "PRE-EXISTING: %s (exit %d, already failing before this task; does not block completion)\n%s\n", title, r.ExitCode, details[i])
+		case r.Advisory:
+			fmt.Fprintf(&sb, "ADVISORY: %s (exit %d, does not block completion)\n%s\n", title, r.ExitCode, details[i])
+		default:
+			fmt.Fprintf(&sb, "FAIL: %s (exit %d)\n%s\n", title, r.ExitCode, details[i])
+		}
+	}
+	return sb.String()
+}
+
+// failureDetail returns the parsed failures of r as a compact list, or its
+// raw output when nothing could be parsed or the gate timed out.
+func failureDetail(r GateResult) string {
+	if len(r.Failures) == 0 || r.TimedOut {
+		return r.Output
+	}
+	var sb strings.Builder
+	for i, f := range r.Failures {
+		if i == MaxFailures {
+			fmt.Fprintf(&sb, "- ...and %d more\n", len(r.Failures)-MaxFailures)
+			break
+		}
+		marker := ""
+		if f.PreExisting {
+			marker = "[pre-existing] "
 		}
+		fmt.Fprintf(&sb, "- %s%s\n", marker, strings.ReplaceAll(f.String(), "\n", "\n  "))
 	}
 	return sb.String()
 }
@@ -2,11 +2,16 @@ package gate
 
 import (
 	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestRunGatesAllPass(t *testing.T) {
-	gates := []string{"true", "echo hello"}
+	gates := Commands("true", "echo hello")
 	results, err := RunGates(context.Background(), gates, t.TempDir())
 	if err != nil {
 		t.Fatalf("RunGates failed: %v", err)
@@ -22,7 +27,7 @@ func TestRunGatesAllPass(t *testing.T) {
 }
 
 func TestRunGatesOneFails(t *testing.T) {
-	gates := []string{"true", "false", "true"}
+	gates := Commands("true", "false", "true")
 	results, err := RunGates(context.Background(), gates, t.TempDir())
 	if err != nil {
 		t.Fatalf("RunGates failed: %v", err)
@@ -39,7 +44,7 @@ func TestRunGatesOneFails(t *testing.T) {
 }
 
 func TestRunGatesEmpty(t *testing.T) {
-	results, err := RunGates(context.Background(), []string{}, t.TempDir())
+	results, err := RunGates(context.Background(), Commands(), t.TempDir())
 	if err != nil {
 		t.Fatalf("RunGates failed: %v", err)
 	}
@@ -76,3 +81,176 @@ func TestGateFailureSummary(t *testing.T) {
 		t.Error("expected non-empty summary")
 	}
 }
+
+func TestRunGatesTimeoutKillsProcessGroup(t *testing.T) {
+	// The gate prints, then waits on a child that would outlive a plain kill
+	// of the shell and hold the output pipe open.
+	gates := Commands("echo partial; sleep 30 & wait", "true")
+	start := time.Now()
+	results, err := RunGatesWithOptions(context.Background(), gates, t.TempDir(), Options{Timeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("RunGatesWithOptions failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("gates took %v, want the hung gate killed promptly", elapsed)
+	}
+	if results[0].Passed || !results[0].TimedOut {
+		t.Errorf("gate 0 = %+v, want failed and timed out", results[0])
+	}
+	if !strings.Contains(results[0].Output, "partial") {
+		t.Errorf("gate 0 output = %q, want partial output captured", results[0].Output)
+	}
+	if !results[1].Passed || results[1].TimedOut {
+		t.Errorf("gate 1 = %+v, want passed", results[1])
+	}
+
+	summary := GateFailureSummary(results)
+	if !strings.Contains(summary, "TIMEOUT: echo partial") || !strings.Contains(summary, "partial\n") {
+		t.Errorf("summary does not report the timeout:\n%s", summary)
+	}
+}
+
+func TestRunGatesCancelledIsNotTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results, err := RunGatesWithOptions(ctx, Commands("sleep 30"), t.TempDir(), Options{Timeout: time.Minute})
+	if err != nil {
+		t.Fatalf("RunGatesWithOptions failed: %v", err)
+	}
+	if results[0].Passed || results[0].TimedOut {
+		t.Errorf("result = %+v, want failed without timeout", results[0])
+	}
+}
+
+func TestRunGatesStructured(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	gates := []Gate{
+		{Name: "where", Run: "basename \"$PWD\"", Dir: "sub"},
+		{Run: "echo $GATE_MODE", Env: map[string]string{"GATE_MODE": "strict"}},
+		{Run: "exit 3"},
+	}
+	results, err := RunGates(context.Background(), gates, dir)
+	if err != nil {
+		t.Fatalf("RunGates failed: %v", err)
+	}
+	if results[0].Name != "where" || results[0].Output != "sub\n" {
+		t.Errorf("gate 0 = %+v, want to run in sub", results[0])
+	}
+	if results[1].Output != "strict\n" {
+		t.Errorf("gate 1 output = %q, want env applied", results[1].Output)
+	}
+	if results[2].Passed || results[2].ExitCode != 3 {
+		t.Errorf("gate 2 = %+v, want exit code 3", results[2])
+	}
+}
+
+func TestRunGatesRetries(t *testing.T) {
+	dir := t.TempDir()
+	// Fails the first two times, then passes.
+	flaky := Gate{Run: "echo x >> runs; test $(wc -l < runs) -ge 3", Retries: 2}
+	results, err := RunGates(context.Background(), []Gate{flaky}, dir)
+	if err != nil {
+		t.Fatalf("RunGates failed: %v", err)
+	}
+	if !results[0].Passed || results[0].Attempts != 3 {
+		t.Errorf("result = %+v, want passed on attempt 3", results[0])
+	}
+}
+
+func TestAdvisoryGatesDoNotBlock(t *testing.T) {
+	advisory := false
+	gates := []Gate{{Run: "true"}, {Name: "lint", Run: "echo style; false", Required: &advisory}}
+	results, err := RunGates(context.Background(), gates, t.TempDir())
+	if err != nil {
+		t.Fatalf("RunGates failed: %v", err)
+	}
+	if !results[1].Advisory || results[1].Passed {
+		t.Errorf("result = %+v, want a failed advisory gate", results[1])
+	}
+	if !AllGatesPassed(results) {
+		t.Error("advisory failures should not block AllGatesPassed")
+	}
+	if summary := GateFailureSummary(results); !strings.Contains(summary, "ADVISORY: lint") {
+		t.Errorf("summary should report the advisory gate:\n%s", summary)
+	}
+}
+
+func TestGateJSON(t *testing.T) {
+	var gates []Gate
+	data := `["go test ./...", {"name": "lint", "run": "golangci-lint run", "required": false}]`
+	if err := json.Unmarshal([]byte(data), &gates); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if gates[0].Run != "go test ./..." || gates[1].Label() != "lint" || gates[1].IsRequired() {
+		t.Errorf("gates = %+v", gates)
+	}
+
+	out, err := json.Marshal(gates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `["go test ./...",{"name":"lint","run":"golangci-lint run","required":false}]`
+	if string(out) != want {
+		t.Errorf("Marshal = %s, want %s", out, want)
+	}
+}
+
+func TestRunGatesConcurrently(t *testing.T) {
+	gates := Commands("sleep 0.3; echo a", "echo b", "sleep 0.3; echo c", "sleep 0.1; echo d")
+	start := time.Now()
+	results, err := RunGatesWithOptions(context.Background(), gates, t.TempDir(), Options{Concurrency: 4})
+	if err != nil {
+		t.Fatalf("RunGatesWithOptions failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 650*time.Millisecond {
+		t.Errorf("gates took %v, want them to overlap", elapsed)
+	}
+	for i, want := range []string{"a\n", "b\n", "c\n", "d\n"} {
+		if results[i].Command != gates[i].Run || results[i].Output != want {
+			t.Errorf("results[%d] = %+v, want output %q in gate order", i, results[i], want)
+		}
+	}
+}
+
+func TestRunGatesFailFast(t *testing.T) {
+	gates := Commands("true", "false", "echo never")
+	results, err := RunGatesWithOptions(context.Background(), gates, t.TempDir(), Options{FailFast: true})
+	if err != nil {
+		t.Fatalf("RunGatesWithOptions failed: %v", err)
+	}
+	if !results[0].Passed || results[1].Passed || results[1].Skipped {
+		t.Errorf("results = %+v, want gate 0 passed and gate 1 failed", results[:2])
+	}
+	if !results[2].Skipped || results[2].Output != "" {
+		t.Errorf("results[2] = %+v, want skipped without running", results[2])
+	}
+	if summary := GateFailureSummary(results); !strings.Contains(summary, "SKIPPED: echo never") {
+		t.Errorf("summary should mention the skipped gate:\n%s", summary)
+	}
+}
+
+func TestRunGatesFailFastCancelsRunning(t *testing.T) {
+	advisory := false
+	gates := []Gate{
+		{Run: "sleep 30"},
+		{Run: "exit 1", Required: &advisory},
+		{Run: "sleep 0.1; exit 2"},
+	}
+	start := time.Now()
+	results, err := RunGatesWithOptions(context.Background(), gates, t.TempDir(), Options{Concurrency: 3, FailFast: true})
+	if err != nil {
+		t.Fatalf("RunGatesWithOptions failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("gates took %v, want the running gate cancelled", elapsed)
+	}
+	if !results[0].Skipped {
+		t.Errorf("results[0] = %+v, want cancelled", results[0])
+	}
+	if results[1].Skipped || results[2].Skipped || results[2].ExitCode != 2 {
+		t.Errorf("results = %+v, want gates 1 and 2 to report their own failures", results[1:])
+	}
+}
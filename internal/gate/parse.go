@@ -0,0 +1,366 @@
+package gate
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Parser names accepted in a gate's "parser" field. An empty parser
+// detects the format from the output.
+const (
+	ParserAuto         = "auto"
+	ParserNone         = "none"
+	ParserGoTestJSON   = "go-test-json"
+	ParserJUnit        = "junit"
+	ParserGolangciJSON = "golangci-lint-json"
+)
+
+const (
+	// maxFailureLines caps how many output lines one failure keeps.
+	maxFailureLines = 10
+	// MaxFailures caps how many failures a gate reports to the provider.
+	MaxFailures = 30
+)
+
+// Failure is one failing test or lint issue extracted from gate output.
+type Failure struct {
+	Test        string `json:"test,omitempty"`
+	File        string `json:"file,omitempty"`
+	Line        int    `json:"line,omitempty"`
+	Message     string `json:"message,omitempty"`
+	PreExisting bool   `json:"preExisting,omitempty"`
+}
+
+func (f Failure) String() string {
+	var b strings.Builder
+	b.WriteString(f.Test)
+	if f.File != "" {
+		if b.Len() > 0 {
+			b.WriteString(" at ")
+		}
+		b.WriteString(f.File)
+		if f.Line > 0 {
+			fmt.Fprintf(&b, ":%d", f.Line)
+		}
+	}
+	if f.Message != "" {
+		if b.Len() > 0 {
+			b.WriteString(": ")
+		}
+		b.WriteString(f.Message)
+	}
+	return b.String()
+}
+
+// Parser extracts failures from a gate's output in one format.
+type Parser interface {
+	// Detect reports whether output looks like this parser's format.
+	Detect(output []byte) bool
+	Parse(output []byte) ([]Failure, error)
+}
+
+var parsers = map[string]Parser{
+	ParserGoTestJSON:   goTestJSONParser{},
+	ParserJUnit:        junitParser{},
+	ParserGolangciJSON: golangciParser{},
+}
+
+// detectOrder is the order formats are tried in when auto-detecting.
+var detectOrder = []string{ParserGoTestJSON, ParserGolangciJSON, ParserJUnit}
+
+func knownParser(name string) bool {
+	if name == "" || name == ParserAuto || name == ParserNone {
+		return true
+	}
+	_, ok := parsers[name]
+	return ok
+}
+
+// ParseFailures extracts failures from output with the named parser, or
+// with the first parser that recognises the output when name is empty or
+// auto. It returns nil when no parser applies or nothing was found.
+func ParseFailures(name string, output []byte) []Failure {
+	var p Parser
+	switch name {
+	case ParserNone:
+		return nil
+	case "", ParserAuto:
+		for _, n := range detectOrder {
+			if parsers[n].Detect(output) {
+				p = parsers[n]
+				break
+			}
+		}
+	default:
+		p = parsers[name]
+	}
+	if p == nil {
+		return nil
+	}
+	failures, err := p.Parse(output)
+	if err != nil {
+		return nil
+	}
+	return failures
+}
+
+var goLocation = regexp.MustCompile(`^\s*([\w./\\-]+\.go):(\d+)(?::\d+)?: ?(.*)$`)
+
+type goTestJSONParser struct{}
+
+type testKey struct{ pkg, test string }
+
+type goTestEvent struct {
+	Action     string
+	Package    string
+	Test       string
+	Output     string
+	ImportPath string
+}
+
+func (goTestJSONParser) Detect(output []byte) bool {
+	sc := bufio.NewScanner(bytes.NewReader(output))
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 || line[0] != '{' {
+			continue
+		}
+		var ev goTestEvent
+		return json.Unmarshal(line, &ev) == nil && ev.Action != ""
+	}
+	return false
+}
+
+func (goTestJSONParser) Parse(output []byte) ([]Failure, error) {
+	outputs := map[testKey][]string{}
+	buildOutput := map[string][]string{}
+	var stray []string
+	var failedTests []testKey
+	var failedPkgs []string
+
+	sc := bufio.NewScanner(bytes.NewReader(output))
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Bytes()
+		var ev goTestEvent
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(line, &ev); err != nil || ev.Action == "" {
+			stray = append(stray, string(line))
+			continue
+		}
+		k := testKey{ev.Package, ev.Test}
+		switch ev.Action {
+		case "output":
+			outputs[k] = append(outputs[k], strings.TrimRight(ev.Output, "\n"))
+		case "build-output":
+			buildOutput[ev.ImportPath] = append(buildOutput[ev.ImportPath], strings.TrimRight(ev.Output, "\n"))
+		case "fail":
+			if ev.Test != "" {
+				failedTests = append(failedTests, k)
+			} else {
+				failedPkgs = append(failedPkgs, ev.Package)
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	var failures []Failure
+	pkgsWithTests := map[string]bool{}
+	for _, k := range failedTests {
+		pkgsWithTests[k.pkg] = true
+		// A parent test fails whenever one of its subtests does; report
+		// only the subtest.
+		if hasFailedSubtest(k.test, k.pkg, failedTests) {
+			continue
+		}
+		f := failureFromLines(outputs[k])
+		f.Test = k.test
+		failures = append(failures, f)
+	}
+	for _, pkg := range failedPkgs {
+		if pkgsWithTests[pkg] {
+			continue
+		}
+		var lines []string
+		for _, importPath := range slices.Sorted(maps.Keys(buildOutput)) {
+			// Test builds are reported as "pkg [pkg.test]".
+			if importPath == pkg || strings.HasPrefix(importPath, pkg+" ") {
+				lines = append(lines, buildOutput[importPath]...)
+			}
+		}
+		lines = append(lines, outputs[testKey{pkg, ""}]...)
+		if len(lines) == 0 {
+			lines = stray
+		}
+		f := failureFromLines(lines)
+		f.Test = pkg
+		failures = append(failures, f)
+	}
+	return failures, nil
+}
+
+func hasFailedSubtest(test, pkg string, failed []testKey) bool {
+	for _, k := range failed {
+		if k.pkg == pkg && strings.HasPrefix(k.test, test+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// failureFromLines keeps the informative lines of a test's output and takes
+// the first file:line location among them.
+func failureFromLines(lines []string) Failure {
+	var f Failure
+	var kept []string
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "",
+			strings.HasPrefix(trimmed, "=== "),
+			strings.HasPrefix(trimmed, "# "),
+			strings.HasPrefix(trimmed, "--- "),
+			trimmed == "FAIL", trimmed == "PASS",
+			strings.HasPrefix(trimmed, "FAIL\t"), strings.HasPrefix(trimmed, "ok "),
+			strings.HasPrefix(trimmed, "exit status "):
+			continue
+		}
+		if f.File == "" {
+			if m := goLocation.FindStringSubmatch(line); m != nil {
+				f.File = m[1]
+				f.Line, _ = strconv.Atoi(m[2])
+				trimmed = m[3]
+			}
+		}
+		if len(kept) < maxFailureLines {
+			kept = append(kept, trimmed)
+		}
+	}
+	f.Message = strings.Join(kept, "\n")
+	return f
+}
+
+type junitParser struct{}
+
+type junitSuite struct {
+	Suites []junitSuite `xml:"testsuite"`
+	Cases  []junitCase  `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string         `xml:"name,attr"`
+	Classname string         `xml:"classname,attr"`
+	File      string         `xml:"file,attr"`
+	Line      int            `xml:"line,attr"`
+	Failures  []junitProblem `xml:"failure"`
+	Errors    []junitProblem `xml:"error"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+func (junitParser) Detect(output []byte) bool {
+	return bytes.Contains(output, []byte("<testsuite"))
+}
+
+func (junitParser) Parse(output []byte) ([]Failure, error) {
+	start := bytes.Index(output, []byte("<testsuite"))
+	if start < 0 {
+		return nil, fmt.Errorf("no testsuite element")
+	}
+	var root junitSuite
+	if err := xml.Unmarshal(output[start:], &root); err != nil {
+		return nil, fmt.Errorf("parsing JUnit XML: %w", err)
+	}
+	var failures []Failure
+	var walk func(s junitSuite)
+	walk = func(s junitSuite) {
+		for _, c := range s.Cases {
+			for _, p := range append(c.Failures, c.Errors...) {
+				f := failureFromLines(strings.Split(strings.TrimSpace(p.Body), "\n"))
+				if p.Message != "" && !strings.Contains(f.Message, p.Message) {
+					f.Message = strings.TrimSpace(p.Message + "\n" + f.Message)
+				}
+				f.Test = c.Name
+				if c.Classname != "" {
+					f.Test = c.Classname + "." + c.Name
+				}
+				if c.File != "" {
+					f.File, f.Line = c.File, c.Line
+				}
+				failures = append(failures, f)
+			}
+		}
+		for _, child := range s.Suites {
+			walk(child)
+		}
+	}
+	walk(root)
+	return failures, nil
+}
+
+type golangciParser struct{}
+
+type golangciReport struct {
+	Issues []struct {
+		FromLinter string
+		Text       string
+		Pos        struct {
+			Filename string
+			Line     int
+		}
+	}
+}
+
+func (golangciParser) Detect(output []byte) bool {
+	_, ok := findGolangciReport(output)
+	return ok
+}
+
+func (golangciParser) Parse(output []byte) ([]Failure, error) {
+	report, ok := findGolangciReport(output)
+	if !ok {
+		return nil, fmt.Errorf("no golangci-lint JSON report")
+	}
+	failures := make([]Failure, 0, len(report.Issues))
+	for _, issue := range report.Issues {
+		failures = append(failures, Failure{
+			Test:    issue.FromLinter,
+			File:    issue.Pos.Filename,
+			Line:    issue.Pos.Line,
+			Message: issue.Text,
+		})
+	}
+	return failures, nil
+}
+
+// findGolangciReport looks for the line holding golangci-lint's JSON report;
+// other output may surround it.
+func findGolangciReport(output []byte) (golangciReport, bool) {
+	for _, line := range bytes.Split(output, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if !bytes.HasPrefix(line, []byte(`{"Issues"`)) {
+			continue
+		}
+		var report golangciReport
+		if err := json.Unmarshal(line, &report); err == nil {
+			return report, true
+		}
+	}
+	return golangciReport{}, false
+}
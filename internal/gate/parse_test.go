@@ -0,0 +1,109 @@
+package gate
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestParseGoTestJSON(t *testing.T) {
+	failures := ParseFailures("", readFixture(t, "go-test.json"))
+
+	want := []Failure{
+		{Test: "TestAdd", File: "calc_test.go", Line: 7, Message: "Add(2, 3) = -1, want 5"},
+		{Test: "TestTable/negative", File: "calc_test.go", Line: 14, Message: "Add(-1, -1) = 0, want -2"},
+		{Test: "example.com/calc/broken", File: "broken/broken.go", Line: 3, Message: "undefined: undefinedThing"},
+	}
+	if len(failures) != len(want) {
+		t.Fatalf("got %d failures, want %d: %+v", len(failures), len(want), failures)
+	}
+	for i := range want {
+		if failures[i] != want[i] {
+			t.Errorf("failures[%d] = %+v, want %+v", i, failures[i], want[i])
+		}
+	}
+}
+
+func TestParseJUnit(t *testing.T) {
+	failures := ParseFailures(ParserJUnit, readFixture(t, "junit.xml"))
+	if len(failures) != 2 {
+		t.Fatalf("got %d failures, want 2: %+v", len(failures), failures)
+	}
+	first := failures[0]
+	if first.Test != "LoginForm.rejects empty password" || first.File != "src/login.test.ts" || first.Line != 42 {
+		t.Errorf("failures[0] = %+v", first)
+	}
+	if !strings.Contains(first.Message, "expected false to be true") {
+		t.Errorf("failures[0].Message = %q", first.Message)
+	}
+	if failures[1].Test != "Api.fetches user" || failures[1].Message != "TypeError: fetch is not a function" {
+		t.Errorf("failures[1] = %+v", failures[1])
+	}
+}
+
+func TestParseGolangciLintJSON(t *testing.T) {
+	output := append([]byte("level=warning msg=\"some linter is deprecated\"\n"), readFixture(t, "golangci-lint.json")...)
+	failures := ParseFailures("", output)
+	if len(failures) != 2 {
+		t.Fatalf("got %d failures, want 2: %+v", len(failures), failures)
+	}
+	want := Failure{Test: "errcheck", File: "internal/store/store.go", Line: 27, Message: "Error return value of `os.Remove` is not checked"}
+	if failures[0] != want {
+		t.Errorf("failures[0] = %+v, want %+v", failures[0], want)
+	}
+}
+
+func TestParseFailuresUnknownFormat(t *testing.T) {
+	if failures := ParseFailures("", []byte("make: *** [all] Error 1\n")); failures != nil {
+		t.Errorf("ParseFailures = %+v, want nil for plain output", failures)
+	}
+	if failures := ParseFailures(ParserNone, readFixture(t, "go-test.json")); failures != nil {
+		t.Errorf("ParseFailures(none) = %+v, want nil", failures)
+	}
+}
+
+func TestGateFailureSummaryUsesParsedFailures(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "report.xml"), readFixture(t, "junit.xml"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "noise.txt"), []byte("lots of noise\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gates := []Gate{{Name: "web", Run: "cat noise.txt; exit 1", Report: "report.xml"}}
+	results, err := RunGates(context.Background(), gates, dir)
+	if err != nil {
+		t.Fatalf("RunGates failed: %v", err)
+	}
+	if len(results[0].Failures) != 2 {
+		t.Fatalf("Failures = %+v, want 2 from the report", results[0].Failures)
+	}
+
+	summary := GateFailureSummary(results)
+	if strings.Contains(summary, "lots of noise") {
+		t.Errorf("summary should list parsed failures instead of raw output:\n%s", summary)
+	}
+	if !strings.Contains(summary, "- LoginForm.rejects empty password at src/login.test.ts:42: AssertionError: expected false to be true") {
+		t.Errorf("summary missing compact failure:\n%s", summary)
+	}
+}
+
+func TestValidateParser(t *testing.T) {
+	if err := (Gate{Run: "go test -json ./...", Parser: ParserGoTestJSON}).Validate(); err != nil {
+		t.Errorf("Validate = %v, want nil", err)
+	}
+	if err := (Gate{Run: "make", Parser: "tap"}).Validate(); err == nil {
+		t.Error("expected error for unknown parser")
+	}
+}
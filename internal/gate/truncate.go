@@ -0,0 +1,118 @@
+package gate
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// DefaultOutputBudget is how many bytes of gate output a failure summary
+// keeps when no budget is configured.
+const DefaultOutputBudget = 16000
+
+// ansiEscape matches CSI sequences (colours, cursor movement) and OSC
+// sequences (terminal titles, hyperlinks).
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)`)
+
+// StripANSI removes terminal escape sequences from s.
+func StripANSI(s string) string {
+	return ansiEscape.ReplaceAllString(s, "")
+}
+
+// CleanOutput makes raw command output cheaper to read: it strips escape
+// sequences, keeps only the final state of lines redrawn with carriage
+// returns (progress bars), and collapses runs of identical lines.
+func CleanOutput(s string) string {
+	lines := strings.Split(StripANSI(s), "\n")
+	var b strings.Builder
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		if k := strings.LastIndex(strings.TrimRight(line, "\r"), "\r"); k >= 0 {
+			line = line[k+1:]
+		}
+		line = strings.TrimRight(line, "\r")
+		j := i + 1
+		for j < len(lines) && strings.TrimRight(lines[j], "\r") == line {
+			j++
+		}
+		b.WriteString(line)
+		if j-i > 1 {
+			fmt.Fprintf(&b, "\n[previous line repeated %d more times]", j-i-1)
+		}
+		if j < len(lines) {
+			b.WriteByte('\n')
+		}
+		i = j
+	}
+	return b.String()
+}
+
+// Clip shortens s to about budget bytes, keeping whole lines from its start
+// and, with twice the room, its end, where errors and summaries usually
+// are. When the last line alone is too long, the end of it is kept instead.
+// A note says how much was left out. A budget of 0 or less means no limit.
+func Clip(s string, budget int) string {
+	if budget <= 0 || len(s) <= budget {
+		return s
+	}
+	headBudget := budget / 3
+	tailBudget := budget - headBudget
+
+	lines := strings.SplitAfter(s, "\n")
+	head, used := 0, 0
+	for head < len(lines) && used+len(lines[head]) <= headBudget {
+		used += len(lines[head])
+		head++
+	}
+	tail, usedTail := len(lines), 0
+	for tail > head && usedTail+len(lines[tail-1]) <= tailBudget {
+		usedTail += len(lines[tail-1])
+		tail--
+	}
+
+	if head == 0 && usedTail == 0 {
+		// No whole line fits; cut inside the text instead.
+		start := runeBoundary(s, headBudget)
+		end := runeBoundary(s, len(s)-tailBudget)
+		return fmt.Sprintf("%s\n... [%d bytes omitted] ...\n%s", s[:start], end-start, s[end:])
+	}
+	if usedTail == 0 {
+		// The last line does not fit; keep its end rather than losing it.
+		kept := strings.Join(lines[:head], "")
+		end := runeBoundary(s, len(s)-tailBudget)
+		return fmt.Sprintf("%s... [%d bytes omitted] ...\n%s", kept, end-len(kept), s[end:])
+	}
+
+	omitted := strings.Join(lines[head:tail], "")
+	return fmt.Sprintf("%s... [%d lines, %d bytes omitted] ...\n%s",
+		strings.Join(lines[:head], ""), tail-head, len(omitted), strings.Join(lines[tail:], ""))
+}
+
+// runeBoundary moves i back to the start of the UTF-8 sequence it falls in.
+func runeBoundary(s string, i int) int {
+	for i > 0 && i < len(s) && !utf8.RuneStart(s[i]) {
+		i--
+	}
+	return i
+}
+
+// shareBudget splits budget between texts of the given sizes. Each gets an
+// equal share; what a small text does not need is divided among the rest.
+func shareBudget(sizes []int, budget int) []int {
+	order := make([]int, len(sizes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return sizes[order[a]] < sizes[order[b]] })
+
+	shares := make([]int, len(sizes))
+	remaining := budget
+	for k, i := range order {
+		fair := remaining / (len(order) - k)
+		shares[i] = min(sizes[i], fair)
+		remaining -= shares[i]
+	}
+	return shares
+}
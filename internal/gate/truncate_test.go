@@ -0,0 +1,98 @@
+package gate
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestStripANSI(t *testing.T) {
+	in := "\x1b[31mFAIL\x1b[0m \x1b]8;;https://example.com\x07link\x1b]8;;\x07 done\x1b[2K"
+	if got := StripANSI(in); got != "FAIL link done" {
+		t.Errorf("StripANSI = %q", got)
+	}
+}
+
+func TestCleanOutput(t *testing.T) {
+	in := "start\nwarn: slow\nwarn: slow\nwarn: slow\n 10%\r 50%\r100%\nend\n"
+	want := "start\nwarn: slow\n[previous line repeated 2 more times]\n100%\nend\n"
+	if got := CleanOutput(in); got != want {
+		t.Errorf("CleanOutput = %q, want %q", got, want)
+	}
+}
+
+func TestClipKeepsHeadAndTail(t *testing.T) {
+	var lines []string
+	for i := 1; i <= 100; i++ {
+		lines = append(lines, fmt.Sprintf("line %03d", i))
+	}
+	in := strings.Join(lines, "\n") + "\n"
+
+	got := Clip(in, 90)
+	if !strings.HasPrefix(got, "line 001\nline 002\nline 003\n") {
+		t.Errorf("Clip should keep the first lines:\n%s", got)
+	}
+	if !strings.HasSuffix(got, "line 099\nline 100\n") {
+		t.Errorf("Clip should keep the last lines:\n%s", got)
+	}
+	if !strings.Contains(got, "... [91 lines, 819 bytes omitted] ...") {
+		t.Errorf("Clip should say what it omitted:\n%s", got)
+	}
+	if Clip(in, 0) != in || Clip(in, len(in)) != in {
+		t.Error("Clip should leave output within budget alone")
+	}
+}
+
+func TestClipSingleLongLine(t *testing.T) {
+	in := strings.Repeat("é", 500)
+	got := Clip(in, 60)
+	if !strings.Contains(got, "bytes omitted") || len(got) > 120 {
+		t.Errorf("Clip = %q", got)
+	}
+	if !strings.HasPrefix(got, "éé") || strings.ContainsRune(got, '�') {
+		t.Errorf("Clip should cut on rune boundaries: %q", got)
+	}
+}
+
+func TestClipLongLastLine(t *testing.T) {
+	in := "line 1\nline 2\n" + strings.Repeat("x", 500) + " FAIL: the error\n"
+	got := Clip(in, 90)
+	if !strings.HasPrefix(got, "line 1\nline 2\n") {
+		t.Errorf("Clip should keep the first lines:\n%s", got)
+	}
+	if !strings.HasSuffix(got, "FAIL: the error\n") || !strings.Contains(got, "bytes omitted") {
+		t.Errorf("Clip should keep the end of the last line:\n%s", got)
+	}
+	if len(got) > 120 {
+		t.Errorf("Clip returned %d bytes, want about 90", len(got))
+	}
+}
+
+func TestGateFailureSummaryFairShare(t *testing.T) {
+	results := []GateResult{
+		{Command: "go test ./...", Output: strings.Repeat("noisy test output\n", 2000)},
+		{Command: "go vet ./...", Output: "vet: x.go:3: unreachable code\n"},
+	}
+	summary := GateFailureSummaryWithBudget(results, 2000)
+	if !strings.Contains(summary, "vet: x.go:3: unreachable code") {
+		t.Errorf("small gate output should survive in full:\n%s", summary)
+	}
+	if len(summary) > 2500 {
+		t.Errorf("summary is %d bytes, want it near the 2000-byte budget", len(summary))
+	}
+
+	// Distinct lines so de-duplication does not shrink the output.
+	var big strings.Builder
+	for i := range 2000 {
+		fmt.Fprintf(&big, "failure %d\n", i)
+	}
+	results = []GateResult{
+		{Command: "a", Output: big.String()},
+		{Command: "b", Output: big.String()},
+	}
+	summary = GateFailureSummaryWithBudget(results, 2000)
+	a, b, _ := strings.Cut(summary, "FAIL: b")
+	if len(a) < 800 || len(b) < 800 {
+		t.Errorf("gates should split the budget evenly, got %d and %d bytes", len(a), len(b))
+	}
+}
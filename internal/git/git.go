@@ -0,0 +1,350 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Run executes git with args in dir and returns its combined output with
+// trailing whitespace removed.
+func Run(ctx context.Context, dir string, args ...string) (string, error) {
+	return runEnv(ctx, dir, nil, args...)
+}
+
+// runEnv is Run with extra environment variables.
+func runEnv(ctx context.Context, dir string, env []string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	output, err := cmd.CombinedOutput()
+	out := strings.TrimRight(string(output), " \t\r\n")
+	if err != nil {
+		return out, fmt.Errorf("git %s: %w\noutput: %s", strings.Join(args, " "), err, out)
+	}
+	return out, nil
+}
+
+func IsRepo(ctx context.Context, dir string) bool {
+	out, err := Run(ctx, dir, "rev-parse", "--is-inside-work-tree")
+	return err == nil && out == "true"
+}
+
+// TopLevel returns the absolute path of the repository root containing dir.
+func TopLevel(ctx context.Context, dir string) (string, error) {
+	return Run(ctx, dir, "rev-parse", "--show-toplevel")
+}
+
+// HasCommits reports whether HEAD in dir points at a commit. It does not in
+// a repository created by git init until the first commit.
+func HasCommits(ctx context.Context, dir string) bool {
+	_, err := Run(ctx, dir, "rev-parse", "--verify", "--quiet", "HEAD")
+	return err == nil
+}
+
+func CurrentBranch(ctx context.Context, dir string) (string, error) {
+	return Run(ctx, dir, "rev-parse", "--abbrev-ref", "HEAD")
+}
+
+// DirtyFiles lists paths with uncommitted changes, including untracked
+// files. Paths are relative to the repository root.
+func DirtyFiles(ctx context.Context, dir string) ([]string, error) {
+	out, err := Run(ctx, dir, "status", "--porcelain", "--untracked-files=all")
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, line := range strings.Split(out, "\n") {
+		if len(line) > 3 {
+			files = append(files, line[3:])
+		}
+	}
+	return files, nil
+}
+
+// Checkout switches dir to branch, creating it from HEAD if it does not exist.
+func Checkout(ctx context.Context, dir, branch string) error {
+	if _, err := Run(ctx, dir, "rev-parse", "--verify", "--quiet", "refs/heads/"+branch); err != nil {
+		_, err = Run(ctx, dir, "checkout", "-b", branch)
+		return err
+	}
+	_, err := Run(ctx, dir, "checkout", branch)
+	return err
+}
+
+// AddWorktree creates a worktree at path on a new branch started from base.
+// An existing branch with the same name is reset to base.
+func AddWorktree(ctx context.Context, repoDir, path, branch, base string) error {
+	_, err := Run(ctx, repoDir, "worktree", "add", "-B", branch, path, base)
+	return err
+}
+
+// Apply applies the unified diff in patchFile to the files in dir. Paths in
+// the diff are relative to dir, even when dir is not a repository or is a
+// subdirectory of one.
+func Apply(ctx context.Context, dir, patchFile string) error {
+	patchFile, err := filepath.Abs(patchFile)
+	if err != nil {
+		return err
+	}
+	_, err = runEnv(ctx, dir, []string{"GIT_CEILING_DIRECTORIES=" + filepath.Dir(dir)}, "apply", "--whitespace=nowarn", patchFile)
+	return err
+}
+
+func RemoveWorktree(ctx context.Context, repoDir, path string) error {
+	_, err := Run(ctx, repoDir, "worktree", "remove", "--force", path)
+	return err
+}
+
+func DeleteBranch(ctx context.Context, repoDir, branch string) error {
+	_, err := Run(ctx, repoDir, "branch", "-D", branch)
+	return err
+}
+
+// CommitAll stages every change in dir, except the paths in exclude, and
+// commits it with message. Excluded paths are relative to the repository
+// root. It reports false without committing when there
+// is nothing to commit.
+func CommitAll(ctx context.Context, dir, message string, exclude ...string) (bool, error) {
+	args := []string{"add", "-A", "--", "."}
+	for _, path := range exclude {
+		args = append(args, ":(top,exclude)"+path)
+	}
+	if _, err := Run(ctx, dir, args...); err != nil {
+		return false, err
+	}
+	if _, err := Run(ctx, dir, "diff", "--cached", "--quiet"); err == nil {
+		return false, nil
+	}
+	if _, err := Run(ctx, dir, "commit", "-m", message); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ErrMergeConflict is returned by Merge when the merge stops on conflicts.
+var ErrMergeConflict = errors.New("merge conflict")
+
+// Merge merges branch into the current branch of dir with a merge commit.
+// On conflict the merge is aborted and the returned error wraps
+// ErrMergeConflict and lists the conflicting files.
+func Merge(ctx context.Context, dir, branch, message string) error {
+	_, mergeErr := Run(ctx, dir, "merge", "--no-ff", "-m", message, branch)
+	if mergeErr == nil {
+		return nil
+	}
+	conflicts, err := Run(ctx, dir, "diff", "--name-only", "--diff-filter=U")
+	if err != nil || conflicts == "" {
+		return mergeErr
+	}
+	if _, err := Run(ctx, dir, "merge", "--abort"); err != nil {
+		return fmt.Errorf("aborting merge: %w", err)
+	}
+	return fmt.Errorf("%w in %s", ErrMergeConflict, strings.ReplaceAll(conflicts, "\n", ", "))
+}
+
+// Snapshot records the state of a working tree so it can be restored after
+// a failed attempt.
+type Snapshot struct {
+	Head string
+	// Stash is a commit holding uncommitted tracked changes, or "" if the
+	// tracked files matched Head.
+	Stash     string
+	Untracked map[string]bool
+}
+
+// TakeSnapshot captures HEAD, uncommitted tracked changes and the set of
+// untracked files in dir without modifying the working tree.
+func TakeSnapshot(ctx context.Context, dir string) (*Snapshot, error) {
+	head, err := Run(ctx, dir, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	stash, err := Run(ctx, dir, "stash", "create")
+	if err != nil {
+		return nil, err
+	}
+	untracked, err := untrackedFiles(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{Head: head, Stash: stash, Untracked: untracked}, nil
+}
+
+// Restore resets dir to the snapshot: tracked files return to their
+// recorded state and untracked files created since are removed. Files and
+// directories in keep, relative to the repository root, are left untouched.
+func (s *Snapshot) Restore(ctx context.Context, dir string, keep ...string) error {
+	top, err := TopLevel(ctx, dir)
+	if err != nil {
+		return err
+	}
+	saved := make(map[string][]byte, len(keep))
+	for _, path := range keep {
+		if data, err := os.ReadFile(filepath.Join(top, path)); err == nil {
+			saved[path] = data
+		}
+	}
+
+	if _, err := Run(ctx, dir, "reset", "-q", "--hard", s.Head); err != nil {
+		return err
+	}
+	if s.Stash != "" {
+		if _, err := Run(ctx, dir, "stash", "apply", "-q", s.Stash); err != nil {
+			return err
+		}
+	}
+
+	untracked, err := untrackedFiles(ctx, dir)
+	if err != nil {
+		return err
+	}
+	for path := range untracked {
+		if s.Untracked[path] || underAny(path, keep) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(top, path)); err != nil {
+			return fmt.Errorf("removing %s: %w", path, err)
+		}
+	}
+
+	for path, data := range saved {
+		if err := os.WriteFile(filepath.Join(top, path), data, 0644); err != nil {
+			return fmt.Errorf("restoring %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// Changes lists the files, relative to the repository root, that Restore
+// would change: tracked files that differ from the snapshot and untracked
+// files created since. Files and directories in keep are left out.
+func (s *Snapshot) Changes(ctx context.Context, dir string, keep ...string) ([]string, error) {
+	base := s.Head
+	if s.Stash != "" {
+		base = s.Stash
+	}
+	out, err := Run(ctx, dir, "diff", "--name-only", base, "--", ":/")
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, line := range strings.Split(out, "\n") {
+		if line != "" && !underAny(line, keep) {
+			files = append(files, line)
+		}
+	}
+	untracked, err := untrackedFiles(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	for path := range untracked {
+		if !s.Untracked[path] && !underAny(path, keep) {
+			files = append(files, path)
+		}
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+// SaveToBranch commits the current state of dir, except the paths in
+// exclude, onto branch as a child of HEAD. The current branch, index and
+// working tree are left as they were, including changes already staged.
+func SaveToBranch(ctx context.Context, dir, branch, message string, exclude ...string) error {
+	tree, err := TreeHash(ctx, dir, exclude...)
+	if err != nil {
+		return err
+	}
+	commit, err := Run(ctx, dir, "commit-tree", tree, "-p", "HEAD", "-m", message)
+	if err != nil {
+		return err
+	}
+	_, err = Run(ctx, dir, "branch", "-f", branch, commit)
+	return err
+}
+
+// TreeHash returns the hash of the tree that committing every change in
+// dir, untracked files included, would produce. The paths in exclude are
+// left out. It works on a copy of the index, so the real one is untouched;
+// equal hashes mean equal working trees.
+func TreeHash(ctx context.Context, dir string, exclude ...string) (string, error) {
+	indexPath, err := Run(ctx, dir, "rev-parse", "--git-path", "index")
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(indexPath) {
+		indexPath = filepath.Join(dir, indexPath)
+	}
+
+	tmp, err := os.CreateTemp("", "do-more-index-")
+	if err != nil {
+		return "", fmt.Errorf("creating temporary index: %w", err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	// Starting from the real index lets git skip rehashing unchanged files.
+	// Without one, git needs the file to be absent rather than empty.
+	if data, err := os.ReadFile(indexPath); err == nil {
+		if err := os.WriteFile(tmp.Name(), data, 0644); err != nil {
+			return "", fmt.Errorf("copying index: %w", err)
+		}
+	} else {
+		os.Remove(tmp.Name())
+	}
+
+	env := []string{"GIT_INDEX_FILE=" + tmp.Name()}
+	args := []string{"add", "-A", "--", "."}
+	for _, path := range exclude {
+		args = append(args, ":(top,exclude)"+path)
+	}
+	if _, err := runEnv(ctx, dir, env, args...); err != nil {
+		return "", err
+	}
+	return runEnv(ctx, dir, env, "write-tree")
+}
+
+// DiffTrees returns a binary unified diff from tree from to tree to, limited
+// to dir and with paths relative to it, in the form Apply takes.
+func DiffTrees(ctx context.Context, dir, from, to string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", "diff", "--binary", "--relative", from, to)
+	cmd.Dir = dir
+	// The patch is returned as is: trimming it like Run does would corrupt
+	// its last line.
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git diff %s %s: %w", from, to, err)
+	}
+	return string(out), nil
+}
+
+func underAny(path string, dirs []string) bool {
+	for _, d := range dirs {
+		if path == d || strings.HasPrefix(path, d+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// untrackedFiles lists untracked, non-ignored files relative to the
+// repository root.
+func untrackedFiles(ctx context.Context, dir string) (map[string]bool, error) {
+	out, err := Run(ctx, dir, "ls-files", "--others", "--exclude-standard", "--full-name", ":/")
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]bool)
+	for _, line := range strings.Split(out, "\n") {
+		if line != "" {
+			files[line] = true
+		}
+	}
+	return files, nil
+}
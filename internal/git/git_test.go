@@ -0,0 +1,299 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func initRepo(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	ctx := context.Background()
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"config", "user.name", "test"},
+		{"config", "user.email", "test@example.com"},
+	} {
+		if _, err := Run(ctx, dir, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, dir, "README", "base\n")
+	if _, err := CommitAll(ctx, dir, "initial"); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func writeFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIsRepo(t *testing.T) {
+	ctx := context.Background()
+	if !IsRepo(ctx, initRepo(t)) {
+		t.Error("expected initialized directory to be a repo")
+	}
+	if IsRepo(ctx, t.TempDir()) {
+		t.Error("expected empty directory not to be a repo")
+	}
+}
+
+func TestCommitAllNothingToCommit(t *testing.T) {
+	dir := initRepo(t)
+
+	committed, err := CommitAll(context.Background(), dir, "empty")
+	if err != nil {
+		t.Fatalf("CommitAll failed: %v", err)
+	}
+	if committed {
+		t.Error("expected no commit for a clean tree")
+	}
+}
+
+func TestWorktreeMerge(t *testing.T) {
+	ctx := context.Background()
+	dir := initRepo(t)
+	wt := filepath.Join(t.TempDir(), "wt")
+
+	if err := AddWorktree(ctx, dir, wt, "feature", "main"); err != nil {
+		t.Fatalf("AddWorktree failed: %v", err)
+	}
+	writeFile(t, wt, "feature.txt", "feature\n")
+	if _, err := CommitAll(ctx, wt, "add feature"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveWorktree(ctx, dir, wt); err != nil {
+		t.Fatalf("RemoveWorktree failed: %v", err)
+	}
+
+	if err := Merge(ctx, dir, "feature", "merge feature"); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "feature.txt")); err != nil {
+		t.Errorf("expected merged file: %v", err)
+	}
+	if err := DeleteBranch(ctx, dir, "feature"); err != nil {
+		t.Errorf("DeleteBranch failed: %v", err)
+	}
+}
+
+func TestMergeConflict(t *testing.T) {
+	ctx := context.Background()
+	dir := initRepo(t)
+	wt := filepath.Join(t.TempDir(), "wt")
+
+	if err := AddWorktree(ctx, dir, wt, "feature", "main"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, wt, "README", "feature\n")
+	if _, err := CommitAll(ctx, wt, "change on feature"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, dir, "README", "main\n")
+	if _, err := CommitAll(ctx, dir, "change on main"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := Merge(ctx, dir, "feature", "merge feature")
+	if !errors.Is(err, ErrMergeConflict) {
+		t.Fatalf("expected ErrMergeConflict, got %v", err)
+	}
+	if out, _ := Run(ctx, dir, "status", "--porcelain"); out != "" {
+		t.Errorf("expected clean tree after aborted merge, got %q", out)
+	}
+}
+
+func TestDirtyFiles(t *testing.T) {
+	ctx := context.Background()
+	dir := initRepo(t)
+
+	files, err := DirtyFiles(ctx, dir)
+	if err != nil {
+		t.Fatalf("DirtyFiles failed: %v", err)
+	}
+	if len(files) != 0 {
+		t.Errorf("expected clean tree, got %v", files)
+	}
+
+	writeFile(t, dir, "README", "changed\n")
+	writeFile(t, dir, "new.txt", "new\n")
+	files, err = DirtyFiles(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0] != "README" || files[1] != "new.txt" {
+		t.Errorf("DirtyFiles = %v, want [README new.txt]", files)
+	}
+}
+
+func TestCheckoutCreatesAndSwitches(t *testing.T) {
+	ctx := context.Background()
+	dir := initRepo(t)
+
+	if err := Checkout(ctx, dir, "feat/x"); err != nil {
+		t.Fatalf("Checkout new branch failed: %v", err)
+	}
+	if branch, _ := CurrentBranch(ctx, dir); branch != "feat/x" {
+		t.Errorf("CurrentBranch = %q, want feat/x", branch)
+	}
+	if err := Checkout(ctx, dir, "main"); err != nil {
+		t.Fatalf("Checkout existing branch failed: %v", err)
+	}
+	if branch, _ := CurrentBranch(ctx, dir); branch != "main" {
+		t.Errorf("CurrentBranch = %q, want main", branch)
+	}
+}
+
+func TestCommitAllExclude(t *testing.T) {
+	ctx := context.Background()
+	dir := initRepo(t)
+	writeFile(t, dir, "code.go", "package x\n")
+	writeFile(t, dir, "do-more.json", "{}\n")
+
+	committed, err := CommitAll(ctx, dir, "add code", "do-more.json")
+	if err != nil {
+		t.Fatalf("CommitAll failed: %v", err)
+	}
+	if !committed {
+		t.Fatal("expected a commit")
+	}
+	files, _ := DirtyFiles(ctx, dir)
+	if len(files) != 1 || files[0] != "do-more.json" {
+		t.Errorf("expected only do-more.json left uncommitted, got %v", files)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	ctx := context.Background()
+	dir := initRepo(t)
+	writeFile(t, dir, "README", "uncommitted\n")
+	writeFile(t, dir, "notes.txt", "mine\n")
+	writeFile(t, dir, "do-more.json", "{}\n")
+
+	snap, err := TakeSnapshot(ctx, dir)
+	if err != nil {
+		t.Fatalf("TakeSnapshot failed: %v", err)
+	}
+
+	writeFile(t, dir, "README", "agent edit\n")
+	writeFile(t, dir, "generated.go", "package x\n")
+	writeFile(t, dir, "do-more.json", `{"status":"failed"}`+"\n")
+
+	changes, err := snap.Changes(ctx, dir, "do-more.json")
+	if err != nil || strings.Join(changes, " ") != "README generated.go" {
+		t.Errorf("Changes = %v (%v), want README and generated.go", changes, err)
+	}
+
+	if err := snap.Restore(ctx, dir, "do-more.json"); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	for name, want := range map[string]string{
+		"README":       "uncommitted\n",
+		"notes.txt":    "mine\n",
+		"do-more.json": `{"status":"failed"}` + "\n",
+	} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(data) != want {
+			t.Errorf("%s = %q (%v), want %q", name, data, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "generated.go")); !os.IsNotExist(err) {
+		t.Errorf("expected generated.go to be removed, got %v", err)
+	}
+}
+
+func TestSaveToBranch(t *testing.T) {
+	ctx := context.Background()
+	dir := initRepo(t)
+	writeFile(t, dir, "attempt.go", "package x\n")
+	writeFile(t, dir, "README", "staged\n")
+	if _, err := Run(ctx, dir, "add", "README"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SaveToBranch(ctx, dir, "do-more/failed/1", "failed attempt"); err != nil {
+		t.Fatalf("SaveToBranch failed: %v", err)
+	}
+
+	if branch, _ := CurrentBranch(ctx, dir); branch != "main" {
+		t.Errorf("current branch = %q, want main", branch)
+	}
+	files, _ := Run(ctx, dir, "show", "--name-only", "--format=%s", "do-more/failed/1")
+	if files != "failed attempt\n\nREADME\nattempt.go" {
+		t.Errorf("saved commit = %q", files)
+	}
+	if dirty, _ := DirtyFiles(ctx, dir); len(dirty) != 2 {
+		t.Errorf("expected working tree untouched, got %v", dirty)
+	}
+	if staged, _ := Run(ctx, dir, "diff", "--cached", "--name-only"); staged != "README" {
+		t.Errorf("staged files = %q, want README still staged", staged)
+	}
+}
+
+func TestTreeHash(t *testing.T) {
+	ctx := context.Background()
+	dir := initRepo(t)
+
+	clean, err := TreeHash(ctx, dir)
+	if err != nil {
+		t.Fatalf("TreeHash failed: %v", err)
+	}
+	head, _ := Run(ctx, dir, "rev-parse", "HEAD^{tree}")
+	if clean != head {
+		t.Errorf("clean TreeHash = %s, want HEAD tree %s", clean, head)
+	}
+
+	writeFile(t, dir, "new.go", "package x\n")
+	changed, _ := TreeHash(ctx, dir)
+	again, _ := TreeHash(ctx, dir)
+	if changed == clean || changed != again {
+		t.Errorf("TreeHash should change with the tree and be stable: %s %s %s", clean, changed, again)
+	}
+	if excluded, _ := TreeHash(ctx, dir, "new.go"); excluded != clean {
+		t.Errorf("excluded TreeHash = %s, want %s", excluded, clean)
+	}
+	if dirty, _ := DirtyFiles(ctx, dir); len(dirty) != 1 || dirty[0] != "new.go" {
+		t.Errorf("TreeHash should not stage anything, status shows %v", dirty)
+	}
+	if staged, _ := Run(ctx, dir, "diff", "--cached", "--name-only"); staged != "" {
+		t.Errorf("index changed: %q", staged)
+	}
+}
+
+func TestApply(t *testing.T) {
+	ctx := context.Background()
+	patch := filepath.Join(t.TempDir(), "change.patch")
+	writeFile(t, filepath.Dir(patch), "change.patch", `--- a/notes.txt
++++ b/notes.txt
+@@ -1 +1 @@
+-old
++new
+`)
+
+	repo := initRepo(t)
+	sub := filepath.Join(repo, "sub")
+	for _, dir := range []string{t.TempDir(), sub} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, dir, "notes.txt", "old\n")
+		if err := Apply(ctx, dir, patch); err != nil {
+			t.Fatalf("Apply in %s failed: %v", dir, err)
+		}
+		if data, _ := os.ReadFile(filepath.Join(dir, "notes.txt")); string(data) != "new\n" {
+			t.Errorf("notes.txt in %s = %q, want the patch applied", dir, data)
+		}
+	}
+	if err := Apply(ctx, sub, patch); err == nil {
+		t.Error("expected an error applying the patch twice")
+	}
+}
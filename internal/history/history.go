@@ -0,0 +1,138 @@
+package history
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tmdgusya/do-more/internal/config"
+	"github.com/tmdgusya/do-more/internal/gate"
+	"github.com/tmdgusya/do-more/internal/provider"
+)
+
+// MaxOutputLen caps how much provider and gate output is kept per attempt.
+const MaxOutputLen = 4096
+
+// Attempt records one iteration of a task.
+type Attempt struct {
+	Iteration      int               `json:"iteration"`
+	Provider       string            `json:"provider"`
+	Session        string            `json:"session,omitempty"`
+	StartedAt      time.Time         `json:"startedAt"`
+	EndedAt        time.Time         `json:"endedAt"`
+	Output         string            `json:"output"`
+	ProviderError  string            `json:"providerError,omitempty"`
+	Gates          []gate.GateResult `json:"gates,omitempty"`
+	Passed         bool              `json:"passed"`
+	FailureSummary string            `json:"failureSummary,omitempty"`
+	Fingerprint    string            `json:"fingerprint,omitempty"`
+	Usage          provider.Usage    `json:"usage,omitzero"`
+}
+
+// Dir returns the directory holding attempt history for the config at cfgPath.
+func Dir(cfgPath string) string {
+	return filepath.Join(config.StateDir(cfgPath), "history")
+}
+
+func path(cfgPath, taskID string) string {
+	return filepath.Join(Dir(cfgPath), url.PathEscape(taskID)+".json")
+}
+
+// Load returns the recorded attempts for a task, oldest first. A task with
+// no history yields an empty slice.
+func Load(cfgPath, taskID string) ([]Attempt, error) {
+	data, err := os.ReadFile(path(cfgPath, taskID))
+	if errors.Is(err, os.ErrNotExist) {
+		return []Attempt{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading history: %w", err)
+	}
+	var attempts []Attempt
+	if err := json.Unmarshal(data, &attempts); err != nil {
+		return nil, fmt.Errorf("parsing history: %w", err)
+	}
+	return attempts, nil
+}
+
+// Append adds an attempt to a task's history, truncating its outputs to
+// MaxOutputLen.
+func Append(cfgPath, taskID string, a Attempt) error {
+	attempts, err := Load(cfgPath, taskID)
+	if err != nil {
+		return err
+	}
+
+	a.Output = Truncate(a.Output, MaxOutputLen)
+	a.FailureSummary = Truncate(a.FailureSummary, MaxOutputLen)
+	gates := make([]gate.GateResult, len(a.Gates))
+	for i, g := range a.Gates {
+		g.Output = Truncate(g.Output, MaxOutputLen)
+		gates[i] = g
+	}
+	a.Gates = gates
+	attempts = append(attempts, a)
+
+	data, err := json.MarshalIndent(attempts, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling history: %w", err)
+	}
+	if err := os.MkdirAll(Dir(cfgPath), 0755); err != nil {
+		return fmt.Errorf("creating history directory: %w", err)
+	}
+	if err := os.WriteFile(path(cfgPath, taskID), data, 0644); err != nil {
+		return fmt.Errorf("writing history: %w", err)
+	}
+	return nil
+}
+
+// Truncate shortens s to at most max bytes, keeping the tail, which is
+// where tools usually print the error that matters.
+func Truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	const marker = "...[truncated]\n"
+	if max <= len(marker) {
+		return s[len(s)-max:]
+	}
+	return marker + s[len(s)-(max-len(marker)):]
+}
+
+// Format renders attempts for the terminal.
+func Format(attempts []Attempt) string {
+	var b strings.Builder
+	for _, a := range attempts {
+		result := "failed"
+		if a.Passed {
+			result = "passed"
+		}
+		fmt.Fprintf(&b, "Attempt %d (%s) %s, %s, %s\n",
+			a.Iteration, a.Provider, a.StartedAt.Format(time.RFC3339),
+			a.EndedAt.Sub(a.StartedAt).Round(time.Second), result)
+		if a.Usage.Reported() {
+			fmt.Fprintf(&b, "  Usage: %s\n", a.Usage)
+		}
+		if a.ProviderError != "" {
+			fmt.Fprintf(&b, "  Provider error: %s\n", firstLine(a.ProviderError))
+		}
+		for _, g := range a.Gates {
+			mark := "✗"
+			if g.Passed {
+				mark = "✓"
+			}
+			fmt.Fprintf(&b, "  %s %s\n", mark, g.Label())
+		}
+	}
+	return b.String()
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
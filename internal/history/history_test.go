@@ -0,0 +1,113 @@
+package history
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tmdgusya/do-more/internal/gate"
+	"github.com/tmdgusya/do-more/internal/provider"
+)
+
+func TestLoadMissingHistory(t *testing.T) {
+	cfgPath := filepath.Join(t.TempDir(), "do-more.json")
+
+	attempts, err := Load(cfgPath, "1")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if attempts == nil || len(attempts) != 0 {
+		t.Errorf("Load = %v, want empty slice", attempts)
+	}
+}
+
+func TestAppendAndLoad(t *testing.T) {
+	cfgPath := filepath.Join(t.TempDir(), "do-more.json")
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	first := Attempt{
+		Iteration:      1,
+		Provider:       "claude",
+		StartedAt:      start,
+		EndedAt:        start.Add(time.Minute),
+		Output:         strings.Repeat("x", MaxOutputLen+100),
+		Gates:          []gate.GateResult{{Command: "false", Passed: false, Output: "boom"}},
+		FailureSummary: "FAIL: false\nboom\n",
+	}
+	second := Attempt{Iteration: 2, Provider: "claude", Passed: true}
+
+	if err := Append(cfgPath, "a/b", first); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if err := Append(cfgPath, "a/b", second); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+
+	attempts, err := Load(cfgPath, "a/b")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(attempts) != 2 {
+		t.Fatalf("len(attempts) = %d, want 2", len(attempts))
+	}
+	if len(attempts[0].Output) != MaxOutputLen {
+		t.Errorf("len(Output) = %d, want %d", len(attempts[0].Output), MaxOutputLen)
+	}
+	if attempts[0].Gates[0].Output != "boom" {
+		t.Errorf("Gates[0].Output = %q, want boom", attempts[0].Gates[0].Output)
+	}
+	if !attempts[0].StartedAt.Equal(start) {
+		t.Errorf("StartedAt = %v, want %v", attempts[0].StartedAt, start)
+	}
+	if !attempts[1].Passed {
+		t.Error("second attempt should be passed")
+	}
+}
+
+func TestTruncateKeepsTail(t *testing.T) {
+	got := Truncate("0123456789abcdefghijklmnopqrstuvwxyz", 20)
+	if len(got) != 20 {
+		t.Fatalf("len = %d, want 20", len(got))
+	}
+	if !strings.HasSuffix(got, "xyz") {
+		t.Errorf("Truncate = %q, want tail kept", got)
+	}
+	if Truncate("short", 20) != "short" {
+		t.Error("short strings should be unchanged")
+	}
+}
+
+func TestFormat(t *testing.T) {
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	attempts := []Attempt{
+		{
+			Iteration: 1,
+			Provider:  "claude",
+			StartedAt: start,
+			EndedAt:   start.Add(90 * time.Second),
+			Usage:     provider.Usage{InputTokens: 1200, OutputTokens: 300, CostUSD: 0.05, DurationMs: 85_000},
+			Gates: []gate.GateResult{
+				{Command: "go vet ./...", Passed: true},
+				{Command: "go test ./...", Passed: false},
+			},
+		},
+		{
+			Iteration:     2,
+			Provider:      "claude",
+			StartedAt:     start,
+			EndedAt:       start,
+			ProviderError: "exit status 1\nmore detail",
+		},
+	}
+
+	want := "Attempt 1 (claude) 2026-01-02T03:04:05Z, 1m30s, failed\n" +
+		"  Usage: 1,200 input / 300 output tokens, $0.05, 1m25s\n" +
+		"  ✓ go vet ./...\n" +
+		"  ✗ go test ./...\n" +
+		"Attempt 2 (claude) 2026-01-02T03:04:05Z, 0s, failed\n" +
+		"  Provider error: exit status 1\n"
+	if got := Format(attempts); got != want {
+		t.Errorf("Format() =\n%q\nwant\n%q", got, want)
+	}
+}
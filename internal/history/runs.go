@@ -0,0 +1,62 @@
+package history
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tmdgusya/do-more/internal/config"
+	"github.com/tmdgusya/do-more/internal/provider"
+)
+
+// Run records what one loop run did and consumed.
+type Run struct {
+	StartedAt time.Time      `json:"startedAt"`
+	EndedAt   time.Time      `json:"endedAt"`
+	Tasks     []string       `json:"tasks,omitempty"`
+	Usage     provider.Usage `json:"usage,omitzero"`
+}
+
+func runsPath(cfgPath string) string {
+	return filepath.Join(config.StateDir(cfgPath), "runs.json")
+}
+
+// LoadRuns returns the recorded runs, oldest first.
+func LoadRuns(cfgPath string) ([]Run, error) {
+	data, err := os.ReadFile(runsPath(cfgPath))
+	if errors.Is(err, os.ErrNotExist) {
+		return []Run{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading runs: %w", err)
+	}
+	var runs []Run
+	if err := json.Unmarshal(data, &runs); err != nil {
+		return nil, fmt.Errorf("parsing runs: %w", err)
+	}
+	return runs, nil
+}
+
+// AppendRun adds a run to the recorded runs.
+func AppendRun(cfgPath string, run Run) error {
+	runs, err := LoadRuns(cfgPath)
+	if err != nil {
+		return err
+	}
+	runs = append(runs, run)
+
+	data, err := json.MarshalIndent(runs, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling runs: %w", err)
+	}
+	if err := os.MkdirAll(config.StateDir(cfgPath), 0755); err != nil {
+		return fmt.Errorf("creating state directory: %w", err)
+	}
+	if err := os.WriteFile(runsPath(cfgPath), data, 0644); err != nil {
+		return fmt.Errorf("writing runs: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package history
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tmdgusya/do-more/internal/provider"
+)
+
+func TestAppendAndLoadRuns(t *testing.T) {
+	cfgPath := filepath.Join(t.TempDir(), "do-more.json")
+
+	runs, err := LoadRuns(cfgPath)
+	if err != nil || runs == nil || len(runs) != 0 {
+		t.Fatalf("LoadRuns = %v, %v; want an empty slice", runs, err)
+	}
+
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	run := Run{
+		StartedAt: start,
+		EndedAt:   start.Add(time.Hour),
+		Tasks:     []string{"1", "2"},
+		Usage:     provider.Usage{InputTokens: 10, OutputTokens: 5, CostUSD: 0.5, DurationMs: 1000},
+	}
+	for range 2 {
+		if err := AppendRun(cfgPath, run); err != nil {
+			t.Fatalf("AppendRun failed: %v", err)
+		}
+	}
+
+	runs, err = LoadRuns(cfgPath)
+	if err != nil {
+		t.Fatalf("LoadRuns failed: %v", err)
+	}
+	if len(runs) != 2 || runs[1].Usage != run.Usage || len(runs[1].Tasks) != 2 {
+		t.Errorf("runs = %+v, want the run twice", runs)
+	}
+}
@@ -0,0 +1,92 @@
+package loop
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tmdgusya/do-more/internal/config"
+	"github.com/tmdgusya/do-more/internal/provider"
+)
+
+// providerChain walks a task's ordered provider list, skipping names that
+// are not registered.
+type providerChain struct {
+	names    []string
+	next     int
+	current  provider.Provider
+	failures int // gate-failing iterations in a row with current
+}
+
+// advance moves to the next registered provider and reports whether there
+// was one. Unregistered names are noted in the task's learnings.
+func (r *runner) advance(task *config.Task, c *providerChain) bool {
+	for c.next < len(c.names) {
+		name := c.names[c.next]
+		c.next++
+		p, ok := r.registry.Get(name)
+		if !ok {
+			task.Learnings += fmt.Sprintf("\nUnknown provider: %q", name)
+			if len(c.names) > 1 {
+				r.logger.Log("Task #%s: skipping unknown provider: %s", task.ID, name)
+			}
+			continue
+		}
+		c.current, c.failures = r.withRunOptions(task, p), 0
+		return true
+	}
+	return false
+}
+
+// switchProvider moves task on to the next provider in c, logging why. It
+// reports false, leaving the current provider in place, when the chain is
+// exhausted.
+func (r *runner) switchProvider(task *config.Task, c *providerChain, reason string) bool {
+	from := c.current.Name()
+	if !r.advance(task, c) {
+		return false
+	}
+	r.logger.Log("Task #%s: switching provider from %s to %s (%s)", task.ID, from, c.current.Name(), reason)
+	return true
+}
+
+// succeeded records which provider got task's gates to pass when it had
+// fallbacks to choose from.
+func (c *providerChain) succeeded(task *config.Task) {
+	if len(c.names) < 2 {
+		return
+	}
+	name := c.current.Name()
+	var tried []string
+	for _, n := range c.names[:c.next] {
+		if n != name {
+			tried = append(tried, n)
+		}
+	}
+	if len(tried) == 0 {
+		task.Learnings += fmt.Sprintf("\nSucceeded with provider %s.", name)
+		return
+	}
+	task.Learnings += fmt.Sprintf("\nSucceeded with provider %s after trying %s.", name, strings.Join(tried, ", "))
+}
+
+// withRunOptions configures p for task with the model and extra arguments
+// set for it on task or the project. Configurable providers are configured
+// even without any, so that each task gets its own copy. A provider that
+// cannot take them runs with its defaults.
+func (r *runner) withRunOptions(task *config.Task, p provider.Provider) provider.Provider {
+	opts := r.cfg.RunOptions(task, p.Name())
+	cp, ok := p.(provider.ConfigurableProvider)
+	if !ok {
+		if opts.Model == "" && len(opts.ExtraArgs) == 0 {
+			return p
+		}
+		r.logger.Log("Task #%s: provider %s does not take a model or extra arguments, using its defaults", task.ID, p.Name())
+		return p
+	}
+	configured, err := cp.WithOptions(opts)
+	if err != nil {
+		r.logger.Log("Task #%s: %v, using its defaults", task.ID, err)
+		return p
+	}
+	return configured
+}
@@ -0,0 +1,113 @@
+package loop
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tmdgusya/do-more/internal/config"
+)
+
+// runLock is the content of the lock file written while a loop runs.
+type runLock struct {
+	PID       int       `json:"pid"`
+	StartedAt time.Time `json:"startedAt"`
+}
+
+// RunLockPath returns the lock file path for the config at cfgPath.
+func RunLockPath(cfgPath string) string {
+	return filepath.Join(config.StateDir(cfgPath), "run.lock")
+}
+
+// RunLockHeld reports whether a running process holds the run lock for the
+// config at cfgPath.
+func RunLockHeld(cfgPath string) bool {
+	f, err := os.Open(RunLockPath(cfgPath))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	locked, err := lockFile(f)
+	return err == nil && !locked
+}
+
+// acquireRunLock takes the run lock for this process by locking the lock
+// file. The system drops the lock when the process exits, however it exits,
+// so a file left behind by a crash or a reboot does not keep a new run out
+// even if its PID now belongs to another process. The PID and start time
+// written to the file only serve to report who holds the lock. The returned
+// function releases it.
+func acquireRunLock(cfgPath string) (func(), error) {
+	path := RunLockPath(cfgPath)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("creating state directory: %w", err)
+	}
+
+	data, err := json.Marshal(runLock{PID: os.Getpid(), StartedAt: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; attempt < 3; attempt++ {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("creating run lock: %w", err)
+		}
+		locked, err := lockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("locking run lock: %w", err)
+		}
+		if !locked {
+			f.Close()
+			if lock, err := readRunLock(path); err == nil {
+				return nil, fmt.Errorf("another do-more run (pid %d) has been active since %s", lock.PID, lock.StartedAt.Format(time.RFC3339))
+			}
+			return nil, fmt.Errorf("another do-more run holds %s", path)
+		}
+		// A run that finished between our open and lock has removed the
+		// file we locked; lock the one now at path instead.
+		if !lockedFileAt(f, path) {
+			f.Close()
+			continue
+		}
+		err = f.Truncate(0)
+		if err == nil {
+			_, err = f.WriteAt(data, 0)
+		}
+		if err != nil {
+			os.Remove(path)
+			f.Close()
+			return nil, fmt.Errorf("writing run lock: %w", err)
+		}
+		return func() {
+			os.Remove(path)
+			f.Close()
+		}, nil
+	}
+	return nil, fmt.Errorf("could not acquire run lock %s", path)
+}
+
+// lockedFileAt reports whether f is still the file at path.
+func lockedFileAt(f *os.File, path string) bool {
+	open, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(path)
+	return err == nil && os.SameFile(open, current)
+}
+
+func readRunLock(path string) (*runLock, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lock runLock
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, err
+	}
+	return &lock, nil
+}
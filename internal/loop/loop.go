@@ -2,10 +2,19 @@ package loop
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/tmdgusya/do-more/internal/config"
 	"github.com/tmdgusya/do-more/internal/gate"
+	"github.com/tmdgusya/do-more/internal/git"
+	"github.com/tmdgusya/do-more/internal/history"
 	"github.com/tmdgusya/do-more/internal/prompt"
 	"github.com/tmdgusya/do-more/internal/provider"
 )
@@ -14,120 +23,1054 @@ type Logger interface {
 	Log(format string, args ...any)
 }
 
+// OutputLogger is a Logger that also receives provider output while the
+// provider runs, one line at a time.
+type OutputLogger interface {
+	Logger
+	ProviderOutput(taskID string, line string)
+}
+
+// UsageLogger is a Logger that also receives what each provider run
+// consumed, along with the run's total so far. Loggers without it get a
+// log line when the provider reported tokens or cost.
+type UsageLogger interface {
+	Logger
+	Usage(taskID string, used, runTotal provider.Usage)
+}
+
 type StdoutLogger struct{}
 
 func (l *StdoutLogger) Log(format string, args ...any) {
 	fmt.Printf("[do-more] "+format+"\n", args...)
 }
 
+func (l *StdoutLogger) ProviderOutput(taskID string, line string) {
+	fmt.Printf("  #%s │ %s\n", taskID, line)
+}
+
+// Options tunes how RunLoopWithOptions schedules tasks.
+type Options struct {
+	// Parallel is the number of tasks run at once, each in its own git
+	// worktree. Values below 2 run tasks one at a time in workDir.
+	Parallel int
+
+	// Force allows running on a git working tree with uncommitted changes.
+	Force bool
+
+	// Resume decides what happens to tasks left in_progress by a run that
+	// exited without finishing them: ResumeContinue (the default),
+	// ResumeReset or ResumeFail.
+	Resume string
+
+	// TaskStarted, if set, is called when a task starts with a function
+	// that cancels only that task. The cause is recorded in its learnings.
+	TaskStarted func(taskID string, cancel context.CancelCauseFunc)
+
+	// TaskFinished, if set, is called when a task stops running.
+	TaskFinished func(taskID string)
+}
+
+// Resume policies for tasks left in_progress by a dead run.
+const (
+	// ResumeContinue puts the task back to pending and keeps its edits.
+	ResumeContinue = "continue"
+	// ResumeReset puts the task back to pending and, in a git repository,
+	// discards uncommitted changes left in the working tree.
+	ResumeReset = "reset"
+	// ResumeFail marks the task failed.
+	ResumeFail = "fail"
+)
+
+// BudgetError is the cause of a task or run stopped by a budget cap.
+type BudgetError struct {
+	Reason string
+}
+
+func (e *BudgetError) Error() string {
+	return "budget reached: " + e.Reason
+}
+
+// runner holds the state shared by every task in a single loop run.
+type runner struct {
+	mu           sync.Mutex // guards cfg and config saves
+	cfg          *config.Config
+	cfgPath      string
+	providerName string
+	registry     *provider.ProviderRegistry
+	logger       *lockedLogger
+	opts         Options
+
+	// isRepo is set when workDir is inside a git repository.
+	isRepo bool
+	// useGit is set when workDir is a git repository and the config names
+	// a branch; completed tasks are then committed one by one.
+	useGit bool
+	// cfgRel and stateRel are the config file and state directory relative
+	// to the repository root; both are kept out of commits.
+	cfgRel   string
+	stateRel string
+
+	// baseline caches baseline gate results by gate when the config's
+	// baseline mode is run.
+	baseline map[string]gate.GateResult
+
+	// run records this run's tasks and what its providers consumed.
+	run history.Run
+	// stopReason is set once the run reaches a budget cap; no task or
+	// iteration starts after that.
+	stopReason string
+}
+
+// lockedLogger serializes Log calls from concurrent workers.
+type lockedLogger struct {
+	mu     sync.Mutex
+	logger Logger
+}
+
+func (l *lockedLogger) Log(format string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logger.Log(format, args...)
+}
+
+// streams reports whether the wrapped logger wants provider output.
+func (l *lockedLogger) streams() bool {
+	_, ok := l.logger.(OutputLogger)
+	return ok
+}
+
+func (l *lockedLogger) ProviderOutput(taskID string, line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if ol, ok := l.logger.(OutputLogger); ok {
+		ol.ProviderOutput(taskID, line)
+	}
+}
+
+func (l *lockedLogger) Usage(taskID string, used, runTotal provider.Usage) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if ul, ok := l.logger.(UsageLogger); ok {
+		ul.Usage(taskID, used, runTotal)
+		return
+	}
+	if used.Reported() {
+		l.logger.Log("Task #%s: used %s (run total %s)", taskID, used, runTotal)
+	}
+}
+
 func RunLoop(ctx context.Context, cfgPath string, providerName string, registry *provider.ProviderRegistry, workDir string, logger Logger) error {
+	return RunLoopWithOptions(ctx, cfgPath, providerName, registry, workDir, logger, Options{})
+}
+
+func RunLoopWithOptions(ctx context.Context, cfgPath string, providerName string, registry *provider.ProviderRegistry, workDir string, logger Logger, opts Options) error {
 	cfg, err := config.LoadConfig(cfgPath)
 	if err != nil {
 		return fmt.Errorf("loading config: %w", err)
 	}
 
+	r := &runner{
+		cfg:          cfg,
+		cfgPath:      cfgPath,
+		providerName: providerName,
+		registry:     registry,
+		logger:       &lockedLogger{logger: logger},
+		opts:         opts,
+	}
+
+	switch opts.Resume {
+	case "", ResumeContinue, ResumeReset, ResumeFail:
+	default:
+		return fmt.Errorf("unknown resume policy %q", opts.Resume)
+	}
+
+	release, err := acquireRunLock(cfgPath)
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	logger.Log("Starting with default provider: %s", providerName)
+	r.run.StartedAt = time.Now()
+	defer r.recordRun()
 
-	for {
-		task := cfg.NextPendingTask()
+	r.detectRepo(ctx, workDir)
+	if err := r.recoverStaleTasks(ctx, workDir); err != nil {
+		return err
+	}
+	if err := r.prepareGit(ctx, workDir); err != nil {
+		return err
+	}
+
+	runCtx := ctx
+	if d := cfg.Budget.RunDuration(); d > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeoutCause(ctx, d, &BudgetError{Reason: fmt.Sprintf("run took %s", d)})
+		defer cancel()
+	}
+
+	if opts.Parallel > 1 {
+		err = r.runParallel(runCtx, workDir, opts.Parallel)
+	} else {
+		err = r.runSequential(runCtx, workDir)
+	}
+	if err != nil {
+		return err
+	}
+	var budgetErr *BudgetError
+	if ctx.Err() == nil && errors.As(context.Cause(runCtx), &budgetErr) {
+		r.mu.Lock()
+		r.stopReason = budgetErr.Reason
+		r.mu.Unlock()
+		r.logger.Log("Budget reached (%s): run stopped", budgetErr.Reason)
+	}
+
+	r.logSummary()
+	return nil
+}
+
+func (r *runner) runSequential(ctx context.Context, workDir string) error {
+	for ctx.Err() == nil {
+		r.mu.Lock()
+		task, err := r.claimNextTask()
+		r.mu.Unlock()
+		if err != nil {
+			return err
+		}
 		if task == nil {
 			break
 		}
 
-		task.Status = config.StatusInProgress
-		if err := config.SaveConfig(cfgPath, cfg); err != nil {
-			return fmt.Errorf("saving config: %w", err)
+		snap, err := r.snapshotTask(ctx, task, workDir)
+		if err != nil {
+			r.mu.Lock()
+			task.Status = config.StatusPending
+			if serr := r.save(); serr != nil {
+				err = errors.Join(err, serr)
+			}
+			r.mu.Unlock()
+			return err
 		}
 
-		// Resolve provider per-task
-		effectiveProvider := task.EffectiveProvider(providerName)
-		p, ok := registry.Get(effectiveProvider)
-		if !ok {
-			task.Status = config.StatusFailed
-			task.Learnings += fmt.Sprintf("\nUnknown provider: %q", effectiveProvider)
-			logger.Log("Task #%s: failed (unknown provider: %s)", task.ID, effectiveProvider)
-			if err := config.SaveConfig(cfgPath, cfg); err != nil {
-				return fmt.Errorf("saving config: %w", err)
+		passed, err := r.runTask(ctx, task, workDir)
+		removeSnapshot(r.cfgPath, task.ID)
+		if err != nil {
+			return err
+		}
+		if !passed && snap != nil && r.cfg.EffectiveOnFailure() != config.OnFailureKeep {
+			if err := r.discardFailedAttempt(ctx, task, workDir, snap); err != nil {
+				return err
+			}
+		}
+		if passed {
+			if r.useGit {
+				if err := r.commitTask(ctx, task, workDir); err != nil {
+					return err
+				}
+			}
+			r.mu.Lock()
+			err = r.completeTask(task)
+			r.mu.Unlock()
+			if err != nil {
+				return err
 			}
-			continue
 		}
+	}
+	return nil
+}
+
+// snapshotTask records the state of workDir before task starts, both for
+// onFailure and so that --resume reset can undo the task if the process
+// dies while it runs. It returns nil outside a repository and in one with no
+// commits yet, which has no HEAD to return to.
+func (r *runner) snapshotTask(ctx context.Context, task *config.Task, workDir string) (*git.Snapshot, error) {
+	if !r.isRepo || !git.HasCommits(ctx, workDir) {
+		return nil, nil
+	}
+	snap, err := git.TakeSnapshot(ctx, workDir)
+	if err != nil {
+		return nil, fmt.Errorf("snapshotting before task %s: %w", task.ID, err)
+	}
+	if err := saveSnapshot(r.cfgPath, task.ID, snap); err != nil {
+		return nil, fmt.Errorf("saving snapshot of task %s: %w", task.ID, err)
+	}
+	return snap, nil
+}
 
-		var gateOutput string
-		completed := false
+// runParallel runs up to n tasks at once. Each task gets a worktree on its
+// own branch; finished branches are merged back into workDir one at a time.
+func (r *runner) runParallel(ctx context.Context, workDir string, n int) error {
+	if !git.IsRepo(ctx, workDir) {
+		return fmt.Errorf("parallel mode requires a git repository in %s", workDir)
+	}
+	base, err := git.CurrentBranch(ctx, workDir)
+	if err != nil {
+		return fmt.Errorf("resolving current branch: %w", err)
+	}
 
-		for iteration := 1; iteration <= cfg.MaxIterations; iteration++ {
-			logger.Log("── Iteration %d/%d ── Task #%s: %s", iteration, cfg.MaxIterations, task.ID, task.Title)
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-			pr := prompt.BuildPrompt(task, cfg.Gates, gateOutput)
+	// repoMu serializes git commands that change the main repository's
+	// metadata; concurrent worktree adds and merges race inside git.
+	var repoMu sync.Mutex
+	finished := make(chan error)
+	inFlight := 0
+	var firstErr error
 
-			logger.Log("Invoking %s...", p.Name())
-			output, err := p.Run(ctx, pr, workDir)
-			if err != nil {
-				logger.Log("Provider error: %v", err)
-				if iteration >= cfg.MaxIterations {
-					task.Status = config.StatusFailed
-					task.Learnings += fmt.Sprintf("\nFailed after %d iterations. Last error: %v", iteration, err)
+	for {
+		if firstErr == nil && runCtx.Err() == nil {
+			r.mu.Lock()
+			for inFlight < n {
+				task, err := r.claimNextTask()
+				if err != nil {
+					firstErr = err
+					cancel()
 					break
 				}
-				gateOutput = fmt.Sprintf("Provider error: %v\nOutput: %s", err, output)
-				continue
+				if task == nil {
+					break
+				}
+				inFlight++
+				go func() {
+					finished <- r.runInWorktree(runCtx, task, workDir, base, &repoMu)
+				}()
 			}
+			r.mu.Unlock()
+		}
+
+		if inFlight == 0 {
+			break
+		}
+		if err := <-finished; err != nil && firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+		inFlight--
+	}
+	return firstErr
+}
 
-			logger.Log("Provider finished")
+func (r *runner) runInWorktree(ctx context.Context, task *config.Task, workDir, base string, repoMu *sync.Mutex) error {
+	branch := "do-more/task-" + task.ID
+	wtDir, err := os.MkdirTemp("", "do-more-worktree-")
+	if err != nil {
+		return fmt.Errorf("creating worktree directory: %w", err)
+	}
+	defer os.RemoveAll(wtDir)
 
-			results, err := gate.RunGates(ctx, cfg.Gates, workDir)
-			if err != nil {
-				return fmt.Errorf("running gates: %w", err)
+	repoMu.Lock()
+	err = git.AddWorktree(ctx, workDir, wtDir, branch, base)
+	repoMu.Unlock()
+	if err != nil {
+		r.mu.Lock()
+		task.Status = config.StatusPending
+		r.save()
+		r.mu.Unlock()
+		return fmt.Errorf("creating worktree for task %s: %w", task.ID, err)
+	}
+	defer func() {
+		// Use a fresh context so cleanup still happens after cancellation.
+		repoMu.Lock()
+		defer repoMu.Unlock()
+		git.RemoveWorktree(context.Background(), workDir, wtDir)
+		git.DeleteBranch(context.Background(), workDir, branch)
+	}()
+
+	passed, err := r.runTask(ctx, task, wtDir)
+	if err != nil {
+		return err
+	}
+	if !passed {
+		// The worktree is removed either way, so only stash-to-branch
+		// needs to act on a failed attempt.
+		if r.cfg.EffectiveOnFailure() == config.OnFailureStashToBranch {
+			return r.discardFailedAttempt(ctx, task, wtDir, nil)
+		}
+		return nil
+	}
+
+	committed, err := git.CommitAll(ctx, wtDir, commitMessage(task), r.excludes()...)
+	if err != nil {
+		return fmt.Errorf("committing task %s: %w", task.ID, err)
+	}
+
+	if committed {
+		repoMu.Lock()
+		err = git.Merge(ctx, workDir, branch, fmt.Sprintf("Merge task #%s: %s", task.ID, task.Title))
+		repoMu.Unlock()
+		if errors.Is(err, git.ErrMergeConflict) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			task.Status = config.StatusFailed
+			task.Learnings += fmt.Sprintf("\nGates passed but merging branch %s failed: %v", branch, err)
+			r.logger.Log("Task #%s: failed (merge conflict)", task.ID)
+			return r.save()
+		}
+		if err != nil {
+			return fmt.Errorf("merging task %s: %w", task.ID, err)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.completeTask(task)
+}
+
+// detectRepo records whether workDir is a git repository and where the
+// config and state directory sit inside it.
+func (r *runner) detectRepo(ctx context.Context, workDir string) {
+	if !git.IsRepo(ctx, workDir) {
+		if r.cfg.Branch != "" {
+			r.logger.Log("Not a git repository; skipping branch checkout and commits")
+		}
+		if policy := r.cfg.EffectiveOnFailure(); policy != config.OnFailureKeep {
+			r.logger.Log("Not a git repository; onFailure %q ignored", policy)
+		}
+		return
+	}
+	r.isRepo = true
+	r.cfgRel = repoRelative(ctx, workDir, r.cfgPath)
+	r.stateRel = repoRelative(ctx, workDir, config.StateDir(r.cfgPath))
+}
+
+// recoverStaleTasks applies the resume policy to tasks left in_progress.
+// Holding the run lock guarantees no other live process owns them.
+func (r *runner) recoverStaleTasks(ctx context.Context, workDir string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stale := r.cfg.TasksWithStatus(config.StatusInProgress)
+	if len(stale) == 0 {
+		return nil
+	}
+
+	policy := r.opts.Resume
+	if policy == "" {
+		policy = ResumeContinue
+	}
+
+	if r.isRepo {
+		// Worktrees from an interrupted parallel run are gone; drop their
+		// bookkeeping so the branches can be reused.
+		git.Run(ctx, workDir, "worktree", "prune")
+	}
+
+	for _, task := range stale {
+		if policy == ResumeReset {
+			if err := r.resetStaleTask(ctx, task, workDir); err != nil {
+				return err
 			}
+		}
+		removeSnapshot(r.cfgPath, task.ID)
+		switch policy {
+		case ResumeFail:
+			task.Status = config.StatusFailed
+			task.Learnings += "\nInterrupted: the previous run exited while this task was in progress"
+			r.logger.Log("Task #%s: failed (interrupted by a previous run)", task.ID)
+		default:
+			task.Status = config.StatusPending
+			task.Learnings += "\nResumed after the previous run was interrupted"
+			r.logger.Log("Task #%s: recovered from interrupted run (%s)", task.ID, policy)
+		}
+	}
+	return r.save()
+}
+
+// resetStaleTask returns the working tree to how it was before task
+// started, as recorded in its snapshot, and drops the task's provider
+// session, which would remember the discarded edits. Only what changed
+// since the snapshot is touched, and discarding it requires --force. A task
+// without a snapshot, such as one that ran in a worktree, leaves the tree
+// alone. The caller must hold r.mu.
+func (r *runner) resetStaleTask(ctx context.Context, task *config.Task, workDir string) error {
+	if !r.isRepo {
+		return nil
+	}
+	snap, err := loadSnapshot(r.cfgPath, task.ID)
+	if err != nil {
+		return err
+	}
+	if snap == nil {
+		r.logger.Log("Task #%s: no record of the tree before it started, keeping its changes", task.ID)
+		return nil
+	}
+	changes, err := snap.Changes(ctx, workDir, r.excludes()...)
+	if err != nil {
+		return fmt.Errorf("checking changes of interrupted task %s: %w", task.ID, err)
+	}
+	if len(changes) > 0 && !r.opts.Force {
+		return fmt.Errorf("--resume reset would discard changes made since task #%s started (%s); run with --force to discard them", task.ID, strings.Join(changes, ", "))
+	}
+	if err := snap.Restore(ctx, workDir, r.excludes()...); err != nil {
+		return fmt.Errorf("discarding changes from interrupted run: %w", err)
+	}
+	task.Session = nil
+	r.logger.Log("Task #%s: discarded changes from interrupted run (%d files)", task.ID, len(changes))
+	return nil
+}
+
+// prepareGit checks out the configured branch and refuses to start on a
+// dirty working tree unless forced. Outside a git repository, or when no
+// branch is configured, git integration is skipped.
+func (r *runner) prepareGit(ctx context.Context, workDir string) error {
+	if !r.isRepo {
+		return nil
+	}
+
+	if r.cfg.Branch == "" && r.opts.Parallel < 2 {
+		return nil
+	}
+
+	dirty, err := git.DirtyFiles(ctx, workDir)
+	if err != nil {
+		return fmt.Errorf("checking working tree: %w", err)
+	}
+	dirty = slices.DeleteFunc(dirty, r.isExcluded)
+	if len(dirty) > 0 && !r.opts.Force {
+		return fmt.Errorf("working tree has uncommitted changes (%s); commit them or run with --force", strings.Join(dirty, ", "))
+	}
+
+	if r.cfg.Branch != "" {
+		if err := git.Checkout(ctx, workDir, r.cfg.Branch); err != nil {
+			return fmt.Errorf("checking out branch %s: %w", r.cfg.Branch, err)
+		}
+		r.logger.Log("On branch %s", r.cfg.Branch)
+		r.useGit = true
+	}
+	return nil
+}
+
+// discardFailedAttempt applies the onFailure policy to a task that ended
+// failed: the attempt is optionally saved to do-more/failed/<task-id>, then
+// dir is restored to snap. A nil snap skips the restore. Tasks that did not
+// fail, such as interrupted ones, are left alone.
+func (r *runner) discardFailedAttempt(ctx context.Context, task *config.Task, dir string, snap *git.Snapshot) error {
+	r.mu.Lock()
+	failed := task.Status == config.StatusFailed
+	r.mu.Unlock()
+	if !failed {
+		return nil
+	}
+
+	var note string
+	if r.cfg.EffectiveOnFailure() == config.OnFailureStashToBranch {
+		branch := "do-more/failed/" + task.ID
+		message := fmt.Sprintf("do-more: failed attempt at task #%s %s", task.ID, task.Title)
+		if err := git.SaveToBranch(ctx, dir, branch, message, r.excludes()...); err != nil {
+			return fmt.Errorf("saving failed attempt of task %s: %w", task.ID, err)
+		}
+		note = fmt.Sprintf("\nFailed attempt saved to branch %s", branch)
+		r.logger.Log("Task #%s: failed attempt saved to %s", task.ID, branch)
+	}
+
+	if snap != nil {
+		if err := snap.Restore(ctx, dir, r.excludes()...); err != nil {
+			return fmt.Errorf("reverting task %s: %w", task.ID, err)
+		}
+		r.logger.Log("Task #%s: working tree reverted", task.ID)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	task.Learnings += note
+	return r.save()
+}
+
+// repoRelative returns path relative to the root of the repository that
+// contains workDir, or "" if it cannot be resolved.
+func repoRelative(ctx context.Context, workDir, path string) string {
+	top, err := git.TopLevel(ctx, workDir)
+	if err != nil {
+		return ""
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return ""
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		abs = resolved
+	}
+	if resolved, err := filepath.EvalSymlinks(top); err == nil {
+		top = resolved
+	}
+	rel, err := filepath.Rel(top, abs)
+	if err != nil {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// commitTask commits everything the provider changed in dir for task.
+func (r *runner) commitTask(ctx context.Context, task *config.Task, dir string) error {
+	committed, err := git.CommitAll(ctx, dir, commitMessage(task), r.excludes()...)
+	if err != nil {
+		return fmt.Errorf("committing task %s: %w", task.ID, err)
+	}
+	if committed {
+		r.logger.Log("Committed task #%s", task.ID)
+	} else {
+		r.logger.Log("Task #%s: no changes to commit", task.ID)
+	}
+	return nil
+}
+
+// excludes lists paths that must never be part of a task commit.
+func (r *runner) excludes() []string {
+	var paths []string
+	for _, p := range []string{r.cfgRel, r.stateRel} {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// isExcluded reports whether a repository-relative path is one of the
+// excludes or lies inside one.
+func (r *runner) isExcluded(path string) bool {
+	for _, p := range r.excludes() {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func commitMessage(task *config.Task) string {
+	msg := fmt.Sprintf("do-more: task #%s %s", task.ID, task.Title)
+	if task.Description != "" {
+		msg += "\n\n" + task.Description
+	}
+	return msg
+}
+
+// claimNextTask unblocks tasks whose dependencies are no longer failed,
+// blocks tasks whose dependencies failed, then marks the next ready task
+// in_progress. The caller must hold r.mu.
+func (r *runner) claimNextTask() (*config.Task, error) {
+	if r.stopReason != "" {
+		return nil, nil
+	}
+	unblocked := r.cfg.UnblockReachableTasks()
+	for _, t := range unblocked {
+		r.logger.Log("Task #%s: unblocked (dependencies no longer failed)", t.ID)
+	}
+	blocked := r.cfg.BlockUnreachableTasks()
+	for _, t := range blocked {
+		r.logger.Log("Task #%s: blocked (dependency failed)", t.ID)
+	}
+	if len(unblocked) > 0 || len(blocked) > 0 {
+		if err := r.save(); err != nil {
+			return nil, err
+		}
+	}
+
+	task := r.cfg.NextPendingTask()
+	if task == nil {
+		return nil, nil
+	}
+	task.Status = config.StatusInProgress
+	r.run.Tasks = append(r.run.Tasks, task.ID)
+	if err := r.save(); err != nil {
+		return nil, err
+	}
+	return task, nil
+}
+
+// completeTask marks task done. The caller must hold r.mu.
+func (r *runner) completeTask(task *config.Task) error {
+	task.Status = config.StatusDone
+	r.logger.Log("Task #%s: done", task.ID)
+	return r.save()
+}
+
+// save persists the config. The caller must hold r.mu.
+func (r *runner) save() error {
+	if err := config.SaveConfig(r.cfgPath, r.cfg); err != nil {
+		return fmt.Errorf("saving config: %w", err)
+	}
+	return nil
+}
+
+// runTask iterates the provider and gates for task in dir until the gates
+// pass or the iteration budget runs out. It reports whether the gates passed
+// and leaves marking the task done to the caller; failures are recorded on
+// the task directly.
+func (r *runner) runTask(ctx context.Context, task *config.Task, dir string) (bool, error) {
+	taskCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	if r.opts.TaskStarted != nil {
+		r.opts.TaskStarted(task.ID, cancel)
+	}
+	if r.opts.TaskFinished != nil {
+		defer r.opts.TaskFinished(task.ID)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-			allPassed := true
-			for _, r := range results {
-				if r.Passed {
-					logger.Log("Running gate: %s  ✓", r.Command)
-				} else {
-					logger.Log("Running gate: %s  ✗", r.Command)
-					allPassed = false
+	if d := r.cfg.Budget.TaskDuration(); d > 0 {
+		var stop context.CancelFunc
+		taskCtx, stop = context.WithTimeoutCause(taskCtx, d, &BudgetError{Reason: fmt.Sprintf("task took %s", d)})
+		defer stop()
+	}
+
+	// Resolve the task's providers; later ones are fallbacks.
+	chain := &providerChain{names: task.ProviderChain(r.providerName)}
+	if !r.advance(task, chain) {
+		task.Status = config.StatusFailed
+		r.logger.Log("Task #%s: failed (unknown provider: %s)", task.ID, strings.Join(chain.names, ", "))
+		return false, r.save()
+	}
+	policy := r.cfg.ProviderSwitch
+
+	maxIterations := r.cfg.MaxIterations
+	gates := r.cfg.EffectiveGates(task)
+	var gateOutput string
+
+	baseline, err := r.runBaseline(taskCtx, task, gates, dir)
+	if err != nil {
+		return false, err
+	}
+	if taskCtx.Err() != nil {
+		return false, r.interruptTask(ctx, taskCtx, task)
+	}
+	baselineNote := gate.BaselineSummary(baseline, r.cfg.EffectiveOutputBudget()/2)
+	stalls := stallDetector{limit: r.cfg.EffectiveStagnationLimit()}
+
+	for iteration := 1; iteration <= maxIterations; iteration++ {
+		if r.stopReason != "" {
+			task.Status = config.StatusPending
+			r.logger.Log("Task #%s: left pending (budget reached)", task.ID)
+			return false, r.save()
+		}
+		r.logger.Log("── Iteration %d/%d ── Task #%s: %s", iteration, maxIterations, task.ID, task.Title)
+
+		p := chain.current
+		session := task.ResumeSession(p.Name())
+		pr := prompt.BuildPromptWithBaseline(task, gates, gateOutput, baselineNote)
+		if session != "" && gateOutput != "" {
+			pr = prompt.BuildFollowUpPrompt(gateOutput)
+		}
+
+		attempt := history.Attempt{Iteration: iteration, Provider: p.Name(), StartedAt: time.Now()}
+
+		if session != "" {
+			r.logger.Log("Invoking %s (continuing session %s)...", p.Name(), session)
+		} else {
+			r.logger.Log("Invoking %s...", p.Name())
+		}
+		r.mu.Unlock()
+		res, err := r.runProvider(taskCtx, p, task.ID, pr, dir, session)
+		r.mu.Lock()
+		output, next := res.Output, res.Session
+		if err := r.addUsage(task, &attempt, res.Usage); err != nil {
+			return false, err
+		}
+		if taskCtx.Err() != nil {
+			return false, r.interruptTask(ctx, taskCtx, task)
+		}
+		attempt.Output = output
+		attempt.Session = next
+		if err := r.keepSession(task, p.Name(), next, err); err != nil {
+			return false, err
+		}
+		if err != nil {
+			r.logger.Log("Provider error: %v", err)
+			attempt.ProviderError = err.Error()
+			attempt.FailureSummary = fmt.Sprintf("Provider error: %v", err)
+			r.mu.Unlock()
+			tree := r.treeState(taskCtx, dir)
+			r.mu.Lock()
+			attempt.Fingerprint = fingerprint(tree, "provider error: "+gate.NormalizeOutput(err.Error()))
+			if err := r.recordAttempt(task, attempt); err != nil {
+				return false, err
+			}
+			if iteration < maxIterations && policy.SwitchOnError() && r.switchProvider(task, chain, "provider error") {
+				stalls = stallDetector{limit: stalls.limit}
+				gateOutput = attempt.FailureSummary
+				continue
+			}
+			if iteration < maxIterations && stalls.observe(attempt.Fingerprint) {
+				if !policy.SwitchOnStagnation() || !r.switchProvider(task, chain, "no progress") {
+					r.stagnate(task, iteration, stalls.limit)
+					break
 				}
+				stalls = stallDetector{limit: stalls.limit}
 			}
-
-			if allPassed {
-				task.Status = config.StatusDone
-				completed = true
-				logger.Log("Task #%s: done", task.ID)
+			if iteration >= maxIterations {
+				task.Status = config.StatusFailed
+				task.Learnings += fmt.Sprintf("\nFailed after %d iterations. Last error: %v", iteration, err)
 				break
 			}
+			gateOutput = fmt.Sprintf("Provider error: %v\nOutput: %s", err, gate.Clip(gate.CleanOutput(output), r.cfg.EffectiveOutputBudget()))
+			continue
+		}
 
-			if iteration >= cfg.MaxIterations {
-				task.Status = config.StatusFailed
-				task.Learnings += fmt.Sprintf("\nFailed after %d iterations. Gates did not pass.", iteration)
-				logger.Log("Task #%s: failed (max iterations reached)", task.ID)
+		r.logger.Log("Provider finished")
+
+		r.mu.Unlock()
+		results, err := gate.RunGatesWithOptions(taskCtx, gates, dir, r.cfg.GateOptions())
+		tree := r.treeState(taskCtx, dir)
+		r.mu.Lock()
+		if err != nil {
+			return false, fmt.Errorf("running gates: %w", err)
+		}
+		if taskCtx.Err() != nil {
+			return false, r.interruptTask(ctx, taskCtx, task)
+		}
+		if baseline != nil {
+			results = gate.ApplyBaseline(results, baseline)
+		}
+
+		for _, res := range results {
+			if res.Skipped {
+				r.logger.Log("Gate skipped (fail-fast): %s", res.Label())
+				continue
+			}
+			if res.Passed {
+				r.logger.Log("Running gate: %s  ✓", res.Label())
+			} else {
+				r.logger.Log("Running gate: %s  ✗", res.Label())
+			}
+			if res.TimedOut {
+				r.logger.Log("Gate timed out after %s: %s", res.Duration.Round(time.Millisecond), res.Label())
+			}
+			if !res.Passed && res.Advisory {
+				r.logger.Log("Advisory gate failed, not blocking: %s", res.Label())
+			}
+			if !res.Passed && res.PreExisting {
+				r.logger.Log("Gate failure is pre-existing, not blocking: %s", res.Label())
+			}
+		}
+
+		attempt.Gates = results
+		attempt.Passed = gate.AllGatesPassed(results)
+		if !attempt.Passed {
+			attempt.FailureSummary = gate.GateFailureSummaryWithBudget(results, r.cfg.EffectiveOutputBudget())
+			attempt.Fingerprint = fingerprint(tree, gate.FailureFingerprint(results))
+		}
+		if err := r.recordAttempt(task, attempt); err != nil {
+			return false, err
+		}
+
+		if attempt.Passed {
+			chain.succeeded(task)
+			return true, nil
+		}
+
+		chain.failures++
+		if iteration < maxIterations && stalls.observe(attempt.Fingerprint) {
+			if !policy.SwitchOnStagnation() || !r.switchProvider(task, chain, "no progress") {
+				r.stagnate(task, iteration, stalls.limit)
 				break
 			}
+			stalls = stallDetector{limit: stalls.limit}
+		} else if k := policy.SwitchAfterFailures(); iteration < maxIterations && k > 0 && chain.failures >= k {
+			if r.switchProvider(task, chain, fmt.Sprintf("gates failed %d times", k)) {
+				stalls = stallDetector{limit: stalls.limit}
+			}
+		}
+
+		if iteration >= maxIterations {
+			task.Status = config.StatusFailed
+			task.Learnings += fmt.Sprintf("\nFailed after %d iterations. Gates did not pass.", iteration)
+			r.logger.Log("Task #%s: failed (max iterations reached)", task.ID)
+			break
+		}
+
+		gateOutput = attempt.FailureSummary
+	}
+
+	return false, r.save()
+}
+
+// runBaseline runs gates before the provider touches dir so that failures
+// which are already there can be told apart from new ones. It returns nil
+// when baselines are off. In run mode each gate's first baseline is reused
+// for later tasks. It must be called with r.mu held.
+func (r *runner) runBaseline(ctx context.Context, task *config.Task, gates []gate.Gate, dir string) ([]gate.GateResult, error) {
+	mode := r.cfg.Baseline
+	if mode == "" || mode == config.BaselineOff || len(gates) == 0 {
+		return nil, nil
+	}
+
+	missing := gates
+	if mode == config.BaselineRun {
+		missing = nil
+		for _, g := range gates {
+			if _, ok := r.baseline[baselineKey(g)]; !ok {
+				missing = append(missing, g)
+			}
+		}
+	}
 
-			gateOutput = gate.GateFailureSummary(results)
+	var fresh []gate.GateResult
+	if len(missing) > 0 {
+		r.logger.Log("Task #%s: running baseline gates", task.ID)
+		// Every gate needs a verdict, so a failure must not skip the rest.
+		opts := r.cfg.GateOptions()
+		opts.FailFast = false
+		r.mu.Unlock()
+		results, err := gate.RunGatesWithOptions(ctx, missing, dir, opts)
+		r.mu.Lock()
+		if err != nil {
+			return nil, fmt.Errorf("running baseline gates: %w", err)
 		}
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+		fresh = results
+	}
+
+	if mode == config.BaselineTask {
+		r.logBaseline(fresh)
+		return fresh, nil
+	}
+	if r.baseline == nil {
+		r.baseline = make(map[string]gate.GateResult)
+	}
+	for i, g := range missing {
+		r.baseline[baselineKey(g)] = fresh[i]
+	}
+	baseline := make([]gate.GateResult, len(gates))
+	for i, g := range gates {
+		baseline[i] = r.baseline[baselineKey(g)]
+	}
+	r.logBaseline(fresh)
+	return baseline, nil
+}
 
-		if err := config.SaveConfig(cfgPath, cfg); err != nil {
-			return fmt.Errorf("saving config: %w", err)
+func (r *runner) logBaseline(results []gate.GateResult) {
+	for _, res := range results {
+		if !res.Passed {
+			r.logger.Log("Baseline: gate already failing: %s", res.Label())
 		}
+	}
+}
 
-		_ = completed
+func baselineKey(g gate.Gate) string {
+	return g.Name + "\x00" + g.Run + "\x00" + g.Dir
+}
+
+// keepSession stores the session a provider run left behind on task so
+// the next iteration, or the next run, can continue it. A failed run's
+// session may be unusable and is dropped. The caller must hold r.mu.
+func (r *runner) keepSession(task *config.Task, providerName, next string, runErr error) error {
+	var session *config.Session
+	if runErr == nil && next != "" && !task.FreshSession {
+		session = &config.Session{Provider: providerName, ID: next}
+	}
+	if session == task.Session || session != nil && task.Session != nil && *session == *task.Session {
+		return nil
+	}
+	task.Session = session
+	return r.save()
+}
+
+// addUsage adds what one provider run consumed to its attempt, its task
+// and the run, and saves the task's new total. The caller must hold r.mu.
+func (r *runner) addUsage(task *config.Task, attempt *history.Attempt, used provider.Usage) error {
+	attempt.Usage = used
+	task.Usage.Add(used)
+	r.run.Usage.Add(used)
+	r.logger.Usage(task.ID, used, r.run.Usage)
+	if reason := r.cfg.Budget.Exceeded(r.run.Usage); reason != "" && r.stopReason == "" {
+		r.stopReason = reason
+		r.logger.Log("Budget reached (%s): no new iterations will start", reason)
 	}
+	return r.save()
+}
+
+// recordRun appends this run to the recorded runs when it worked on any
+// task.
+func (r *runner) recordRun() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.run.Tasks) == 0 {
+		return
+	}
+	r.run.EndedAt = time.Now()
+	if err := history.AppendRun(r.cfgPath, r.run); err != nil {
+		r.logger.Log("Recording run: %v", err)
+	}
+}
+
+// stagnate fails task because its last limit iterations changed nothing and
+// failed the same way.
+func (r *runner) stagnate(task *config.Task, iteration, limit int) {
+	task.Status = config.StatusFailed
+	task.Learnings += fmt.Sprintf("\nStopped after %d iterations: the last %d made no progress (same working tree, same failures).", iteration, limit)
+	r.logger.Log("Task #%s: failed (stagnated: no progress in %d iterations)", task.ID, limit)
+}
+
+// fingerprint combines a working-tree state and a failure fingerprint. It
+// is empty when the tree state is unknown, so such iterations never count
+// as repeats.
+func fingerprint(tree, failures string) string {
+	if tree == "" {
+		return ""
+	}
+	return tree + ":" + failures
+}
+
+// recordAttempt finishes attempt and appends it to the task's history.
+func (r *runner) recordAttempt(task *config.Task, attempt history.Attempt) error {
+	attempt.EndedAt = time.Now()
+	if err := history.Append(r.cfgPath, task.ID, attempt); err != nil {
+		return fmt.Errorf("recording attempt for task %s: %w", task.ID, err)
+	}
+	return nil
+}
+
+// interruptTask records why a task stopped early. When the whole run was
+// cancelled the task goes back to pending so the next run picks it up;
+// when only this task was cancelled it fails with the cancellation cause.
+// The caller must hold r.mu.
+func (r *runner) interruptTask(ctx, taskCtx context.Context, task *config.Task) error {
+	if ctx.Err() != nil {
+		task.Status = config.StatusPending
+		var budgetErr *BudgetError
+		if errors.As(context.Cause(ctx), &budgetErr) {
+			r.logger.Log("Task #%s: left pending (%v)", task.ID, budgetErr)
+		} else {
+			r.logger.Log("Task #%s: interrupted", task.ID)
+		}
+		return r.save()
+	}
+	cause := context.Cause(taskCtx)
+	task.Status = config.StatusFailed
+	task.Learnings += fmt.Sprintf("\nCancelled: %v", cause)
+	r.logger.Log("Task #%s: failed (%v)", task.ID, cause)
+	return r.save()
+}
+
+func (r *runner) logSummary() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	// Print summary
 	done := 0
 	failed := 0
-	for _, t := range cfg.Tasks {
+	blocked := 0
+	for _, t := range r.cfg.Tasks {
 		switch t.Status {
 		case config.StatusDone:
 			done++
 		case config.StatusFailed:
 			failed++
+		case config.StatusBlocked:
+			blocked++
 		}
 	}
-	total := len(cfg.Tasks)
-	logger.Log("── Summary ──")
-	logger.Log("%d/%d tasks done, %d failed", done, total, failed)
-
-	return nil
+	total := len(r.cfg.Tasks)
+	r.logger.Log("── Summary ──")
+	r.logger.Log("%d/%d tasks done, %d failed, %d blocked", done, total, failed, blocked)
+	if r.stopReason != "" {
+		pending := len(r.cfg.TasksWithStatus(config.StatusPending))
+		r.logger.Log("Stopped early, budget reached (%s): %d tasks left pending", r.stopReason, pending)
+	}
+	if len(r.run.Tasks) > 0 {
+		r.logger.Log("Usage: %s", r.run.Usage)
+	}
 }
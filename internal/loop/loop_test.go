@@ -2,11 +2,20 @@ package loop
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/tmdgusya/do-more/internal/config"
+	"github.com/tmdgusya/do-more/internal/gate"
+	"github.com/tmdgusya/do-more/internal/git"
+	"github.com/tmdgusya/do-more/internal/history"
 	"github.com/tmdgusya/do-more/internal/provider"
 )
 
@@ -33,6 +42,27 @@ func (l *LogRecorder) Log(format string, args ...any) {
 	l.Messages = append(l.Messages, format)
 }
 
+// writeFakeConfig saves cfg in dir along with the script the fake provider
+// follows there, and returns the config's path.
+func writeFakeConfig(t *testing.T, dir string, cfg *config.Config, script string) string {
+	t.Helper()
+	cfgPath := filepath.Join(dir, "do-more.json")
+	if err := config.SaveConfig(cfgPath, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, provider.DefaultFakeScript), []byte(script), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return cfgPath
+}
+
+// fakeRegistry returns a registry holding just the fake provider.
+func fakeRegistry() *provider.ProviderRegistry {
+	registry := provider.NewProviderRegistry()
+	registry.Register(provider.NewFakeProvider())
+	return registry
+}
+
 func TestLoopAllTasksComplete(t *testing.T) {
 	dir := t.TempDir()
 	cfgPath := filepath.Join(dir, "do-more.json")
@@ -40,7 +70,7 @@ func TestLoopAllTasksComplete(t *testing.T) {
 	cfg := &config.Config{
 		Name:          "test",
 		Provider:      "mock",
-		Gates:         []string{"true"},
+		Gates:         gate.Commands("true"),
 		MaxIterations: 3,
 		Tasks: []config.Task{
 			{ID: "1", Title: "Task one", Description: "Do thing one", Status: config.StatusPending},
@@ -75,7 +105,7 @@ func TestLoopProviderFails(t *testing.T) {
 	cfg := &config.Config{
 		Name:          "test",
 		Provider:      "failing",
-		Gates:         []string{"true"},
+		Gates:         gate.Commands("true"),
 		MaxIterations: 2,
 		Tasks: []config.Task{
 			{ID: "1", Title: "Task one", Description: "Do thing", Status: config.StatusPending},
@@ -111,7 +141,7 @@ func TestLoopGateFails(t *testing.T) {
 	cfg := &config.Config{
 		Name:          "test",
 		Provider:      "mock",
-		Gates:         []string{"false"},
+		Gates:         gate.Commands("false"),
 		MaxIterations: 2,
 		Tasks: []config.Task{
 			{ID: "1", Title: "Task one", Description: "Do thing", Status: config.StatusPending},
@@ -143,10 +173,10 @@ func TestPerTaskProvider(t *testing.T) {
 	cfg := &config.Config{
 		Name:          "test",
 		Provider:      "mock-a",
-		Gates:         []string{"true"},
+		Gates:         gate.Commands("true"),
 		MaxIterations: 3,
 		Tasks: []config.Task{
-			{ID: "1", Title: "Task one", Description: "Do thing", Status: config.StatusPending, Provider: "mock-b"},
+			{ID: "1", Title: "Task one", Description: "Do thing", Status: config.StatusPending, Provider: config.ProviderList{"mock-b"}},
 		},
 	}
 	if err := config.SaveConfig(cfgPath, cfg); err != nil {
@@ -176,7 +206,7 @@ func TestDefaultProviderFallback(t *testing.T) {
 	cfg := &config.Config{
 		Name:          "test",
 		Provider:      "mock",
-		Gates:         []string{"true"},
+		Gates:         gate.Commands("true"),
 		MaxIterations: 3,
 		Tasks: []config.Task{
 			{ID: "1", Title: "Task one", Description: "Do thing", Status: config.StatusPending},
@@ -208,10 +238,10 @@ func TestInvalidProviderFails(t *testing.T) {
 	cfg := &config.Config{
 		Name:          "test",
 		Provider:      "mock",
-		Gates:         []string{"true"},
+		Gates:         gate.Commands("true"),
 		MaxIterations: 3,
 		Tasks: []config.Task{
-			{ID: "1", Title: "Task one", Description: "Do thing", Status: config.StatusPending, Provider: "nonexistent"},
+			{ID: "1", Title: "Task one", Description: "Do thing", Status: config.StatusPending, Provider: config.ProviderList{"nonexistent"}},
 		},
 	}
 	if err := config.SaveConfig(cfgPath, cfg); err != nil {
@@ -236,6 +266,1455 @@ func TestInvalidProviderFails(t *testing.T) {
 	}
 }
 
+func TestLoopRunsTasksInDependencyOrder(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "do-more.json")
+
+	cfg := &config.Config{
+		Name:          "test",
+		Provider:      "mock",
+		Gates:         gate.Commands("true"),
+		MaxIterations: 1,
+		Tasks: []config.Task{
+			{ID: "1", Title: "Task one", Status: config.StatusPending, DependsOn: []string{"2"}},
+			{ID: "2", Title: "Task two", Status: config.StatusPending},
+		},
+	}
+	if err := config.SaveConfig(cfgPath, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &recordingProvider{name: "mock"}
+	registry := provider.NewProviderRegistry()
+	registry.Register(rec)
+
+	err := RunLoop(context.Background(), cfgPath, "mock", registry, dir, &LogRecorder{})
+	if err != nil {
+		t.Fatalf("RunLoop failed: %v", err)
+	}
+
+	if len(rec.prompts) != 2 {
+		t.Fatalf("provider called %d times, want 2", len(rec.prompts))
+	}
+	if !contains(rec.prompts[0], "Task two") || !contains(rec.prompts[1], "Task one") {
+		t.Errorf("tasks ran out of dependency order")
+	}
+}
+
+func TestLoopBlocksTasksWithFailedDependency(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "do-more.json")
+
+	cfg := &config.Config{
+		Name:          "test",
+		Provider:      "mock",
+		Gates:         gate.Commands("false"),
+		MaxIterations: 1,
+		Tasks: []config.Task{
+			{ID: "1", Title: "Task one", Status: config.StatusPending},
+			{ID: "2", Title: "Task two", Status: config.StatusPending, DependsOn: []string{"1"}},
+		},
+	}
+	if err := config.SaveConfig(cfgPath, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &recordingProvider{name: "mock"}
+	registry := provider.NewProviderRegistry()
+	registry.Register(rec)
+
+	err := RunLoop(context.Background(), cfgPath, "mock", registry, dir, &LogRecorder{})
+	if err != nil {
+		t.Fatalf("RunLoop failed: %v", err)
+	}
+
+	reloaded, _ := config.LoadConfig(cfgPath)
+	if reloaded.Tasks[0].Status != config.StatusFailed {
+		t.Errorf("task 1 status = %q, want %q", reloaded.Tasks[0].Status, config.StatusFailed)
+	}
+	if reloaded.Tasks[1].Status != config.StatusBlocked {
+		t.Errorf("task 2 status = %q, want %q", reloaded.Tasks[1].Status, config.StatusBlocked)
+	}
+	if len(rec.prompts) != 1 {
+		t.Errorf("provider called %d times, want 1", len(rec.prompts))
+	}
+
+	// Once the failed dependency is reset and succeeds, task 2 runs too.
+	reloaded.Tasks[0].Status = config.StatusPending
+	reloaded.Gates = gate.Commands("true")
+	if err := config.SaveConfig(cfgPath, reloaded); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunLoop(context.Background(), cfgPath, "mock", registry, dir, &LogRecorder{}); err != nil {
+		t.Fatalf("RunLoop failed: %v", err)
+	}
+	reloaded, _ = config.LoadConfig(cfgPath)
+	for _, task := range reloaded.Tasks {
+		if task.Status != config.StatusDone {
+			t.Errorf("after reset: task %s status = %q, want done", task.ID, task.Status)
+		}
+	}
+}
+
+// recordingProvider records the prompt and session of every run.
+type recordingProvider struct {
+	name     string
+	inner    provider.Provider
+	prompts  []string
+	sessions []string
+}
+
+func (r *recordingProvider) Name() string {
+	return r.name
+}
+
+func (r *recordingProvider) Run(ctx context.Context, prompt string, workDir string) (string, error) {
+	res, err := r.RunWithUsage(ctx, prompt, workDir, "", nil)
+	return res.Output, err
+}
+
+// RunWithUsage passes the run on to inner, or answers "done" without one.
+func (r *recordingProvider) RunWithUsage(ctx context.Context, prompt string, workDir string, session string, out io.Writer) (provider.Result, error) {
+	r.prompts = append(r.prompts, prompt)
+	r.sessions = append(r.sessions, session)
+	if r.inner == nil {
+		return provider.Result{Output: "done"}, nil
+	}
+	return provider.Invoke(ctx, r.inner, prompt, workDir, session, out)
+}
+
+// fileWritingProvider writes the task title into the file named by the
+// first word of that title, inside whichever directory it is run in.
+type fileWritingProvider struct {
+	name string
+}
+
+func (f *fileWritingProvider) Name() string {
+	return f.name
+}
+
+func (f *fileWritingProvider) Run(ctx context.Context, prompt string, workDir string) (string, error) {
+	_, rest, _ := strings.Cut(prompt, "## Task: ")
+	title, _, _ := strings.Cut(rest, "\n")
+	file, _, _ := strings.Cut(title, " ")
+	return "done", os.WriteFile(filepath.Join(workDir, file), []byte(title+"\n"), 0644)
+}
+
+func initGitRepo(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	ctx := context.Background()
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"config", "user.name", "test"},
+		{"config", "user.email", "test@example.com"},
+		{"commit", "-q", "--allow-empty", "-m", "initial"},
+	} {
+		if _, err := git.Run(ctx, dir, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoopParallelMergesWorktrees(t *testing.T) {
+	dir := initGitRepo(t)
+	cfgPath := filepath.Join(dir, "do-more.json")
+
+	cfg := &config.Config{
+		Name:          "test",
+		Provider:      "writer",
+		Gates:         gate.Commands("test -s a.txt || test -s b.txt || test -s c.txt"),
+		MaxIterations: 1,
+		Tasks: []config.Task{
+			{ID: "1", Title: "a.txt first", Status: config.StatusPending},
+			{ID: "2", Title: "b.txt second", Status: config.StatusPending},
+			{ID: "3", Title: "c.txt third", Status: config.StatusPending, DependsOn: []string{"1"}},
+		},
+	}
+	if err := config.SaveConfig(cfgPath, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	registry := provider.NewProviderRegistry()
+	registry.Register(&fileWritingProvider{name: "writer"})
+
+	var mu sync.Mutex
+	started := map[string]bool{}
+	opts := Options{
+		Parallel: 2,
+		TaskStarted: func(id string, _ context.CancelCauseFunc) {
+			mu.Lock()
+			started[id] = true
+			mu.Unlock()
+		},
+	}
+	err := RunLoopWithOptions(context.Background(), cfgPath, "writer", registry, dir, &LogRecorder{}, opts)
+	if err != nil {
+		t.Fatalf("RunLoopWithOptions failed: %v", err)
+	}
+
+	reloaded, _ := config.LoadConfig(cfgPath)
+	for _, task := range reloaded.Tasks {
+		if task.Status != config.StatusDone {
+			t.Errorf("task %q status = %q, want %q (%s)", task.ID, task.Status, config.StatusDone, task.Learnings)
+		}
+	}
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("expected %s merged into workDir: %v", name, err)
+		}
+	}
+	if len(started) != 3 {
+		t.Errorf("TaskStarted called for %d tasks, want 3", len(started))
+	}
+	if out, _ := git.Run(context.Background(), dir, "branch", "--list", "do-more/*"); out != "" {
+		t.Errorf("expected task branches to be cleaned up, got %q", out)
+	}
+}
+
+func TestLoopParallelMergeConflictFailsTask(t *testing.T) {
+	dir := initGitRepo(t)
+	cfgPath := filepath.Join(dir, "do-more.json")
+
+	cfg := &config.Config{
+		Name:          "test",
+		Provider:      "writer",
+		Gates:         gate.Commands("true"),
+		MaxIterations: 1,
+		Tasks: []config.Task{
+			{ID: "1", Title: "same.txt from one", Status: config.StatusPending},
+			{ID: "2", Title: "same.txt from two", Status: config.StatusPending},
+		},
+	}
+	if err := config.SaveConfig(cfgPath, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	registry := provider.NewProviderRegistry()
+	registry.Register(&fileWritingProvider{name: "writer"})
+
+	err := RunLoopWithOptions(context.Background(), cfgPath, "writer", registry, dir, &LogRecorder{}, Options{Parallel: 2})
+	if err != nil {
+		t.Fatalf("RunLoopWithOptions failed: %v", err)
+	}
+
+	reloaded, _ := config.LoadConfig(cfgPath)
+	done, failed := 0, 0
+	for _, task := range reloaded.Tasks {
+		switch task.Status {
+		case config.StatusDone:
+			done++
+		case config.StatusFailed:
+			failed++
+			if !contains(task.Learnings, "merge conflict in same.txt") {
+				t.Errorf("task %q learnings = %q, want merge conflict note", task.ID, task.Learnings)
+			}
+		}
+	}
+	if done != 1 || failed != 1 {
+		t.Errorf("done=%d failed=%d, want 1 and 1", done, failed)
+	}
+}
+
+func TestLoopParallelRequiresGitRepo(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "do-more.json")
+
+	cfg := &config.Config{
+		Name:          "test",
+		MaxIterations: 1,
+		Tasks:         []config.Task{{ID: "1", Title: "Task", Status: config.StatusPending}},
+	}
+	if err := config.SaveConfig(cfgPath, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	err := RunLoopWithOptions(context.Background(), cfgPath, "mock", provider.NewProviderRegistry(), dir, &LogRecorder{}, Options{Parallel: 2})
+	if err == nil {
+		t.Fatal("expected error outside a git repository")
+	}
+}
+
+func TestLoopCommitsEachTaskOnBranch(t *testing.T) {
+	dir := initGitRepo(t)
+	cfgPath := filepath.Join(dir, "do-more.json")
+
+	cfg := &config.Config{
+		Name:          "test",
+		Provider:      "writer",
+		Branch:        "feat/do-more",
+		Gates:         gate.Commands("true"),
+		MaxIterations: 1,
+		Tasks: []config.Task{
+			{ID: "1", Title: "a.txt first", Description: "Write a", Status: config.StatusPending},
+			{ID: "2", Title: "b.txt second", Status: config.StatusPending},
+		},
+	}
+	if err := config.SaveConfig(cfgPath, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	registry := provider.NewProviderRegistry()
+	registry.Register(&fileWritingProvider{name: "writer"})
+
+	err := RunLoop(context.Background(), cfgPath, "writer", registry, dir, &LogRecorder{})
+	if err != nil {
+		t.Fatalf("RunLoop failed: %v", err)
+	}
+
+	ctx := context.Background()
+	if branch, _ := git.CurrentBranch(ctx, dir); branch != "feat/do-more" {
+		t.Errorf("branch = %q, want feat/do-more", branch)
+	}
+	log, err := git.Run(ctx, dir, "log", "--format=%s", "main..HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "do-more: task #2 b.txt second\ndo-more: task #1 a.txt first"
+	if log != want {
+		t.Errorf("commits =\n%s\nwant\n%s", log, want)
+	}
+	files, _ := git.Run(ctx, dir, "show", "--name-only", "--format=", "HEAD")
+	if files != "b.txt" {
+		t.Errorf("HEAD touched %q, want only b.txt", files)
+	}
+}
+
+func TestLoopRefusesDirtyTree(t *testing.T) {
+	dir := initGitRepo(t)
+	cfgPath := filepath.Join(dir, "do-more.json")
+	if err := os.WriteFile(filepath.Join(dir, "wip.txt"), []byte("wip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		Name:          "test",
+		Provider:      "mock",
+		Branch:        "feat/do-more",
+		Gates:         gate.Commands("true"),
+		MaxIterations: 1,
+		Tasks:         []config.Task{{ID: "1", Title: "Task", Status: config.StatusPending}},
+	}
+	if err := config.SaveConfig(cfgPath, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	registry := provider.NewProviderRegistry()
+	registry.Register(&mockProvider{name: "mock", output: "done"})
+
+	err := RunLoop(context.Background(), cfgPath, "mock", registry, dir, &LogRecorder{})
+	if err == nil || !contains(err.Error(), "wip.txt") {
+		t.Fatalf("expected dirty tree error naming wip.txt, got %v", err)
+	}
+
+	err = RunLoopWithOptions(context.Background(), cfgPath, "mock", registry, dir, &LogRecorder{}, Options{Force: true})
+	if err != nil {
+		t.Fatalf("RunLoopWithOptions with Force failed: %v", err)
+	}
+	reloaded, _ := config.LoadConfig(cfgPath)
+	if reloaded.Tasks[0].Status != config.StatusDone {
+		t.Errorf("task status = %q, want %q", reloaded.Tasks[0].Status, config.StatusDone)
+	}
+}
+
+func TestLoopOnFailurePolicies(t *testing.T) {
+	tests := []struct {
+		policy     string
+		wantFile   bool
+		wantBranch bool
+	}{
+		{policy: config.OnFailureKeep, wantFile: true},
+		{policy: config.OnFailureRevert},
+		{policy: config.OnFailureStashToBranch, wantBranch: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			dir := initGitRepo(t)
+			cfgPath := filepath.Join(dir, "do-more.json")
+
+			cfg := &config.Config{
+				Name:          "test",
+				Provider:      "writer",
+				Gates:         gate.Commands("false"),
+				MaxIterations: 2,
+				OnFailure:     tt.policy,
+				Tasks: []config.Task{
+					{ID: "1", Title: "broken.txt attempt", Status: config.StatusPending},
+				},
+			}
+			if err := config.SaveConfig(cfgPath, cfg); err != nil {
+				t.Fatal(err)
+			}
+
+			registry := provider.NewProviderRegistry()
+			registry.Register(&fileWritingProvider{name: "writer"})
+
+			err := RunLoop(context.Background(), cfgPath, "writer", registry, dir, &LogRecorder{})
+			if err != nil {
+				t.Fatalf("RunLoop failed: %v", err)
+			}
+
+			reloaded, _ := config.LoadConfig(cfgPath)
+			if reloaded.Tasks[0].Status != config.StatusFailed {
+				t.Errorf("task status = %q, want %q", reloaded.Tasks[0].Status, config.StatusFailed)
+			}
+
+			_, statErr := os.Stat(filepath.Join(dir, "broken.txt"))
+			if gotFile := statErr == nil; gotFile != tt.wantFile {
+				t.Errorf("broken.txt present = %v, want %v", gotFile, tt.wantFile)
+			}
+
+			ctx := context.Background()
+			files, err := git.Run(ctx, dir, "show", "--name-only", "--format=", "do-more/failed/1")
+			if gotBranch := err == nil; gotBranch != tt.wantBranch {
+				t.Fatalf("failed branch present = %v, want %v", gotBranch, tt.wantBranch)
+			}
+			if tt.wantBranch {
+				if files != "broken.txt" {
+					t.Errorf("saved attempt touched %q, want broken.txt", files)
+				}
+				if !contains(reloaded.Tasks[0].Learnings, "do-more/failed/1") {
+					t.Errorf("learnings = %q, want branch note", reloaded.Tasks[0].Learnings)
+				}
+			}
+		})
+	}
+}
+
+func TestLoopRecoversStaleTasks(t *testing.T) {
+	tests := []struct {
+		policy     string
+		wantStatus string
+		wantCalls  int
+	}{
+		{policy: "", wantStatus: config.StatusDone, wantCalls: 1},
+		{policy: ResumeContinue, wantStatus: config.StatusDone, wantCalls: 1},
+		{policy: ResumeFail, wantStatus: config.StatusFailed, wantCalls: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run("policy="+tt.policy, func(t *testing.T) {
+			dir := t.TempDir()
+			cfgPath := filepath.Join(dir, "do-more.json")
+
+			cfg := &config.Config{
+				Name:          "test",
+				Provider:      "mock",
+				Gates:         gate.Commands("true"),
+				MaxIterations: 1,
+				Tasks: []config.Task{
+					{ID: "1", Title: "Interrupted", Status: config.StatusInProgress},
+				},
+			}
+			if err := config.SaveConfig(cfgPath, cfg); err != nil {
+				t.Fatal(err)
+			}
+
+			rec := &recordingProvider{name: "mock"}
+			registry := provider.NewProviderRegistry()
+			registry.Register(rec)
+
+			err := RunLoopWithOptions(context.Background(), cfgPath, "mock", registry, dir, &LogRecorder{}, Options{Resume: tt.policy})
+			if err != nil {
+				t.Fatalf("RunLoopWithOptions failed: %v", err)
+			}
+
+			reloaded, _ := config.LoadConfig(cfgPath)
+			if reloaded.Tasks[0].Status != tt.wantStatus {
+				t.Errorf("task status = %q, want %q", reloaded.Tasks[0].Status, tt.wantStatus)
+			}
+			if len(rec.prompts) != tt.wantCalls {
+				t.Errorf("provider called %d times, want %d", len(rec.prompts), tt.wantCalls)
+			}
+			if _, err := os.Stat(RunLockPath(cfgPath)); !os.IsNotExist(err) {
+				t.Errorf("expected run lock to be released, got %v", err)
+			}
+		})
+	}
+}
+
+func TestLoopRunsInRepositoryWithoutCommits(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := git.Run(context.Background(), dir, "init", "-q"); err != nil {
+		t.Fatal(err)
+	}
+	cfgPath := writeFakeConfig(t, dir, &config.Config{
+		Name:          "test",
+		Provider:      "fake",
+		Gates:         gate.Commands("test -f hello.txt"),
+		MaxIterations: 1,
+		Tasks: []config.Task{
+			{ID: "1", Title: "Write hello", Status: config.StatusPending},
+		},
+	}, `{"steps": [{"files": {"hello.txt": "hello\n"}}]}`)
+	if err := RunLoop(context.Background(), cfgPath, "fake", fakeRegistry(), dir, &LogRecorder{}); err != nil {
+		t.Fatalf("RunLoop failed: %v", err)
+	}
+	reloaded, _ := config.LoadConfig(cfgPath)
+	if reloaded.Tasks[0].Status != config.StatusDone {
+		t.Errorf("status = %q, want done", reloaded.Tasks[0].Status)
+	}
+}
+
+func TestLoopSnapshotFailureLeavesTaskPending(t *testing.T) {
+	dir := initGitRepo(t)
+	cfgPath := writeFakeConfig(t, dir, &config.Config{
+		Name:          "test",
+		Provider:      "fake",
+		Gates:         gate.Commands("test -f hello.txt"),
+		MaxIterations: 1,
+		Tasks: []config.Task{
+			{ID: "1", Title: "Write hello", Status: config.StatusPending},
+		},
+	}, `{"steps": [{"files": {"hello.txt": "hello\n"}}]}`)
+	// A file where the snapshots directory should be makes saving fail.
+	if err := os.MkdirAll(config.StateDir(cfgPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(config.StateDir(cfgPath), "snapshots"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunLoop(context.Background(), cfgPath, "fake", fakeRegistry(), dir, &LogRecorder{}); err == nil {
+		t.Fatal("expected an error when the snapshot cannot be saved")
+	}
+	reloaded, _ := config.LoadConfig(cfgPath)
+	if reloaded.Tasks[0].Status != config.StatusPending {
+		t.Errorf("status = %q, want pending", reloaded.Tasks[0].Status)
+	}
+}
+
+func TestLoopResumeResetDiscardsChanges(t *testing.T) {
+	dir := initGitRepo(t)
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("mine"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfgPath := writeFakeConfig(t, dir, &config.Config{
+		Name:          "test",
+		Provider:      "mock",
+		Gates:         gate.Commands("test ! -e half-done.txt"),
+		MaxIterations: 1,
+		Tasks: []config.Task{
+			{ID: "1", Title: "Interrupted", Status: config.StatusInProgress, Session: &config.Session{Provider: "mock", ID: "stale"}},
+		},
+	}, `{"steps": [{"output": "done"}]}`)
+	// The run that died took a snapshot before the task started, then the
+	// provider left a file behind.
+	snap, err := git.TakeSnapshot(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveSnapshot(cfgPath, "1", snap); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "half-done.txt"), []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &recordingProvider{name: "mock", inner: provider.NewFakeProvider()}
+	registry := provider.NewProviderRegistry()
+	registry.Register(p)
+
+	err = RunLoopWithOptions(context.Background(), cfgPath, "mock", registry, dir, &LogRecorder{}, Options{Resume: ResumeReset})
+	if err == nil || !contains(err.Error(), "half-done.txt") || contains(err.Error(), "notes.txt") {
+		t.Fatalf("error = %v, want a refusal naming only half-done.txt", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "half-done.txt")); err != nil {
+		t.Errorf("half-done.txt was discarded without --force: %v", err)
+	}
+
+	err = RunLoopWithOptions(context.Background(), cfgPath, "mock", registry, dir, &LogRecorder{}, Options{Resume: ResumeReset, Force: true})
+	if err != nil {
+		t.Fatalf("RunLoopWithOptions failed: %v", err)
+	}
+	reloaded, _ := config.LoadConfig(cfgPath)
+	if reloaded.Tasks[0].Status != config.StatusDone {
+		t.Errorf("task status = %q, want %q", reloaded.Tasks[0].Status, config.StatusDone)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Errorf("unrelated notes.txt was removed: %v", err)
+	}
+	if len(p.sessions) != 1 || p.sessions[0] != "" {
+		t.Errorf("sessions = %q, want a new session after the reset", p.sessions)
+	}
+	if _, err := os.Stat(snapshotPath(cfgPath, "1")); !os.IsNotExist(err) {
+		t.Errorf("expected the snapshot to be removed, got %v", err)
+	}
+}
+
+func TestLoopRefusesWhenLockHeld(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "do-more.json")
+	cfg := &config.Config{
+		Name:          "test",
+		MaxIterations: 1,
+		Tasks:         []config.Task{{ID: "1", Title: "Task", Status: config.StatusPending}},
+	}
+	if err := config.SaveConfig(cfgPath, cfg); err != nil {
+		t.Fatal(err)
+	}
+	writeRunLock(t, cfgPath, os.Getpid())
+	held, err := os.Open(RunLockPath(cfgPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	if locked, err := lockFile(held); !locked || err != nil {
+		t.Fatalf("lockFile = %v, %v", locked, err)
+	}
+
+	err = RunLoop(context.Background(), cfgPath, "mock", provider.NewProviderRegistry(), dir, &LogRecorder{})
+	if err == nil || !contains(err.Error(), "another do-more run") {
+		t.Fatalf("expected lock error, got %v", err)
+	}
+	if !RunLockHeld(cfgPath) {
+		t.Error("lock of a running loop should be left in place")
+	}
+}
+
+func TestLoopReplacesStaleLock(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "do-more.json")
+	cfg := &config.Config{
+		Name:          "test",
+		Provider:      "mock",
+		Gates:         gate.Commands("true"),
+		MaxIterations: 1,
+		Tasks:         []config.Task{{ID: "1", Title: "Task", Status: config.StatusPending}},
+	}
+	if err := config.SaveConfig(cfgPath, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// The lock names a live process, as after a reboot that reused the PID,
+	// but nothing holds it.
+	writeRunLock(t, cfgPath, os.Getpid())
+	if RunLockHeld(cfgPath) {
+		t.Error("a lock file nobody holds should not count as held")
+	}
+
+	registry := provider.NewProviderRegistry()
+	registry.Register(&mockProvider{name: "mock", output: "done"})
+
+	if err := RunLoop(context.Background(), cfgPath, "mock", registry, dir, &LogRecorder{}); err != nil {
+		t.Fatalf("RunLoop failed: %v", err)
+	}
+	reloaded, _ := config.LoadConfig(cfgPath)
+	if reloaded.Tasks[0].Status != config.StatusDone {
+		t.Errorf("task status = %q, want %q", reloaded.Tasks[0].Status, config.StatusDone)
+	}
+}
+
+func writeRunLock(t *testing.T, cfgPath string, pid int) {
+	t.Helper()
+	path := RunLockPath(cfgPath)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(map[string]any{"pid": pid})
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoopRecordsAttemptHistory(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "do-more.json")
+
+	cfg := &config.Config{
+		Name:          "test",
+		Provider:      "mock",
+		Gates:         gate.Commands("echo broken; false"),
+		MaxIterations: 2,
+		Tasks: []config.Task{
+			{ID: "1", Title: "Task one", Status: config.StatusPending},
+		},
+	}
+	if err := config.SaveConfig(cfgPath, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	registry := provider.NewProviderRegistry()
+	registry.Register(&mockProvider{name: "mock", output: "did things"})
+
+	if err := RunLoop(context.Background(), cfgPath, "mock", registry, dir, &LogRecorder{}); err != nil {
+		t.Fatalf("RunLoop failed: %v", err)
+	}
+
+	attempts, err := history.Load(cfgPath, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 2 {
+		t.Fatalf("len(attempts) = %d, want 2", len(attempts))
+	}
+	for i, a := range attempts {
+		if a.Iteration != i+1 {
+			t.Errorf("attempts[%d].Iteration = %d, want %d", i, a.Iteration, i+1)
+		}
+		if a.Provider != "mock" || a.Output != "did things" {
+			t.Errorf("attempts[%d] provider/output = %q/%q", i, a.Provider, a.Output)
+		}
+		if a.Passed || len(a.Gates) != 1 || a.Gates[0].Output != "broken\n" {
+			t.Errorf("attempts[%d] gates = %+v", i, a.Gates)
+		}
+		if !contains(a.FailureSummary, "FAIL: echo broken; false") {
+			t.Errorf("attempts[%d].FailureSummary = %q", i, a.FailureSummary)
+		}
+		if a.EndedAt.Before(a.StartedAt) {
+			t.Errorf("attempts[%d] ended before it started", i)
+		}
+	}
+}
+
+func TestLoopUsesTaskGates(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "do-more.json")
+
+	cfg := &config.Config{
+		Name:          "test",
+		Provider:      "mock",
+		Gates:         gate.Commands("false"),
+		MaxIterations: 1,
+		Tasks: []config.Task{
+			{ID: "1", Title: "Docs only", Status: config.StatusPending, Gates: gate.Commands("echo docs-gate"), GatesMode: config.GatesReplace},
+			{ID: "2", Title: "Extends", Status: config.StatusPending, Gates: gate.Commands("true")},
+		},
+	}
+	if err := config.SaveConfig(cfgPath, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &recordingProvider{name: "mock"}
+	registry := provider.NewProviderRegistry()
+	registry.Register(rec)
+
+	if err := RunLoop(context.Background(), cfgPath, "mock", registry, dir, &LogRecorder{}); err != nil {
+		t.Fatalf("RunLoop failed: %v", err)
+	}
+
+	reloaded, _ := config.LoadConfig(cfgPath)
+	if reloaded.Tasks[0].Status != config.StatusDone {
+		t.Errorf("task 1 status = %q, want %q", reloaded.Tasks[0].Status, config.StatusDone)
+	}
+	if reloaded.Tasks[1].Status != config.StatusFailed {
+		t.Errorf("task 2 status = %q, want %q", reloaded.Tasks[1].Status, config.StatusFailed)
+	}
+	if !contains(rec.prompts[0], "echo docs-gate") || contains(rec.prompts[0], "- false") {
+		t.Errorf("prompt for task 1 should list only its own gates:\n%s", rec.prompts[0])
+	}
+}
+
+func TestLoopGateTimeout(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "do-more.json")
+
+	cfg := &config.Config{
+		Name:          "test",
+		Provider:      "mock",
+		Gates:         gate.Commands("echo watching; sleep 30"),
+		GateTimeout:   "200ms",
+		MaxIterations: 2,
+		Tasks: []config.Task{
+			{ID: "1", Title: "Task one", Status: config.StatusPending},
+		},
+	}
+	if err := config.SaveConfig(cfgPath, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &recordingProvider{name: "mock"}
+	registry := provider.NewProviderRegistry()
+	registry.Register(rec)
+
+	logger := &LogRecorder{}
+	if err := RunLoop(context.Background(), cfgPath, "mock", registry, dir, logger); err != nil {
+		t.Fatalf("RunLoop failed: %v", err)
+	}
+
+	reloaded, _ := config.LoadConfig(cfgPath)
+	if reloaded.Tasks[0].Status != config.StatusFailed {
+		t.Errorf("status = %q, want %q", reloaded.Tasks[0].Status, config.StatusFailed)
+	}
+	if len(rec.prompts) != 2 || !contains(rec.prompts[1], "TIMEOUT: echo watching; sleep 30") {
+		t.Errorf("second prompt should report the timed-out gate:\n%v", rec.prompts)
+	}
+	if !contains(strings.Join(logger.Messages, "\n"), "Gate timed out") {
+		t.Errorf("expected a gate timeout log line, got %v", logger.Messages)
+	}
+}
+
+func TestLoopBaselineIgnoresPreExistingFailures(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "do-more.json")
+
+	cfg := &config.Config{
+		Name:          "test",
+		Provider:      "mock",
+		Gates:         gate.Commands("echo legacy breakage; false"),
+		MaxIterations: 2,
+		Baseline:      config.BaselineTask,
+		Tasks: []config.Task{
+			{ID: "1", Title: "Task one", Status: config.StatusPending},
+		},
+	}
+	if err := config.SaveConfig(cfgPath, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &recordingProvider{name: "mock"}
+	registry := provider.NewProviderRegistry()
+	registry.Register(rec)
+
+	if err := RunLoop(context.Background(), cfgPath, "mock", registry, dir, &LogRecorder{}); err != nil {
+		t.Fatalf("RunLoop failed: %v", err)
+	}
+
+	reloaded, _ := config.LoadConfig(cfgPath)
+	if reloaded.Tasks[0].Status != config.StatusDone {
+		t.Errorf("status = %q, want %q", reloaded.Tasks[0].Status, config.StatusDone)
+	}
+	if len(rec.prompts) != 1 || !contains(rec.prompts[0], "Pre-existing Failures") || !contains(rec.prompts[0], "legacy breakage") {
+		t.Errorf("prompt should list the pre-existing failure:\n%v", rec.prompts)
+	}
+}
+
+func TestLoopBaselineCatchesNewFailures(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "do-more.json")
+
+	// The gate passes before the task and fails once the provider has
+	// written its file.
+	cfg := &config.Config{
+		Name:          "test",
+		Provider:      "mock",
+		Gates:         gate.Commands("test ! -e Alpha"),
+		MaxIterations: 1,
+		Baseline:      config.BaselineRun,
+		Tasks: []config.Task{
+			{ID: "1", Title: "Alpha task", Status: config.StatusPending},
+		},
+	}
+	if err := config.SaveConfig(cfgPath, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	registry := provider.NewProviderRegistry()
+	registry.Register(&fileWritingProvider{name: "mock"})
+
+	if err := RunLoop(context.Background(), cfgPath, "mock", registry, dir, &LogRecorder{}); err != nil {
+		t.Fatalf("RunLoop failed: %v", err)
+	}
+
+	reloaded, _ := config.LoadConfig(cfgPath)
+	if reloaded.Tasks[0].Status != config.StatusFailed {
+		t.Errorf("status = %q, want %q", reloaded.Tasks[0].Status, config.StatusFailed)
+	}
+}
+
+// appendingProvider adds a line to progress.txt on every call, so each
+// iteration changes the working tree.
+type appendingProvider struct {
+	name  string
+	calls int
+}
+
+func (a *appendingProvider) Name() string {
+	return a.name
+}
+
+func (a *appendingProvider) Run(ctx context.Context, prompt string, workDir string) (string, error) {
+	a.calls++
+	f, err := os.OpenFile(filepath.Join(workDir, "progress.txt"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	_, err = f.WriteString("step\n")
+	return "done", err
+}
+
+func TestLoopStopsWhenStagnating(t *testing.T) {
+	for _, useGit := range []bool{false, true} {
+		dir := t.TempDir()
+		if useGit {
+			dir = initGitRepo(t)
+		}
+		cfgPath := filepath.Join(dir, "do-more.json")
+
+		cfg := &config.Config{
+			Name:          "test",
+			Provider:      "mock",
+			Gates:         gate.Commands("echo 'took 0.42s'; false"),
+			MaxIterations: 10,
+			Tasks: []config.Task{
+				{ID: "1", Title: "Task one", Status: config.StatusPending},
+			},
+		}
+		if err := config.SaveConfig(cfgPath, cfg); err != nil {
+			t.Fatal(err)
+		}
+
+		rec := &recordingProvider{name: "mock"}
+		registry := provider.NewProviderRegistry()
+		registry.Register(rec)
+
+		if err := RunLoop(context.Background(), cfgPath, "mock", registry, dir, &LogRecorder{}); err != nil {
+			t.Fatalf("RunLoop failed: %v", err)
+		}
+
+		if len(rec.prompts) != config.DefaultStagnationLimit {
+			t.Errorf("git=%v: provider called %d times, want %d", useGit, len(rec.prompts), config.DefaultStagnationLimit)
+		}
+		reloaded, _ := config.LoadConfig(cfgPath)
+		task := reloaded.Tasks[0]
+		if task.Status != config.StatusFailed || !contains(task.Learnings, "made no progress") {
+			t.Errorf("git=%v: task = %+v, want failed with a stagnation note", useGit, task)
+		}
+	}
+}
+
+func TestLoopStopsWhenStagnatingWithRelativeConfig(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	cfgPath := "do-more.json"
+
+	cfg := &config.Config{
+		Name:          "test",
+		Provider:      "mock",
+		Gates:         gate.Commands("false"),
+		MaxIterations: 10,
+		Tasks: []config.Task{
+			{ID: "1", Title: "Task one", Status: config.StatusPending},
+		},
+	}
+	if err := config.SaveConfig(cfgPath, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &recordingProvider{name: "mock"}
+	registry := provider.NewProviderRegistry()
+	registry.Register(rec)
+
+	if err := RunLoop(context.Background(), cfgPath, "mock", registry, dir, &LogRecorder{}); err != nil {
+		t.Fatalf("RunLoop failed: %v", err)
+	}
+	if len(rec.prompts) != config.DefaultStagnationLimit {
+		t.Errorf("provider called %d times, want %d", len(rec.prompts), config.DefaultStagnationLimit)
+	}
+}
+
+func TestLoopKeepsGoingWhileMakingProgress(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "do-more.json")
+
+	cfg := &config.Config{
+		Name:          "test",
+		Provider:      "mock",
+		Gates:         gate.Commands("false"),
+		MaxIterations: 5,
+		Tasks: []config.Task{
+			{ID: "1", Title: "Task one", Status: config.StatusPending},
+		},
+	}
+	if err := config.SaveConfig(cfgPath, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &appendingProvider{name: "mock"}
+	registry := provider.NewProviderRegistry()
+	registry.Register(p)
+
+	if err := RunLoop(context.Background(), cfgPath, "mock", registry, dir, &LogRecorder{}); err != nil {
+		t.Fatalf("RunLoop failed: %v", err)
+	}
+	if p.calls != 5 {
+		t.Errorf("provider called %d times, want all 5 iterations", p.calls)
+	}
+}
+
+func TestLoopFallsBackToNextProvider(t *testing.T) {
+	tests := []struct {
+		name     string
+		first    provider.Provider
+		switches *config.ProviderSwitch
+		learning string
+	}{
+		{
+			name:     "provider error",
+			first:    &mockProvider{name: "first", err: fmt.Errorf("rate limited")},
+			learning: "Succeeded with provider second after trying first.",
+		},
+		{
+			name:     "gate failures",
+			first:    &appendingProvider{name: "first"},
+			switches: &config.ProviderSwitch{AfterFailures: 2},
+			learning: "Succeeded with provider second after trying first.",
+		},
+		{
+			name:     "stagnation",
+			first:    &recordingProvider{name: "first"},
+			learning: "Succeeded with provider second after trying first.",
+		},
+		{
+			name:     "unknown provider",
+			learning: "Unknown provider: \"first\"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cfgPath := filepath.Join(dir, "do-more.json")
+
+			cfg := &config.Config{
+				Name:           "test",
+				Provider:       "mock",
+				Gates:          gate.Commands("test -f Fixed"),
+				MaxIterations:  10,
+				ProviderSwitch: tt.switches,
+				Tasks: []config.Task{
+					{ID: "1", Title: "Fixed by the fallback", Provider: config.ProviderList{"first", "second"}, Status: config.StatusPending},
+				},
+			}
+			if err := config.SaveConfig(cfgPath, cfg); err != nil {
+				t.Fatal(err)
+			}
+
+			registry := provider.NewProviderRegistry()
+			if tt.first != nil {
+				registry.Register(tt.first)
+			}
+			registry.Register(&fileWritingProvider{name: "second"})
+
+			logger := &LogRecorder{}
+			if err := RunLoop(context.Background(), cfgPath, "mock", registry, dir, logger); err != nil {
+				t.Fatalf("RunLoop failed: %v", err)
+			}
+
+			reloaded, _ := config.LoadConfig(cfgPath)
+			task := reloaded.Tasks[0]
+			if task.Status != config.StatusDone {
+				t.Fatalf("status = %q, want done; learnings: %s", task.Status, task.Learnings)
+			}
+			if !contains(task.Learnings, tt.learning) {
+				t.Errorf("learnings = %q, want %q", task.Learnings, tt.learning)
+			}
+			if tt.first != nil && !slices.Contains(logger.Messages, "Task #%s: switching provider from %s to %s (%s)") {
+				t.Errorf("no provider switch logged: %v", logger.Messages)
+			}
+		})
+	}
+}
+
+func TestLoopDoesNotSwitchWhenDisabled(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "do-more.json")
+
+	off := false
+	cfg := &config.Config{
+		Name:           "test",
+		Provider:       "mock",
+		Gates:          gate.Commands("test -f Fixed"),
+		MaxIterations:  10,
+		ProviderSwitch: &config.ProviderSwitch{OnStagnation: &off},
+		Tasks: []config.Task{
+			{ID: "1", Title: "Fixed by the fallback", Provider: config.ProviderList{"first", "second"}, Status: config.StatusPending},
+		},
+	}
+	if err := config.SaveConfig(cfgPath, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	registry := provider.NewProviderRegistry()
+	registry.Register(&recordingProvider{name: "first"})
+	registry.Register(&fileWritingProvider{name: "second"})
+
+	if err := RunLoop(context.Background(), cfgPath, "mock", registry, dir, &LogRecorder{}); err != nil {
+		t.Fatalf("RunLoop failed: %v", err)
+	}
+	reloaded, _ := config.LoadConfig(cfgPath)
+	if task := reloaded.Tasks[0]; task.Status != config.StatusFailed || !contains(task.Learnings, "made no progress") {
+		t.Errorf("task = %+v, want failed by stagnation without switching", task)
+	}
+}
+
+// configurableProvider records the options it was configured with.
+type configurableProvider struct {
+	mockProvider
+	opts *provider.RunOptions
+}
+
+func (c *configurableProvider) WithOptions(opts provider.RunOptions) (provider.Provider, error) {
+	*c.opts = opts
+	return c, nil
+}
+
+func (c *configurableProvider) Models() []string {
+	return nil
+}
+
+func TestLoopPassesModelAndExtraArgs(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "do-more.json")
+
+	cfg := &config.Config{
+		Name:          "test",
+		Provider:      "mock",
+		Model:         "sonnet",
+		ExtraArgs:     []string{"--verbose"},
+		Gates:         gate.Commands("true"),
+		MaxIterations: 1,
+		Tasks: []config.Task{
+			{ID: "1", Title: "Task one", Status: config.StatusPending, Model: "opus", ExtraArgs: []string{"--fast"}},
+		},
+	}
+	if err := config.SaveConfig(cfgPath, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	var opts provider.RunOptions
+	registry := provider.NewProviderRegistry()
+	registry.Register(&configurableProvider{mockProvider: mockProvider{name: "mock", output: "done"}, opts: &opts})
+
+	if err := RunLoop(context.Background(), cfgPath, "mock", registry, dir, &LogRecorder{}); err != nil {
+		t.Fatalf("RunLoop failed: %v", err)
+	}
+	if opts.Model != "opus" || !slices.Equal(opts.ExtraArgs, []string{"--verbose", "--fast"}) {
+		t.Errorf("provider configured with %+v, want model opus and both extra args", opts)
+	}
+}
+
+func TestLoopContinuesProviderSession(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := writeFakeConfig(t, dir, &config.Config{
+		Name:          "test",
+		Provider:      "mock",
+		Gates:         gate.Commands("test -f fixed"),
+		MaxIterations: 3,
+		Tasks: []config.Task{
+			{ID: "1", Title: "Task one", Status: config.StatusPending},
+		},
+	}, `{"steps": [{"session": "session-1"}, {"files": {"fixed": ""}, "session": "session-1"}]}`)
+
+	p := &recordingProvider{name: "mock", inner: provider.NewFakeProvider()}
+	registry := provider.NewProviderRegistry()
+	registry.Register(p)
+	if err := RunLoop(context.Background(), cfgPath, "mock", registry, dir, &LogRecorder{}); err != nil {
+		t.Fatalf("RunLoop failed: %v", err)
+	}
+
+	if len(p.prompts) != 2 {
+		t.Fatalf("provider called %d times, want 2", len(p.prompts))
+	}
+	if p.sessions[0] != "" || p.sessions[1] != "session-1" {
+		t.Errorf("sessions = %q, want a new session then session-1", p.sessions)
+	}
+	if strings.Contains(p.prompts[1], "## Task:") || !strings.Contains(p.prompts[1], "FAIL: test -f fixed") {
+		t.Errorf("second prompt should carry only the new failures:\n%s", p.prompts[1])
+	}
+	reloaded, _ := config.LoadConfig(cfgPath)
+	if s := reloaded.Tasks[0].Session; s == nil || *s != (config.Session{Provider: "mock", ID: "session-1"}) {
+		t.Errorf("task session = %+v, want mock/session-1", s)
+	}
+
+	attempts, err := history.Load(cfgPath, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 2 || attempts[1].Session != "session-1" {
+		t.Errorf("attempts = %+v, want the session recorded", attempts)
+	}
+}
+
+func TestLoopFreshSession(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := writeFakeConfig(t, dir, &config.Config{
+		Name:          "test",
+		Provider:      "mock",
+		Gates:         gate.Commands("test -f fixed"),
+		MaxIterations: 3,
+		Tasks: []config.Task{
+			{ID: "1", Title: "Task one", Status: config.StatusPending, FreshSession: true},
+		},
+	}, `{"steps": [{"session": "session-1"}, {"files": {"fixed": ""}, "session": "session-1"}]}`)
+
+	p := &recordingProvider{name: "mock", inner: provider.NewFakeProvider()}
+	registry := provider.NewProviderRegistry()
+	registry.Register(p)
+	if err := RunLoop(context.Background(), cfgPath, "mock", registry, dir, &LogRecorder{}); err != nil {
+		t.Fatalf("RunLoop failed: %v", err)
+	}
+
+	if len(p.prompts) != 2 {
+		t.Fatalf("provider called %d times, want 2", len(p.prompts))
+	}
+	if p.sessions[1] != "" {
+		t.Errorf("second call continued session %q, want a fresh one", p.sessions[1])
+	}
+	if !strings.Contains(p.prompts[1], "## Task: Task one") {
+		t.Errorf("second prompt should be the full prompt:\n%s", p.prompts[1])
+	}
+	reloaded, _ := config.LoadConfig(cfgPath)
+	if reloaded.Tasks[0].Session != nil {
+		t.Errorf("task session = %+v, want none", reloaded.Tasks[0].Session)
+	}
+}
+
+// usageRecorder records the usage reported after each provider run.
+type usageRecorder struct {
+	LogRecorder
+	used     []provider.Usage
+	runTotal provider.Usage
+}
+
+func (u *usageRecorder) Usage(taskID string, used, runTotal provider.Usage) {
+	u.used = append(u.used, used)
+	u.runTotal = runTotal
+}
+
+func TestLoopTotalsUsage(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := writeFakeConfig(t, dir, &config.Config{
+		Name:          "test",
+		Provider:      "fake",
+		Gates:         gate.Commands("true"),
+		MaxIterations: 3,
+		Tasks: []config.Task{
+			{ID: "1", Title: "Task one", Status: config.StatusPending},
+			{ID: "2", Title: "Task two", Status: config.StatusPending, Usage: provider.Usage{InputTokens: 1000, DurationMs: 1}},
+		},
+	}, `{"steps": [{"usage": {"inputTokens": 100, "outputTokens": 20, "costUsd": 0.5, "durationMs": 2000}}]}`)
+
+	logger := &usageRecorder{}
+	if err := RunLoop(context.Background(), cfgPath, "fake", fakeRegistry(), dir, logger); err != nil {
+		t.Fatalf("RunLoop failed: %v", err)
+	}
+
+	used := provider.Usage{InputTokens: 100, OutputTokens: 20, CostUSD: 0.5, DurationMs: 2000}
+	runTotal := provider.Usage{InputTokens: 200, OutputTokens: 40, CostUSD: 1, DurationMs: 4000}
+	if len(logger.used) != 2 || logger.used[0] != used || logger.runTotal != runTotal {
+		t.Errorf("reported %v with run total %+v, want %+v twice", logger.used, logger.runTotal, used)
+	}
+
+	reloaded, err := config.LoadConfig(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.Tasks[0].Usage; got != used {
+		t.Errorf("task 1 usage = %+v, want %+v", got, used)
+	}
+	if got := reloaded.Tasks[1].Usage; got.InputTokens != 1100 || got.DurationMs != 2001 {
+		t.Errorf("task 2 usage = %+v, want it added to the earlier total", got)
+	}
+
+	attempts, err := history.Load(cfgPath, "1")
+	if err != nil || len(attempts) != 1 || attempts[0].Usage != used {
+		t.Errorf("attempts = %+v, %v; want the usage recorded", attempts, err)
+	}
+	runs, err := history.LoadRuns(cfgPath)
+	if err != nil || len(runs) != 1 || runs[0].Usage != runTotal || len(runs[0].Tasks) != 2 {
+		t.Errorf("runs = %+v, %v; want one run with both tasks", runs, err)
+	}
+}
+
+func TestLoopMeasuresProviderTime(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := writeFakeConfig(t, dir, &config.Config{
+		Name:          "test",
+		Provider:      "fake",
+		Gates:         gate.Commands("true"),
+		MaxIterations: 1,
+		Tasks:         []config.Task{{ID: "1", Title: "Task one", Status: config.StatusPending}},
+	}, `{"steps": [{"sleep": "20ms"}]}`)
+
+	logger := &usageRecorder{}
+	if err := RunLoop(context.Background(), cfgPath, "fake", fakeRegistry(), dir, logger); err != nil {
+		t.Fatalf("RunLoop failed: %v", err)
+	}
+	if len(logger.used) != 1 || logger.used[0].DurationMs < 10 || logger.used[0].Reported() {
+		t.Errorf("reported %+v, want only the measured time", logger.used)
+	}
+}
+
+func TestLoopStopsAtCostBudget(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := writeFakeConfig(t, dir, &config.Config{
+		Name:          "test",
+		Provider:      "fake",
+		Gates:         gate.Commands("false"),
+		MaxIterations: 3,
+		Budget:        &config.Budget{MaxCostUSD: 0.5},
+		Tasks: []config.Task{
+			{ID: "1", Title: "Task one", Status: config.StatusPending},
+			{ID: "2", Title: "Task two", Status: config.StatusPending},
+		},
+	}, `{"steps": [{"usage": {"costUsd": 0.5}}]}`)
+	logger := &LogRecorder{}
+	if err := RunLoop(context.Background(), cfgPath, "fake", fakeRegistry(), dir, logger); err != nil {
+		t.Fatalf("RunLoop failed: %v", err)
+	}
+	cfg, err := config.LoadConfig(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, task := range cfg.Tasks {
+		if task.Status != config.StatusPending {
+			t.Errorf("task %s status = %s, want pending", task.ID, task.Status)
+		}
+	}
+	if got := cfg.Tasks[0].Usage.CostUSD; got != 0.5 {
+		t.Errorf("task 1 cost = %v, want one iteration's 0.5", got)
+	}
+	if !slices.Contains(logger.Messages, "Stopped early, budget reached (%s): %d tasks left pending") {
+		t.Errorf("summary does not mention the budget: %v", logger.Messages)
+	}
+}
+
+func TestLoopFinishesIterationAtTokenBudget(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := writeFakeConfig(t, dir, &config.Config{
+		Name:          "test",
+		Provider:      "fake",
+		Gates:         gate.Commands("true"),
+		MaxIterations: 3,
+		Budget:        &config.Budget{MaxTokens: 1000},
+		Tasks: []config.Task{
+			{ID: "1", Title: "Task one", Status: config.StatusPending},
+			{ID: "2", Title: "Task two", Status: config.StatusPending},
+		},
+	}, `{"steps": [{"usage": {"inputTokens": 600, "outputTokens": 400}}]}`)
+	logger := &LogRecorder{}
+	if err := RunLoop(context.Background(), cfgPath, "fake", fakeRegistry(), dir, logger); err != nil {
+		t.Fatalf("RunLoop failed: %v", err)
+	}
+	cfg, err := config.LoadConfig(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Tasks[0].Status != config.StatusDone {
+		t.Errorf("task 1 status = %s, want done: the iteration that reached the cap still runs its gates", cfg.Tasks[0].Status)
+	}
+	if cfg.Tasks[1].Status != config.StatusPending {
+		t.Errorf("task 2 status = %s, want pending", cfg.Tasks[1].Status)
+	}
+}
+
+func TestLoopFailsTaskOverTimeBudget(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := writeFakeConfig(t, dir, &config.Config{
+		Name:          "test",
+		Provider:      "fake",
+		Gates:         gate.Commands("true"),
+		MaxIterations: 3,
+		Budget:        &config.Budget{MaxTaskDuration: "50ms"},
+		Tasks: []config.Task{
+			{ID: "1", Title: "Task one", Status: config.StatusPending},
+			{ID: "2", Title: "Task two", Status: config.StatusPending},
+		},
+	}, `{"steps": [{"sleep": "5s"}]}`)
+	logger := &LogRecorder{}
+	if err := RunLoop(context.Background(), cfgPath, "fake", fakeRegistry(), dir, logger); err != nil {
+		t.Fatalf("RunLoop failed: %v", err)
+	}
+	cfg, err := config.LoadConfig(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, task := range cfg.Tasks {
+		if task.Status != config.StatusFailed || !strings.Contains(task.Learnings, "budget reached: task took 50ms") {
+			t.Errorf("task %s = %s with learnings %q, want failed over its time budget", task.ID, task.Status, task.Learnings)
+		}
+	}
+}
+
+func TestLoopStopsAtRunTimeBudget(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := writeFakeConfig(t, dir, &config.Config{
+		Name:          "test",
+		Provider:      "fake",
+		Gates:         gate.Commands("true"),
+		MaxIterations: 3,
+		Budget:        &config.Budget{MaxRunDuration: "50ms"},
+		Tasks: []config.Task{
+			{ID: "1", Title: "Task one", Status: config.StatusPending},
+			{ID: "2", Title: "Task two", Status: config.StatusPending},
+		},
+	}, `{"steps": [{"sleep": "5s"}]}`)
+	logger := &LogRecorder{}
+	if err := RunLoop(context.Background(), cfgPath, "fake", fakeRegistry(), dir, logger); err != nil {
+		t.Fatalf("RunLoop failed: %v", err)
+	}
+	cfg, err := config.LoadConfig(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, task := range cfg.Tasks {
+		if task.Status != config.StatusPending {
+			t.Errorf("task %s status = %s, want pending", task.ID, task.Status)
+		}
+	}
+	if !slices.Contains(logger.Messages, "Stopped early, budget reached (%s): %d tasks left pending") {
+		t.Errorf("summary does not mention the budget: %v", logger.Messages)
+	}
+}
+
+// outputRecorder records log formats and streamed provider output.
+type outputRecorder struct {
+	LogRecorder
+	lines []string
+}
+
+func (o *outputRecorder) ProviderOutput(taskID string, line string) {
+	o.lines = append(o.lines, taskID+": "+line)
+}
+
+func TestLoopStreamsProviderOutput(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := writeFakeConfig(t, dir, &config.Config{
+		Name:          "test",
+		Provider:      "fake",
+		Gates:         gate.Commands("true"),
+		MaxIterations: 1,
+		Tasks: []config.Task{
+			{ID: "1", Title: "Task one", Status: config.StatusPending},
+		},
+	}, `{"steps": [{"output": "Reading files\r\nEdited main.go\ndone"}]}`)
+
+	logger := &outputRecorder{}
+	if err := RunLoop(context.Background(), cfgPath, "fake", fakeRegistry(), dir, logger); err != nil {
+		t.Fatalf("RunLoop failed: %v", err)
+	}
+
+	want := []string{"1: Reading files", "1: Edited main.go", "1: done"}
+	if !slices.Equal(logger.lines, want) {
+		t.Errorf("streamed lines = %q, want %q", logger.lines, want)
+	}
+}
+
+func TestLineWriterSplitsLongLines(t *testing.T) {
+	var lines []string
+	w := &lineWriter{emit: func(line string) { lines = append(lines, line) }}
+	w.Write([]byte(strings.Repeat("é", maxStreamLine)))
+	w.Flush()
+
+	total := 0
+	for _, l := range lines {
+		if len(l) > maxStreamLine || !strings.HasPrefix(l, "é") {
+			t.Errorf("line of %d bytes split inside a character or too long", len(l))
+		}
+		total += len(l)
+	}
+	if total != 2*maxStreamLine {
+		t.Errorf("emitted %d bytes, want %d", total, 2*maxStreamLine)
+	}
+}
+
 func contains(s, substr string) bool {
 	for i := 0; i < len(s)-len(substr)+1; i++ {
 		if s[i:i+len(substr)] == substr {
@@ -0,0 +1,52 @@
+package loop
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/tmdgusya/do-more/internal/config"
+	"github.com/tmdgusya/do-more/internal/git"
+)
+
+// snapshotPath returns where the tree state from before a task started is
+// kept while the task runs, so that --resume reset can return to it after
+// a crash.
+func snapshotPath(cfgPath, taskID string) string {
+	return filepath.Join(config.StateDir(cfgPath), "snapshots", taskID+".json")
+}
+
+func saveSnapshot(cfgPath, taskID string, snap *git.Snapshot) error {
+	path := snapshotPath(cfgPath, taskID)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("creating state directory: %w", err)
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// loadSnapshot returns the saved snapshot of a task, or nil if there is
+// none.
+func loadSnapshot(cfgPath, taskID string) (*git.Snapshot, error) {
+	data, err := os.ReadFile(snapshotPath(cfgPath, taskID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snap git.Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("parsing snapshot of task %s: %w", taskID, err)
+	}
+	return &snap, nil
+}
+
+func removeSnapshot(cfgPath, taskID string) {
+	os.Remove(snapshotPath(cfgPath, taskID))
+}
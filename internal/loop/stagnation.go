@@ -0,0 +1,83 @@
+package loop
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+
+	"github.com/tmdgusya/do-more/internal/config"
+	"github.com/tmdgusya/do-more/internal/git"
+)
+
+// stallDetector counts consecutive iterations that ended in the same state:
+// the same working tree and the same failures.
+type stallDetector struct {
+	limit   int
+	last    string
+	repeats int
+}
+
+// observe records an iteration's fingerprint and reports whether the last
+// limit iterations all ended the same way. An empty fingerprint never
+// matches.
+func (d *stallDetector) observe(fingerprint string) bool {
+	if fingerprint != "" && fingerprint == d.last {
+		d.repeats++
+	} else {
+		d.last, d.repeats = fingerprint, 1
+	}
+	return d.repeats >= d.limit
+}
+
+// treeState fingerprints the files in dir so that iterations which changed
+// nothing can be recognised. It returns "" when dir cannot be read.
+func (r *runner) treeState(ctx context.Context, dir string) string {
+	if r.isRepo {
+		hash, err := git.TreeHash(ctx, dir, r.excludes()...)
+		if err != nil {
+			return ""
+		}
+		return hash
+	}
+
+	// Outside git, compare file sizes and modification times. The walk
+	// yields absolute paths, so the skipped ones must be absolute too.
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	skip := make(map[string]bool)
+	for _, path := range []string{r.cfgPath, config.StateDir(r.cfgPath)} {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return ""
+		}
+		skip[filepath.Clean(abs)] = true
+	}
+	h := sha256.New()
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if skip[path] || (d.IsDir() && d.Name() == ".git") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		fmt.Fprintf(h, "%s\x00%d\x00%d\x00", rel, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,73 @@
+package loop
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/tmdgusya/do-more/internal/provider"
+)
+
+// maxStreamLine is the longest line held back waiting for a newline; longer
+// output is passed on in pieces of this size.
+const maxStreamLine = 4096
+
+// runProvider runs p on prompt in dir, streaming its output to the logger
+// line by line when both support it. See provider.Invoke for how sessions
+// and usage are handled.
+func (r *runner) runProvider(ctx context.Context, p provider.Provider, taskID, prompt, dir, session string) (provider.Result, error) {
+	var out io.Writer
+	if streams(p) && r.logger.streams() {
+		w := &lineWriter{emit: func(line string) { r.logger.ProviderOutput(taskID, line) }}
+		defer w.Flush()
+		out = w
+	}
+
+	return provider.Invoke(ctx, p, prompt, dir, session, out)
+}
+
+// streams reports whether p can pass on its output while it runs.
+func streams(p provider.Provider) bool {
+	_, ok := p.(provider.UsageProvider)
+	return ok
+}
+
+// lineWriter splits what is written to it into lines and passes each to
+// emit, without the line ending.
+type lineWriter struct {
+	emit func(line string)
+	buf  []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		if i := bytes.IndexByte(w.buf, '\n'); i >= 0 {
+			w.emit(strings.TrimSuffix(string(w.buf[:i]), "\r"))
+			w.buf = w.buf[i+1:]
+			continue
+		}
+		if len(w.buf) <= maxStreamLine {
+			return len(p), nil
+		}
+		n := maxStreamLine
+		for n > 0 && !utf8.RuneStart(w.buf[n]) {
+			n--
+		}
+		if n == 0 {
+			n = maxStreamLine
+		}
+		w.emit(string(w.buf[:n]))
+		w.buf = w.buf[n:]
+	}
+}
+
+// Flush emits any output left after the last newline.
+func (w *lineWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.emit(strings.TrimSuffix(string(w.buf), "\r"))
+		w.buf = nil
+	}
+}
@@ -0,0 +1,22 @@
+// Package proc runs commands so that everything they start can be stopped
+// together.
+package proc
+
+import (
+	"os/exec"
+	"time"
+)
+
+// WaitDelay bounds how long a killed command may keep its output pipes
+// open, for example through a child that outlived it.
+const WaitDelay = 2 * time.Second
+
+// KillGroupOnCancel starts cmd in its own process group and kills the whole
+// group when cmd's context ends, waiting at most WaitDelay for its output to
+// close. Without it, children that inherit the output pipes keep cmd from
+// returning until they exit.
+func KillGroupOnCancel(cmd *exec.Cmd) {
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error { return killProcessGroup(cmd) }
+	cmd.WaitDelay = WaitDelay
+}
@@ -5,9 +5,16 @@ import (
 	"strings"
 
 	"github.com/tmdgusya/do-more/internal/config"
+	"github.com/tmdgusya/do-more/internal/gate"
 )
 
-func BuildPrompt(task *config.Task, gates []string, gateOutput string) string {
+func BuildPrompt(task *config.Task, gates []gate.Gate, gateOutput string) string {
+	return BuildPromptWithBaseline(task, gates, gateOutput, "")
+}
+
+// BuildPromptWithBaseline is like BuildPrompt but also tells the provider
+// which gate failures were already there before it started.
+func BuildPromptWithBaseline(task *config.Task, gates []gate.Gate, gateOutput, baseline string) string {
 	var sb strings.Builder
 
 	fmt.Fprintf(&sb, "You are working on the following task:\n\n")
@@ -17,6 +24,10 @@ func BuildPrompt(task *config.Task, gates []string, gateOutput string) string {
 		fmt.Fprintf(&sb, "\n## Previous Learnings\n%s\n", task.Learnings)
 	}
 
+	if baseline != "" {
+		fmt.Fprintf(&sb, "\n## Pre-existing Failures\nThese gates were already failing before you started. You do not need to fix them, but do not add new failures:\n%s\n", baseline)
+	}
+
 	if gateOutput != "" {
 		fmt.Fprintf(&sb, "\n## Gate Failures (previous attempt)\n%s\n", gateOutput)
 	}
@@ -27,9 +38,26 @@ func BuildPrompt(task *config.Task, gates []string, gateOutput string) string {
 		fmt.Fprintf(&sb, "- Make the minimal changes needed\n")
 		fmt.Fprintf(&sb, "- When done, the following gates will be checked:\n")
 		for _, g := range gates {
-			fmt.Fprintf(&sb, "  - %s\n", g)
+			line := g.Run
+			if g.Name != "" {
+				line = fmt.Sprintf("%s: %s", g.Name, g.Run)
+			}
+			if g.Dir != "" {
+				line += fmt.Sprintf(" (in %s)", g.Dir)
+			}
+			if !g.IsRequired() {
+				line += " (advisory, does not block completion)"
+			}
+			fmt.Fprintf(&sb, "  - %s\n", line)
 		}
 	}
 
 	return sb.String()
 }
+
+// BuildFollowUpPrompt is sent instead of the full prompt when the provider
+// continues the conversation of its previous attempt, which already holds
+// the task and instructions.
+func BuildFollowUpPrompt(gateOutput string) string {
+	return fmt.Sprintf("The gates still fail after your last changes. Keep working on the same task and fix these failures:\n\n## Gate Failures (previous attempt)\n%s\n", gateOutput)
+}
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/tmdgusya/do-more/internal/config"
+	"github.com/tmdgusya/do-more/internal/gate"
 )
 
 func TestBuildPrompt(t *testing.T) {
@@ -13,7 +14,7 @@ func TestBuildPrompt(t *testing.T) {
 		Description: "Create POST /api/login",
 		Learnings:   "Use bcrypt for passwords",
 	}
-	gates := []string{"go test ./...", "golangci-lint run"}
+	gates := gate.Commands("go test ./...", "golangci-lint run")
 
 	prompt := BuildPrompt(task, gates, "")
 
@@ -36,7 +37,7 @@ func TestBuildPromptWithGateFailures(t *testing.T) {
 		Title:       "Fix tests",
 		Description: "Make tests pass",
 	}
-	gates := []string{"go test ./..."}
+	gates := gate.Commands("go test ./...")
 	gateOutput := "FAIL: TestFoo expected 1 got 2"
 
 	prompt := BuildPrompt(task, gates, gateOutput)
@@ -53,9 +54,30 @@ func TestBuildPromptNoLearnings(t *testing.T) {
 		Learnings:   "",
 	}
 
-	prompt := BuildPrompt(task, []string{}, "")
+	prompt := BuildPrompt(task, nil, "")
 
 	if strings.Contains(prompt, "Previous Learnings") {
 		t.Error("prompt should not contain learnings section when empty")
 	}
 }
+
+func TestBuildPromptWithBaseline(t *testing.T) {
+	task := &config.Task{Title: "Add feature", Description: "Do it"}
+	prompt := BuildPromptWithBaseline(task, gate.Commands("go test ./..."), "", "FAIL: go test ./...\n- TestLegacy: flaky\n")
+	if !strings.Contains(prompt, "## Pre-existing Failures") || !strings.Contains(prompt, "TestLegacy: flaky") {
+		t.Errorf("prompt should list pre-existing failures:\n%s", prompt)
+	}
+	if strings.Contains(BuildPrompt(task, nil, ""), "Pre-existing") {
+		t.Error("prompt without a baseline should not mention pre-existing failures")
+	}
+}
+
+func TestBuildFollowUpPrompt(t *testing.T) {
+	result := BuildFollowUpPrompt("FAIL: go test ./...\nexpected 5")
+	if !strings.Contains(result, "## Gate Failures (previous attempt)\nFAIL: go test ./...\nexpected 5") {
+		t.Errorf("follow-up prompt missing the gate failures:\n%s", result)
+	}
+	if strings.Contains(result, "## Task:") {
+		t.Errorf("follow-up prompt should not repeat the task:\n%s", result)
+	}
+}
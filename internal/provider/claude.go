@@ -1,11 +1,31 @@
 package provider
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
-	"os/exec"
+	"io"
+	"strings"
+	"unicode/utf8"
 )
 
+// claude -p reads the prompt from stdin when none is given as an argument,
+// and can start a conversation under an ID we choose and resume it later.
+// --model takes an alias for the latest model of a family or a full name.
+// stream-json output, which needs --verbose in print mode, reports tokens
+// and cost as well as the conversation.
+var claudeCommand = CommandSpec{
+	Command:        "claude",
+	Args:           []string{"-p", PromptPlaceholder, "--output-format", "stream-json", "--verbose"},
+	OutputFormat:   OutputClaudeStreamJSON,
+	LargePromptVia: PromptStdin,
+	NewSessionArgs: []string{"--session-id", SessionPlaceholder},
+	ResumeArgs:     []string{"--resume", SessionPlaceholder},
+	ModelArgs:      []string{"--model", ModelPlaceholder},
+	Models:         []string{"sonnet", "opus", "haiku"},
+}
+
 type ClaudeProvider struct{}
 
 func (p *ClaudeProvider) Name() string {
@@ -13,11 +33,122 @@ func (p *ClaudeProvider) Name() string {
 }
 
 func (p *ClaudeProvider) Run(ctx context.Context, prompt string, workDir string) (string, error) {
-	cmd := exec.CommandContext(ctx, "claude", "-p", prompt, "--output-format", "text")
-	cmd.Dir = workDir
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return string(output), fmt.Errorf("claude provider: %w\noutput: %s", err, output)
+	return claudeCommand.run(ctx, p.Name(), prompt, workDir, nil, nil)
+}
+
+func (p *ClaudeProvider) RunWithUsage(ctx context.Context, prompt string, workDir string, session string, out io.Writer) (Result, error) {
+	return claudeCommand.runSession(ctx, p.Name(), prompt, workDir, session, out)
+}
+
+func (p *ClaudeProvider) WithOptions(opts RunOptions) (Provider, error) {
+	return NewCommandProvider(p.Name(), claudeCommand).WithOptions(opts)
+}
+
+func (p *ClaudeProvider) Models() []string {
+	return claudeCommand.Models
+}
+
+// maxToolInput caps how much of a tool call's input is shown.
+const maxToolInput = 200
+
+// claudeStream turns claude's stream-json output into readable lines for
+// out: assistant text as is, and a line per tool call. It keeps the usage
+// from the final result event. Lines that are not JSON, such as stderr,
+// pass through unchanged.
+type claudeStream struct {
+	out   io.Writer
+	buf   []byte
+	usage Usage
+}
+
+// claudeEvent holds the fields of a stream-json event that claudeStream
+// reads.
+type claudeEvent struct {
+	Type    string `json:"type"`
+	Message struct {
+		Content []struct {
+			Type  string          `json:"type"`
+			Text  string          `json:"text"`
+			Name  string          `json:"name"`
+			Input json.RawMessage `json:"input"`
+		} `json:"content"`
+	} `json:"message"`
+	IsError      bool    `json:"is_error"`
+	Result       string  `json:"result"`
+	TotalCostUSD float64 `json:"total_cost_usd"`
+	Usage        struct {
+		InputTokens              int `json:"input_tokens"`
+		CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+		CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+		OutputTokens             int `json:"output_tokens"`
+	} `json:"usage"`
+}
+
+func (s *claudeStream) Write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+	for {
+		i := bytes.IndexByte(s.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := s.buf[:i]
+		s.buf = s.buf[i+1:]
+		if err := s.line(line); err != nil {
+			return len(p), err
+		}
+	}
+}
+
+// Flush handles a last line left without a line ending.
+func (s *claudeStream) Flush() error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+	line := s.buf
+	s.buf = nil
+	return s.line(line)
+}
+
+func (s *claudeStream) line(line []byte) error {
+	var ev claudeEvent
+	if len(bytes.TrimSpace(line)) == 0 || json.Unmarshal(line, &ev) != nil || ev.Type == "" {
+		_, err := fmt.Fprintf(s.out, "%s\n", line)
+		return err
+	}
+	switch ev.Type {
+	case "assistant":
+		for _, c := range ev.Message.Content {
+			var err error
+			switch c.Type {
+			case "text":
+				_, err = fmt.Fprintln(s.out, strings.TrimRight(c.Text, "\n"))
+			case "tool_use":
+				input := string(c.Input)
+				if len(input) > maxToolInput {
+					n := maxToolInput
+					for n > 0 && !utf8.RuneStart(input[n]) {
+						n--
+					}
+					input = input[:n] + "..."
+				}
+				_, err = fmt.Fprintf(s.out, "→ %s %s\n", c.Name, input)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	case "result":
+		if ev.IsError && ev.Result != "" {
+			if _, err := fmt.Fprintln(s.out, ev.Result); err != nil {
+				return err
+			}
+		}
+		u := ev.Usage
+		s.usage = Usage{
+			InputTokens:  u.InputTokens + u.CacheCreationInputTokens + u.CacheReadInputTokens,
+			OutputTokens: u.OutputTokens,
+			CostUSD:      ev.TotalCostUSD,
+		}
 	}
-	return string(output), nil
+	return nil
 }
@@ -0,0 +1,405 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/exec"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tmdgusya/do-more/internal/proc"
+)
+
+// Ways a CommandSpec can hand the prompt to its command.
+const (
+	PromptArg   = "arg"
+	PromptStdin = "stdin"
+	PromptFile  = "file"
+)
+
+// Placeholders replaced in a CommandSpec's args: the prompt itself, the
+// path of the file holding it, and the ID of the session to continue.
+const (
+	PromptPlaceholder     = "{{prompt}}"
+	PromptFilePlaceholder = "{{promptFile}}"
+	SessionPlaceholder    = "{{sessionId}}"
+	ModelPlaceholder      = "{{model}}"
+)
+
+// Output formats a CommandSpec's command can print. Text is passed through
+// as is; Claude's stream-json is turned into readable lines and its usage
+// report is read.
+const (
+	OutputText             = "text"
+	OutputClaudeStreamJSON = "claude-stream-json"
+)
+
+// DefaultMaxArgBytes is the largest prompt passed as an argument before a
+// spec with LargePromptVia switches to it. Linux refuses single arguments
+// over 128 KiB.
+const DefaultMaxArgBytes = 100_000
+
+// CommandSpec describes a provider that runs a command-line tool. It lets
+// do-more.json add providers without new Go code.
+type CommandSpec struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+	// PromptVia is how the prompt reaches the command: "arg" (default)
+	// substitutes it for {{prompt}} in Args, or appends it when no arg
+	// has the placeholder; "stdin" writes it to standard input; "file"
+	// writes it to a temporary file whose path replaces {{promptFile}},
+	// or is appended. Outside "arg" mode an arg that is just {{prompt}}
+	// is left out.
+	PromptVia string `json:"promptVia,omitempty"`
+	// LargePromptVia, if set, is used instead of "arg" for prompts longer
+	// than MaxArgBytes.
+	LargePromptVia string            `json:"largePromptVia,omitempty"`
+	MaxArgBytes    int               `json:"maxArgBytes,omitempty"`
+	Env            map[string]string `json:"env,omitempty"`
+	// SuccessExitCodes lists the exit codes that count as success.
+	// Defaults to 0 only.
+	SuccessExitCodes []int `json:"successExitCodes,omitempty"`
+	// NewSessionArgs and ResumeArgs let the command continue one
+	// conversation across iterations. NewSessionArgs are added to start a
+	// session under a fresh ID, ResumeArgs to continue it; {{sessionId}}
+	// is replaced with the ID in both.
+	NewSessionArgs []string `json:"newSessionArgs,omitempty"`
+	ResumeArgs     []string `json:"resumeArgs,omitempty"`
+	// ModelArgs are added to choose a model, with {{model}} replaced by
+	// its name. Without them the command cannot be given a model.
+	ModelArgs []string `json:"modelArgs,omitempty"`
+	// Models lists model names the command is known to accept.
+	Models []string `json:"models,omitempty"`
+	// OutputFormat is what the command prints: "text" (default) or
+	// "claude-stream-json", which also reports tokens and cost.
+	OutputFormat string `json:"outputFormat,omitempty"`
+}
+
+// Validate reports whether s can be run.
+func (s CommandSpec) Validate() error {
+	if strings.TrimSpace(s.Command) == "" {
+		return fmt.Errorf("command is required")
+	}
+	switch s.PromptVia {
+	case "", PromptArg, PromptStdin, PromptFile:
+	default:
+		return fmt.Errorf("unknown promptVia %q", s.PromptVia)
+	}
+	switch s.LargePromptVia {
+	case "", PromptStdin, PromptFile:
+	default:
+		return fmt.Errorf("largePromptVia must be %q or %q, not %q", PromptStdin, PromptFile, s.LargePromptVia)
+	}
+	switch s.OutputFormat {
+	case "", OutputText, OutputClaudeStreamJSON:
+	default:
+		return fmt.Errorf("unknown outputFormat %q", s.OutputFormat)
+	}
+	if s.MaxArgBytes < 0 {
+		return fmt.Errorf("maxArgBytes must not be negative")
+	}
+	if (len(s.NewSessionArgs) == 0) != (len(s.ResumeArgs) == 0) {
+		return fmt.Errorf("newSessionArgs and resumeArgs must be set together")
+	}
+	return nil
+}
+
+// With returns s with the fields set in o replacing its own. Env entries
+// are merged.
+func (s CommandSpec) With(o CommandSpec) CommandSpec {
+	if o.Command != "" {
+		s.Command = o.Command
+	}
+	if o.Args != nil {
+		s.Args = o.Args
+	}
+	if o.PromptVia != "" {
+		s.PromptVia = o.PromptVia
+	}
+	if o.LargePromptVia != "" {
+		s.LargePromptVia = o.LargePromptVia
+	}
+	if o.MaxArgBytes != 0 {
+		s.MaxArgBytes = o.MaxArgBytes
+	}
+	if len(o.Env) > 0 {
+		env := make(map[string]string, len(s.Env)+len(o.Env))
+		maps.Copy(env, s.Env)
+		maps.Copy(env, o.Env)
+		s.Env = env
+	}
+	if o.SuccessExitCodes != nil {
+		s.SuccessExitCodes = o.SuccessExitCodes
+	}
+	if o.NewSessionArgs != nil {
+		s.NewSessionArgs = o.NewSessionArgs
+	}
+	if o.ResumeArgs != nil {
+		s.ResumeArgs = o.ResumeArgs
+	}
+	if o.ModelArgs != nil {
+		s.ModelArgs = o.ModelArgs
+	}
+	if o.Models != nil {
+		s.Models = o.Models
+	}
+	if o.OutputFormat != "" {
+		s.OutputFormat = o.OutputFormat
+	}
+	return s
+}
+
+// withOptions returns s with arguments added for opts.
+func (s CommandSpec) withOptions(name string, opts RunOptions) (CommandSpec, error) {
+	args := slices.Clone(s.Args)
+	if opts.Model != "" {
+		if len(s.ModelArgs) == 0 {
+			return s, fmt.Errorf("%s provider does not support choosing a model", name)
+		}
+		for _, a := range s.ModelArgs {
+			args = append(args, strings.ReplaceAll(a, ModelPlaceholder, opts.Model))
+		}
+	}
+	s.Args = append(args, opts.ExtraArgs...)
+	return s, nil
+}
+
+// delivery returns how a prompt of the given size is handed over.
+func (s CommandSpec) delivery(size int) string {
+	via := s.PromptVia
+	if via == "" {
+		via = PromptArg
+	}
+	limit := s.MaxArgBytes
+	if limit == 0 {
+		limit = DefaultMaxArgBytes
+	}
+	if via == PromptArg && s.LargePromptVia != "" && size > limit {
+		return s.LargePromptVia
+	}
+	return via
+}
+
+// args returns the command's arguments for delivering prompt via the given
+// mode; promptFile is the prompt's path in "file" mode.
+func (s CommandSpec) args(via, prompt, promptFile string) []string {
+	var args []string
+	found := false
+	for _, a := range s.Args {
+		switch {
+		case via == PromptArg:
+			found = found || strings.Contains(a, PromptPlaceholder)
+			a = strings.ReplaceAll(a, PromptPlaceholder, prompt)
+		case a == PromptPlaceholder:
+			continue
+		case via == PromptFile:
+			found = found || strings.Contains(a, PromptFilePlaceholder)
+			a = strings.ReplaceAll(a, PromptFilePlaceholder, promptFile)
+		}
+		args = append(args, a)
+	}
+	switch {
+	case found || via == PromptStdin:
+	case via == PromptArg:
+		args = append(args, prompt)
+	case via == PromptFile:
+		args = append(args, promptFile)
+	}
+	return args
+}
+
+// writePromptFile saves prompt to a temporary file readable only by the
+// current user and returns its path.
+func writePromptFile(prompt string) (string, error) {
+	f, err := os.CreateTemp("", "do-more-prompt-*.md")
+	if err != nil {
+		return "", fmt.Errorf("creating prompt file: %w", err)
+	}
+	if _, err := f.WriteString(prompt); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", fmt.Errorf("writing prompt file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("writing prompt file: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// succeeded reports whether err, returned by running the command, means
+// it exited with one of the success codes.
+func (s CommandSpec) succeeded(err error) bool {
+	codes := s.SuccessExitCodes
+	if len(codes) == 0 {
+		codes = []int{0}
+	}
+	if err == nil {
+		return slices.Contains(codes, 0)
+	}
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) && slices.Contains(codes, exitErr.ExitCode())
+}
+
+// runSession runs the command, continuing session or starting a new one
+// when session is empty, and returns the session to continue next time in
+// the result. Without session args it just runs the command and returns no
+// session.
+func (s CommandSpec) runSession(ctx context.Context, name, prompt, workDir, session string, out io.Writer) (Result, error) {
+	if len(s.ResumeArgs) == 0 {
+		return s.runResult(ctx, name, prompt, workDir, nil, out)
+	}
+	extra := s.ResumeArgs
+	if session == "" {
+		id, err := newSessionID()
+		if err != nil {
+			return Result{}, fmt.Errorf("%s provider: %w", name, err)
+		}
+		session, extra = id, s.NewSessionArgs
+	}
+	args := make([]string, len(extra))
+	for i, a := range extra {
+		args[i] = strings.ReplaceAll(a, SessionPlaceholder, session)
+	}
+	res, err := s.runResult(ctx, name, prompt, workDir, args, out)
+	res.Session = session
+	return res, err
+}
+
+// newSessionID returns a random version 4 UUID.
+func newSessionID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("generating session ID: %w", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// run runs the command for the provider called name, with extra added to
+// its arguments, and returns its combined output, copying it to out as it
+// arrives when out is not nil.
+func (s CommandSpec) run(ctx context.Context, name, prompt, workDir string, extra []string, out io.Writer) (string, error) {
+	res, err := s.runResult(ctx, name, prompt, workDir, extra, out)
+	return res.Output, err
+}
+
+// runResult is like run but also reports how long the command took and,
+// when its output format says, the tokens and cost it used.
+func (s CommandSpec) runResult(ctx context.Context, name, prompt, workDir string, extra []string, out io.Writer) (Result, error) {
+	via := s.delivery(len(prompt))
+	var promptFile string
+	if via == PromptFile {
+		path, err := writePromptFile(prompt)
+		if err != nil {
+			return Result{}, fmt.Errorf("%s provider: %w", name, err)
+		}
+		defer os.Remove(path)
+		promptFile = path
+	}
+
+	cmd := exec.CommandContext(ctx, s.Command, append(s.args(via, prompt, promptFile), extra...)...)
+	cmd.Dir = workDir
+	proc.KillGroupOnCancel(cmd)
+	if via == PromptStdin {
+		cmd.Stdin = strings.NewReader(prompt)
+	}
+	if len(s.Env) > 0 {
+		keys := make([]string, 0, len(s.Env))
+		for k := range s.Env {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		cmd.Env = os.Environ()
+		for _, k := range keys {
+			cmd.Env = append(cmd.Env, k+"="+s.Env[k])
+		}
+	}
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	if out != nil {
+		w = io.MultiWriter(&buf, out)
+	}
+	var stream *claudeStream
+	if s.OutputFormat == OutputClaudeStreamJSON {
+		stream = &claudeStream{out: w}
+		w = stream
+	}
+	cmd.Stdout = w
+	cmd.Stderr = w
+	start := time.Now()
+	err := cmd.Run()
+	if stream != nil {
+		stream.Flush()
+	}
+	res := Result{Output: buf.String()}
+	if stream != nil {
+		res.Usage = stream.usage
+	}
+	res.Usage.DurationMs = time.Since(start).Milliseconds()
+	if !s.succeeded(err) {
+		if err == nil {
+			err = fmt.Errorf("exit status 0 is not a success exit code")
+		}
+		return res, fmt.Errorf("%s provider: %w\noutput: %s", name, err, res.Output)
+	}
+	return res, nil
+}
+
+// builtinCommands are the specs behind the built-in CLI providers.
+var builtinCommands = map[string]CommandSpec{
+	"claude":   claudeCommand,
+	"kimi":     kimiCommand,
+	"opencode": openCodeCommand,
+}
+
+// BuiltinCommand returns the spec of the built-in provider called name, so
+// that do-more.json can adjust it.
+func BuiltinCommand(name string) (CommandSpec, bool) {
+	spec, ok := builtinCommands[name]
+	return spec, ok
+}
+
+// CommandProvider runs the command described by a CommandSpec.
+type CommandProvider struct {
+	name string
+	spec CommandSpec
+}
+
+// NewCommandProvider returns a provider called name that runs spec.
+func NewCommandProvider(name string, spec CommandSpec) *CommandProvider {
+	return &CommandProvider{name: name, spec: spec}
+}
+
+func (p *CommandProvider) Name() string {
+	return p.name
+}
+
+func (p *CommandProvider) Run(ctx context.Context, prompt string, workDir string) (string, error) {
+	return p.spec.run(ctx, p.name, prompt, workDir, nil, nil)
+}
+
+func (p *CommandProvider) WithOptions(opts RunOptions) (Provider, error) {
+	spec, err := p.spec.withOptions(p.name, opts)
+	if err != nil {
+		return nil, err
+	}
+	return NewCommandProvider(p.name, spec), nil
+}
+
+func (p *CommandProvider) Models() []string {
+	return p.spec.Models
+}
+
+func (p *CommandProvider) RunWithUsage(ctx context.Context, prompt string, workDir string, session string, out io.Writer) (Result, error) {
+	return p.spec.runSession(ctx, p.name, prompt, workDir, session, out)
+}
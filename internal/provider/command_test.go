@@ -0,0 +1,253 @@
+package provider
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandProviderArgs(t *testing.T) {
+	p := NewCommandProvider("echoer", CommandSpec{
+		Command: "sh",
+		Args:    []string{"-c", `echo "$1 $GREETING"`, "sh", "prompt: " + PromptPlaceholder},
+		Env:     map[string]string{"GREETING": "hi"},
+	})
+	output, err := p.Run(context.Background(), "hello", t.TempDir())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if output != "prompt: hello hi\n" {
+		t.Errorf("output = %q, want %q", output, "prompt: hello hi\n")
+	}
+}
+
+func TestCommandProviderAppendsPrompt(t *testing.T) {
+	p := NewCommandProvider("echo", CommandSpec{Command: "echo", Args: []string{"-n"}})
+	output, err := p.Run(context.Background(), "hello", t.TempDir())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if output != "hello" {
+		t.Errorf("output = %q, want %q", output, "hello")
+	}
+}
+
+func TestCommandProviderStdin(t *testing.T) {
+	p := NewCommandProvider("cat", CommandSpec{Command: "cat", PromptVia: PromptStdin})
+	output, err := p.Run(context.Background(), "hello over stdin", t.TempDir())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if output != "hello over stdin" {
+		t.Errorf("output = %q, want the prompt echoed back", output)
+	}
+}
+
+func TestCommandProviderSuccessExitCodes(t *testing.T) {
+	spec := CommandSpec{Command: "sh", Args: []string{"-c", "echo partial; exit 3", "sh"}}
+	_, err := NewCommandProvider("strict", spec).Run(context.Background(), "x", t.TempDir())
+	if err == nil || !strings.Contains(err.Error(), "strict provider: exit status 3") {
+		t.Errorf("Run error = %v, want exit status 3", err)
+	}
+
+	spec.SuccessExitCodes = []int{0, 3}
+	output, err := NewCommandProvider("lenient", spec).Run(context.Background(), "x", t.TempDir())
+	if err != nil {
+		t.Errorf("Run error = %v, want nil for exit code 3", err)
+	}
+	if output != "partial\n" {
+		t.Errorf("output = %q", output)
+	}
+}
+
+func TestCommandSpecValidate(t *testing.T) {
+	if err := (CommandSpec{Command: "aider"}).Validate(); err != nil {
+		t.Errorf("Validate = %v, want nil", err)
+	}
+	if err := (CommandSpec{}).Validate(); err == nil {
+		t.Error("expected error for missing command")
+	}
+	if err := (CommandSpec{Command: "aider", PromptVia: "pigeon"}).Validate(); err == nil {
+		t.Error("expected error for unknown promptVia")
+	}
+	if err := (CommandSpec{Command: "aider", LargePromptVia: PromptArg}).Validate(); err == nil {
+		t.Error("expected error for largePromptVia arg")
+	}
+}
+
+func TestCommandProviderPromptFile(t *testing.T) {
+	p := NewCommandProvider("reader", CommandSpec{
+		Command:   "sh",
+		Args:      []string{"-c", `cat "$1"; echo; ls -l "$1" | cut -c1-10`, "sh", PromptFilePlaceholder, PromptPlaceholder},
+		PromptVia: PromptFile,
+	})
+	output, err := p.Run(context.Background(), "hello from a file", t.TempDir())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if output != "hello from a file\n-rw-------\n" {
+		t.Errorf("output = %q, want the prompt and owner-only permissions", output)
+	}
+}
+
+func TestCommandProviderSwitchesForLargePrompts(t *testing.T) {
+	spec := CommandSpec{
+		Command:        "sh",
+		Args:           []string{"-c", `if [ $# -gt 0 ]; then echo "arg:$1"; else echo "stdin:$(cat)"; fi`, "sh", PromptPlaceholder},
+		LargePromptVia: PromptStdin,
+		MaxArgBytes:    10,
+	}
+	p := NewCommandProvider("switcher", spec)
+
+	output, err := p.Run(context.Background(), "short", t.TempDir())
+	if err != nil || output != "arg:short\n" {
+		t.Errorf("short prompt: output = %q, err = %v, want it as an argument", output, err)
+	}
+	long := strings.Repeat("x", 11)
+	output, err = p.Run(context.Background(), long, t.TempDir())
+	if err != nil || output != "stdin:"+long+"\n" {
+		t.Errorf("long prompt: output = %q, err = %v, want it on stdin", output, err)
+	}
+}
+
+func TestBuiltinClaudeUsesStdinForLargePrompts(t *testing.T) {
+	spec, ok := BuiltinCommand("claude")
+	if !ok {
+		t.Fatal("claude is not a built-in command")
+	}
+	via := spec.delivery(DefaultMaxArgBytes + 1)
+	if via != PromptStdin {
+		t.Fatalf("delivery = %q, want stdin", via)
+	}
+	args := spec.args(via, "prompt", "")
+	if strings.Join(args, " ") != "-p --output-format stream-json --verbose" {
+		t.Errorf("args = %q, want the prompt argument left out", args)
+	}
+}
+
+func TestCommandSpecWith(t *testing.T) {
+	base := CommandSpec{Command: "claude", Args: []string{"-p", PromptPlaceholder}, Env: map[string]string{"A": "1"}}
+	got := base.With(CommandSpec{PromptVia: PromptStdin, Env: map[string]string{"B": "2"}})
+	if got.Command != "claude" || got.PromptVia != PromptStdin || len(got.Args) != 2 {
+		t.Errorf("With = %+v", got)
+	}
+	if got.Env["A"] != "1" || got.Env["B"] != "2" {
+		t.Errorf("Env = %v, want both entries", got.Env)
+	}
+	if len(base.Env) != 1 {
+		t.Errorf("With modified the original Env: %v", base.Env)
+	}
+}
+
+func TestCommandProviderKilledWithChildren(t *testing.T) {
+	// The child would outlive a plain kill of the shell and hold the output
+	// pipe open.
+	p := NewCommandProvider("stuck", CommandSpec{Command: "sh", Args: []string{"-c", "echo start; sleep 30 & wait", "sh"}})
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	output, err := p.Run(ctx, "x", t.TempDir())
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Run took %v, want the provider killed promptly", elapsed)
+	}
+	if err == nil || output != "start\n" {
+		t.Errorf("Run = %q, %v, want the partial output and an error", output, err)
+	}
+}
+
+func TestCommandProviderSessions(t *testing.T) {
+	p := NewCommandProvider("chat", CommandSpec{
+		Command:        "sh",
+		Args:           []string{"-c", `echo "$@"`, "sh"},
+		NewSessionArgs: []string{"--session-id", SessionPlaceholder},
+		ResumeArgs:     []string{"--resume", SessionPlaceholder},
+	})
+
+	res, err := p.RunWithUsage(context.Background(), "start", t.TempDir(), "", nil)
+	if err != nil {
+		t.Fatalf("RunWithUsage failed: %v", err)
+	}
+	session := res.Session
+	if len(session) != 36 || res.Output != "start --session-id "+session+"\n" {
+		t.Errorf("new session: output = %q, session = %q", res.Output, session)
+	}
+
+	res, err = p.RunWithUsage(context.Background(), "again", t.TempDir(), session, nil)
+	if err != nil {
+		t.Fatalf("RunWithUsage failed: %v", err)
+	}
+	if res.Session != session || res.Output != "again --resume "+session+"\n" {
+		t.Errorf("resumed session: output = %q, session = %q, want %q", res.Output, res.Session, session)
+	}
+
+	res, err = NewCommandProvider("plain", CommandSpec{Command: "true"}).RunWithUsage(context.Background(), "x", t.TempDir(), "", nil)
+	if err != nil || res.Session != "" {
+		t.Errorf("provider without session args returned session %q, err %v", res.Session, err)
+	}
+	if err := (CommandSpec{Command: "x", ResumeArgs: []string{"--resume", SessionPlaceholder}}).Validate(); err == nil {
+		t.Error("expected error for resumeArgs without newSessionArgs")
+	}
+}
+
+func TestCommandProviderWithOptions(t *testing.T) {
+	base := NewCommandProvider("echo", CommandSpec{
+		Command:   "echo",
+		Args:      []string{PromptPlaceholder},
+		ModelArgs: []string{"--model=" + ModelPlaceholder},
+		Models:    []string{"small", "large"},
+	})
+	p, err := base.WithOptions(RunOptions{Model: "large", ExtraArgs: []string{"--yes"}})
+	if err != nil {
+		t.Fatalf("WithOptions failed: %v", err)
+	}
+	output, err := p.Run(context.Background(), "hi", t.TempDir())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if output != "hi --model=large --yes\n" {
+		t.Errorf("output = %q, want the model and extra args added", output)
+	}
+	if output, _ := base.Run(context.Background(), "hi", t.TempDir()); output != "hi\n" {
+		t.Errorf("WithOptions changed the original provider: %q", output)
+	}
+
+	_, err = NewCommandProvider("plain", CommandSpec{Command: "echo"}).WithOptions(RunOptions{Model: "large"})
+	if err == nil || !strings.Contains(err.Error(), "does not support choosing a model") {
+		t.Errorf("WithOptions error = %v, want an unsupported model error", err)
+	}
+}
+
+func TestCommandProviderClaudeStreamJSON(t *testing.T) {
+	script := `cat <<'END'
+{"type":"system","subtype":"init","session_id":"abc"}
+{"type":"assistant","message":{"content":[{"type":"text","text":"Adding the endpoint."},{"type":"tool_use","name":"Edit","input":{"file_path":"main.go"}}]}}
+{"type":"user","message":{"content":[{"type":"tool_result","content":"ok"}]}}
+{"type":"assistant","message":{"content":[{"type":"text","text":"Done."}]}}
+{"type":"result","subtype":"success","is_error":false,"result":"Done.","total_cost_usd":0.25,"usage":{"input_tokens":100,"cache_creation_input_tokens":20,"cache_read_input_tokens":30,"output_tokens":40}}
+END
+echo "warning: on stderr" >&2`
+	p := NewCommandProvider("claude-like", CommandSpec{
+		Command:      "sh",
+		Args:         []string{"-c", script, "sh"},
+		OutputFormat: OutputClaudeStreamJSON,
+	})
+	var live strings.Builder
+	res, err := p.RunWithUsage(context.Background(), "x", t.TempDir(), "", &live)
+	if err != nil {
+		t.Fatalf("RunWithUsage failed: %v", err)
+	}
+	want := "Adding the endpoint.\n→ Edit {\"file_path\":\"main.go\"}\nDone.\nwarning: on stderr\n"
+	if res.Output != want {
+		t.Errorf("output = %q, want %q", res.Output, want)
+	}
+	if live.String() != want {
+		t.Errorf("streamed = %q, want the same readable lines", live.String())
+	}
+	if res.Usage.InputTokens != 150 || res.Usage.OutputTokens != 40 || res.Usage.CostUSD != 0.25 {
+		t.Errorf("usage = %+v, want 150 input, 40 output tokens and $0.25", res.Usage)
+	}
+	if err := (CommandSpec{Command: "x", OutputFormat: "xml"}).Validate(); err == nil {
+		t.Error("expected error for unknown outputFormat")
+	}
+}
@@ -0,0 +1,178 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/tmdgusya/do-more/internal/git"
+)
+
+// DefaultFakeScript is the script the fake provider follows when none is
+// given, relative to the work directory.
+const DefaultFakeScript = "do-more.fake.json"
+
+// FakeScript says what the fake provider does, one step per run.
+type FakeScript struct {
+	Steps []FakeStep `json:"steps"`
+}
+
+// FakeStep is one run of the fake provider. It sleeps, applies the patch,
+// writes the files, prints the output and exits with the exit code, in
+// that order.
+type FakeStep struct {
+	// Sleep is how long the run takes, e.g. "30s".
+	Sleep string `json:"sleep,omitempty"`
+	// Patch names a unified diff to apply to the work directory, relative
+	// to the script.
+	Patch string `json:"patch,omitempty"`
+	// Files maps paths in the work directory to the content written there.
+	Files    map[string]string `json:"files,omitempty"`
+	Output   string            `json:"output,omitempty"`
+	ExitCode int               `json:"exitCode,omitempty"`
+	// Usage is reported as what the run consumed.
+	Usage Usage `json:"usage,omitzero"`
+	// Session is reported as the conversation to continue next time, to try
+	// out session handling. The fake provider remembers nothing either way.
+	Session string `json:"session,omitempty"`
+}
+
+// LoadFakeScript reads and checks the script at path.
+func LoadFakeScript(path string) (*FakeScript, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var script FakeScript
+	if err := json.Unmarshal(data, &script); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if len(script.Steps) == 0 {
+		return nil, fmt.Errorf("%s has no steps", path)
+	}
+	for i, step := range script.Steps {
+		if step.Sleep != "" {
+			if d, err := time.ParseDuration(step.Sleep); err != nil || d < 0 {
+				return nil, fmt.Errorf("%s: step %d: invalid sleep %q: want a duration such as \"5s\"", path, i+1, step.Sleep)
+			}
+		}
+		if step.ExitCode < 0 {
+			return nil, fmt.Errorf("%s: step %d: exitCode must not be negative", path, i+1)
+		}
+	}
+	return &script, nil
+}
+
+// FakeProvider follows a FakeScript instead of running a model, to try out
+// gates and iteration limits without spending anything. Each run takes the
+// next step of its script; once the steps run out the last one repeats.
+// Every copy WithOptions makes counts its steps from the start again, so a
+// task configured with it follows the script from its first step.
+type FakeProvider struct {
+	script string
+	runs   *fakeRuns
+}
+
+// fakeRuns counts the runs of a fake provider.
+type fakeRuns struct {
+	mu    sync.Mutex
+	count int
+}
+
+// NewFakeProvider returns a fake provider that follows DefaultFakeScript.
+func NewFakeProvider() *FakeProvider {
+	return &FakeProvider{script: DefaultFakeScript, runs: &fakeRuns{}}
+}
+
+func (p *FakeProvider) Name() string {
+	return "fake"
+}
+
+func (p *FakeProvider) Run(ctx context.Context, prompt string, workDir string) (string, error) {
+	res, err := p.RunWithUsage(ctx, prompt, workDir, "", nil)
+	return res.Output, err
+}
+
+// RunWithUsage carries out the next step of the script and reports the
+// step's usage and session. The session passed in is ignored.
+func (p *FakeProvider) RunWithUsage(ctx context.Context, prompt string, workDir string, session string, out io.Writer) (Result, error) {
+	path := p.script
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(workDir, path)
+	}
+	script, err := LoadFakeScript(path)
+	if err != nil {
+		return Result{}, fmt.Errorf("fake provider: %w", err)
+	}
+	step := script.Steps[p.runs.next(len(script.Steps))]
+
+	if d, _ := time.ParseDuration(step.Sleep); d > 0 {
+		timer := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return Result{}, fmt.Errorf("fake provider: %w", ctx.Err())
+		case <-timer.C:
+		}
+	}
+	if step.Patch != "" {
+		patch := step.Patch
+		if !filepath.IsAbs(patch) {
+			patch = filepath.Join(filepath.Dir(path), patch)
+		}
+		if err := git.Apply(ctx, workDir, patch); err != nil {
+			return Result{}, fmt.Errorf("fake provider: %w", err)
+		}
+	}
+	changes := make([]fileChange, 0, len(step.Files))
+	for name, content := range step.Files {
+		changes = append(changes, fileChange{Path: name, Content: content})
+	}
+	if err := applyChanges(workDir, changes); err != nil {
+		return Result{}, fmt.Errorf("fake provider: %w", err)
+	}
+
+	res := Result{Output: step.Output, Session: step.Session, Usage: step.Usage}
+	if out != nil {
+		io.WriteString(out, step.Output)
+	}
+	if step.ExitCode != 0 {
+		return res, fmt.Errorf("fake provider: exit status %d", step.ExitCode)
+	}
+	return res, nil
+}
+
+// WithOptions returns a copy of p, starting from the first step, that
+// follows the script named by the one extra argument or p's script without
+// one. The fake provider has no models to choose from.
+func (p *FakeProvider) WithOptions(opts RunOptions) (Provider, error) {
+	if opts.Model != "" {
+		return nil, fmt.Errorf("fake provider does not support choosing a model")
+	}
+	switch len(opts.ExtraArgs) {
+	case 0:
+		return &FakeProvider{script: p.script, runs: &fakeRuns{}}, nil
+	case 1:
+		return &FakeProvider{script: opts.ExtraArgs[0], runs: &fakeRuns{}}, nil
+	default:
+		return nil, fmt.Errorf("fake provider takes one extra argument, the script path")
+	}
+}
+
+func (p *FakeProvider) Models() []string {
+	return nil
+}
+
+// next returns the index of the step to run in a script of n steps.
+func (r *fakeRuns) next(n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := min(r.count, n-1)
+	r.count++
+	return i
+}
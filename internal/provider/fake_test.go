@@ -0,0 +1,87 @@
+package provider
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFakeProviderFollowsScript(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"notes.txt": "old\n",
+		"fix.patch": "--- a/notes.txt\n+++ b/notes.txt\n@@ -1 +1 @@\n-old\n+new\n",
+		DefaultFakeScript: `{"steps": [
+			{"files": {"src/a.txt": "first"}, "output": "tried\n", "exitCode": 2},
+			{"patch": "fix.patch", "output": "fixed\n", "session": "s1", "usage": {"inputTokens": 10, "outputTokens": 5, "costUsd": 0.01}}
+		]}`,
+	})
+	p := NewFakeProvider()
+
+	output, err := p.Run(context.Background(), "x", dir)
+	if err == nil || err.Error() != "fake provider: exit status 2" {
+		t.Errorf("step 1 error = %v, want exit status 2", err)
+	}
+	if output != "tried\n" {
+		t.Errorf("step 1 output = %q", output)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "src/a.txt")); string(data) != "first" {
+		t.Errorf("src/a.txt = %q, want the scripted content", data)
+	}
+
+	var live strings.Builder
+	for i := 2; i <= 3; i++ {
+		writeFiles(t, dir, map[string]string{"notes.txt": "old\n"})
+		res, err := p.RunWithUsage(context.Background(), "x", dir, "", &live)
+		if err != nil || res.Output != "fixed\n" || res.Session != "s1" || res.Usage.CostUSD != 0.01 {
+			t.Errorf("run %d = %+v, %v, want the last step", i, res, err)
+		}
+		if data, _ := os.ReadFile(filepath.Join(dir, "notes.txt")); string(data) != "new\n" {
+			t.Errorf("run %d: notes.txt = %q, want the patch applied", i, data)
+		}
+	}
+	if live.String() != "fixed\nfixed\n" {
+		t.Errorf("streamed = %q", live.String())
+	}
+
+	copied, err := p.WithOptions(RunOptions{})
+	if err != nil {
+		t.Fatalf("WithOptions failed: %v", err)
+	}
+	if output, _ := copied.Run(context.Background(), "x", dir); output != "tried\n" {
+		t.Errorf("copy's first run output = %q, want the first step", output)
+	}
+}
+
+func TestFakeProviderOptions(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"slow.json": `{"steps": [{"sleep": "1m"}]}`,
+		"bad.json":  `{"steps": [{"sleep": "soon"}]}`,
+	})
+	p, err := NewFakeProvider().WithOptions(RunOptions{ExtraArgs: []string{"slow.json"}})
+	if err != nil {
+		t.Fatalf("WithOptions failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.Run(ctx, "x", dir); err == nil || !strings.Contains(err.Error(), "deadline exceeded") {
+		t.Errorf("Run error = %v, want the sleep cut short", err)
+	}
+
+	if _, err := NewFakeProvider().Run(context.Background(), "x", dir); err == nil {
+		t.Error("expected an error without a script")
+	}
+	if _, err := LoadFakeScript(filepath.Join(dir, "bad.json")); err == nil {
+		t.Error("expected an error for an invalid sleep")
+	}
+	if _, err := NewFakeProvider().WithOptions(RunOptions{Model: "big"}); err == nil {
+		t.Error("expected an error for a model")
+	}
+	if _, err := NewFakeProvider().WithOptions(RunOptions{ExtraArgs: []string{"a", "b"}}); err == nil {
+		t.Error("expected an error for two extra arguments")
+	}
+}
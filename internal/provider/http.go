@@ -0,0 +1,329 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultHTTPTimeout bounds one chat completion request when HTTPSpec sets
+// no timeout.
+const DefaultHTTPTimeout = 10 * time.Minute
+
+// DefaultMaxTurns is how many model replies an HTTPProvider run allows
+// before giving up, when HTTPSpec sets no limit.
+const DefaultMaxTurns = 50
+
+// maxToolOutput caps what a tool call returns to the model.
+const maxToolOutput = 64 * 1024
+
+// HTTPSpec describes a provider that talks to an OpenAI-compatible chat
+// completions API, such as a llama.cpp or vLLM server.
+type HTTPSpec struct {
+	// BaseURL is the API root, e.g. "http://localhost:8080/v1".
+	BaseURL string `json:"baseUrl"`
+	Model   string `json:"model"`
+	// APIKeyEnv names the environment variable holding the API key, if
+	// the server wants one.
+	APIKeyEnv string `json:"apiKeyEnv,omitempty"`
+	// Timeout bounds each request, e.g. "5m". Defaults to 10 minutes.
+	Timeout string `json:"timeout,omitempty"`
+	// MaxTurns caps the model replies in one run. Defaults to 50.
+	MaxTurns int `json:"maxTurns,omitempty"`
+}
+
+// Validate reports whether s can be used.
+func (s HTTPSpec) Validate() error {
+	if strings.TrimSpace(s.BaseURL) == "" {
+		return fmt.Errorf("baseUrl is required")
+	}
+	if s.Timeout != "" {
+		if d, err := time.ParseDuration(s.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("invalid timeout %q: want a duration such as \"5m\"", s.Timeout)
+		}
+	}
+	if s.MaxTurns < 0 {
+		return fmt.Errorf("maxTurns must not be negative")
+	}
+	return nil
+}
+
+func (s HTTPSpec) timeout() time.Duration {
+	if d, err := time.ParseDuration(s.Timeout); err == nil && d > 0 {
+		return d
+	}
+	return DefaultHTTPTimeout
+}
+
+// HTTPProvider drives a model behind an OpenAI-compatible chat completions
+// API. The model works on workDir through a small set of file tools.
+type HTTPProvider struct {
+	name   string
+	spec   HTTPSpec
+	client *http.Client
+}
+
+// NewHTTPProvider returns a provider called name that talks to the API
+// described by spec.
+func NewHTTPProvider(name string, spec HTTPSpec) *HTTPProvider {
+	return &HTTPProvider{name: name, spec: spec, client: http.DefaultClient}
+}
+
+func (p *HTTPProvider) Name() string {
+	return p.name
+}
+
+func (p *HTTPProvider) Run(ctx context.Context, prompt string, workDir string) (string, error) {
+	res, err := p.RunWithUsage(ctx, prompt, workDir, "", nil)
+	return res.Output, err
+}
+
+// WithOptions returns a copy of p that uses opts.Model. Extra arguments
+// have no meaning for an HTTP API and are refused.
+func (p *HTTPProvider) WithOptions(opts RunOptions) (Provider, error) {
+	if len(opts.ExtraArgs) > 0 {
+		return nil, fmt.Errorf("%s provider does not take extra arguments", p.name)
+	}
+	spec := p.spec
+	if opts.Model != "" {
+		spec.Model = opts.Model
+	}
+	return &HTTPProvider{name: p.name, spec: spec, client: p.client}, nil
+}
+
+func (p *HTTPProvider) Models() []string {
+	if p.spec.Model == "" {
+		return nil
+	}
+	return []string{p.spec.Model}
+}
+
+// RunWithUsage sends prompt to the model and carries out the file tool
+// calls it makes in workDir until it answers without one. Each tool call
+// and the final answer are written to out as they happen, and the result
+// reports the tokens the server counted. The API has no sessions, so
+// session is ignored.
+func (p *HTTPProvider) RunWithUsage(ctx context.Context, prompt string, workDir string, session string, out io.Writer) (res Result, err error) {
+	start := time.Now()
+	var transcript strings.Builder
+	defer func() {
+		res.Output = transcript.String()
+		res.Usage.DurationMs = time.Since(start).Milliseconds()
+	}()
+
+	root, err := os.OpenRoot(workDir)
+	if err != nil {
+		return res, fmt.Errorf("%s provider: %w", p.name, err)
+	}
+	defer root.Close()
+
+	var w io.Writer = &transcript
+	if out != nil {
+		w = io.MultiWriter(&transcript, out)
+	}
+	messages := []chatMessage{
+		{Role: "system", Content: httpSystemPrompt},
+		{Role: "user", Content: prompt},
+	}
+	maxTurns := p.spec.MaxTurns
+	if maxTurns == 0 {
+		maxTurns = DefaultMaxTurns
+	}
+	for turn := 0; turn < maxTurns; turn++ {
+		reply, usage, err := p.complete(ctx, messages)
+		if err != nil {
+			return res, fmt.Errorf("%s provider: %w", p.name, err)
+		}
+		res.Usage.InputTokens += usage.PromptTokens
+		res.Usage.OutputTokens += usage.CompletionTokens
+		messages = append(messages, reply)
+		if len(reply.ToolCalls) == 0 {
+			fmt.Fprintln(w, reply.Content)
+			return res, nil
+		}
+		for _, call := range reply.ToolCalls {
+			result := runTool(root, call.Function.Name, call.Function.Arguments)
+			fmt.Fprintf(w, "→ %s %s\n", call.Function.Name, call.Function.Arguments)
+			messages = append(messages, chatMessage{Role: "tool", ToolCallID: call.ID, Content: result})
+		}
+	}
+	return res, fmt.Errorf("%s provider: no final answer after %d turns", p.name, maxTurns)
+}
+
+// complete sends one chat completion request and returns the reply and the
+// tokens it used.
+func (p *HTTPProvider) complete(ctx context.Context, messages []chatMessage) (chatMessage, chatUsage, error) {
+	body, err := json.Marshal(chatRequest{Model: p.spec.Model, Messages: messages, Tools: fileTools})
+	if err != nil {
+		return chatMessage{}, chatUsage{}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.spec.timeout())
+	defer cancel()
+
+	url := strings.TrimSuffix(p.spec.BaseURL, "/") + "/chat/completions"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return chatMessage{}, chatUsage{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.spec.APIKeyEnv != "" {
+		if key := os.Getenv(p.spec.APIKeyEnv); key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return chatMessage{}, chatUsage{}, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return chatMessage{}, chatUsage{}, fmt.Errorf("reading response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return chatMessage{}, chatUsage{}, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	var parsed chatResponse
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return chatMessage{}, chatUsage{}, fmt.Errorf("parsing response: %w", err)
+	}
+	if len(parsed.Choices) == 0 {
+		return chatMessage{}, chatUsage{}, fmt.Errorf("response has no choices")
+	}
+	return parsed.Choices[0].Message, parsed.Usage, nil
+}
+
+const httpSystemPrompt = `You are a coding agent working in a project directory. Use the tools to read, list and write files; paths are relative to the project root. Make the changes the task needs, then reply with a short summary and no tool calls.`
+
+type chatRequest struct {
+	Model    string        `json:"model,omitempty"`
+	Messages []chatMessage `json:"messages"`
+	Tools    []chatTool    `json:"tools,omitempty"`
+}
+
+type chatMessage struct {
+	Role       string     `json:"role"`
+	Content    string     `json:"content"`
+	ToolCalls  []toolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+}
+
+type toolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type chatResponse struct {
+	Choices []struct {
+		Message chatMessage `json:"message"`
+	} `json:"choices"`
+	Usage chatUsage `json:"usage"`
+}
+
+type chatUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+type chatTool struct {
+	Type     string       `json:"type"`
+	Function toolFunction `json:"function"`
+}
+
+type toolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Parameters  json.RawMessage `json:"parameters"`
+}
+
+// fileTools are the tools offered to the model.
+var fileTools = []chatTool{
+	{Type: "function", Function: toolFunction{
+		Name:        "read_file",
+		Description: "Read a file in the project.",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"path":{"type":"string"}},"required":["path"]}`),
+	}},
+	{Type: "function", Function: toolFunction{
+		Name:        "write_file",
+		Description: "Create or overwrite a file in the project with the given content.",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"path":{"type":"string"},"content":{"type":"string"}},"required":["path","content"]}`),
+	}},
+	{Type: "function", Function: toolFunction{
+		Name:        "list_files",
+		Description: "List the entries of a directory in the project. Directories end with a slash.",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"path":{"type":"string"}}}`),
+	}},
+}
+
+// runTool carries out one tool call inside root and returns its result for
+// the model. Failures are reported to the model rather than ending the run.
+func runTool(root *os.Root, name, arguments string) string {
+	var args struct {
+		Path    string `json:"path"`
+		Content string `json:"content"`
+	}
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+		return fmt.Sprintf("error: invalid arguments: %v", err)
+	}
+	file := path.Clean("/" + args.Path)[1:]
+	if file == "" {
+		file = "."
+	}
+
+	switch name {
+	case "read_file":
+		data, err := root.ReadFile(file)
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		if len(data) > maxToolOutput {
+			return string(data[:maxToolOutput]) + fmt.Sprintf("\n[truncated, %d more bytes]", len(data)-maxToolOutput)
+		}
+		return string(data)
+	case "write_file":
+		if dir := path.Dir(file); dir != "." {
+			if err := root.MkdirAll(dir, 0755); err != nil {
+				return "error: " + err.Error()
+			}
+		}
+		if err := root.WriteFile(file, []byte(args.Content), 0644); err != nil {
+			return "error: " + err.Error()
+		}
+		return fmt.Sprintf("wrote %d bytes to %s", len(args.Content), file)
+	case "list_files":
+		f, err := root.Open(file)
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		defer f.Close()
+		entries, err := f.ReadDir(-1)
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		names := make([]string, 0, len(entries))
+		for _, e := range entries {
+			if e.IsDir() {
+				names = append(names, e.Name()+"/")
+			} else {
+				names = append(names, e.Name())
+			}
+		}
+		sort.Strings(names)
+		return strings.Join(names, "\n")
+	default:
+		return fmt.Sprintf("error: unknown tool %q", name)
+	}
+}
@@ -0,0 +1,173 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// chatServer stands in for an OpenAI-compatible API. It answers each
+// request with the next of replies and records the requests it saw.
+func chatServer(t *testing.T, replies ...chatMessage) (*httptest.Server, *[]chatRequest, *[]*http.Request) {
+	t.Helper()
+	var bodies []chatRequest
+	var reqs []*http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+		var body chatRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bodies = append(bodies, body)
+		reqs = append(reqs, r)
+		if len(replies) == 0 {
+			http.Error(w, "no more replies", http.StatusInternalServerError)
+			return
+		}
+		reply := replies[0]
+		replies = replies[1:]
+		json.NewEncoder(w).Encode(map[string]any{
+			"choices": []map[string]any{{"message": reply}},
+			"usage":   map[string]int{"prompt_tokens": 100, "completion_tokens": 10},
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &bodies, &reqs
+}
+
+func callTool(id, name, arguments string) toolCall {
+	var c toolCall
+	c.ID, c.Type = id, "function"
+	c.Function.Name, c.Function.Arguments = name, arguments
+	return c
+}
+
+func TestHTTPProviderToolLoop(t *testing.T) {
+	srv, bodies, reqs := chatServer(t,
+		chatMessage{Role: "assistant", ToolCalls: []toolCall{
+			callTool("1", "read_file", `{"path": "README.md"}`),
+			callTool("2", "write_file", `{"path": "src/hello.txt", "content": "hello"}`),
+		}},
+		chatMessage{Role: "assistant", ToolCalls: []toolCall{callTool("3", "list_files", `{"path": "src"}`)}},
+		chatMessage{Role: "assistant", Content: "Wrote hello.txt"},
+	)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "README.md"), []byte("# demo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_HTTP_KEY", "secret")
+
+	p := NewHTTPProvider("local", HTTPSpec{BaseURL: srv.URL + "/v1/", Model: "qwen", APIKeyEnv: "TEST_HTTP_KEY"})
+	res, err := p.RunWithUsage(context.Background(), "say hello", dir, "", nil)
+	if err != nil {
+		t.Fatalf("RunWithUsage = %v", err)
+	}
+	out := res.Output
+	if res.Usage.InputTokens != 300 || res.Usage.OutputTokens != 30 {
+		t.Errorf("usage = %+v, want the three replies' tokens summed", res.Usage)
+	}
+	if !strings.Contains(out, "Wrote hello.txt") || !strings.Contains(out, "write_file") {
+		t.Errorf("output = %q, want the tool calls and final answer", out)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "src", "hello.txt"))
+	if err != nil || string(got) != "hello" {
+		t.Errorf("hello.txt = %q, %v; want hello", got, err)
+	}
+
+	if len(*bodies) != 3 {
+		t.Fatalf("requests = %d, want 3", len(*bodies))
+	}
+	if auth := (*reqs)[0].Header.Get("Authorization"); auth != "Bearer secret" {
+		t.Errorf("Authorization = %q, want Bearer secret", auth)
+	}
+	first := (*bodies)[0]
+	if first.Model != "qwen" || len(first.Tools) != len(fileTools) {
+		t.Errorf("first request = model %q with %d tools", first.Model, len(first.Tools))
+	}
+	second := (*bodies)[1].Messages
+	if n := len(second); n != 5 || second[3].Content != "# demo" || second[3].ToolCallID != "1" {
+		t.Errorf("second request messages = %+v, want the read_file result", second)
+	}
+	third := (*bodies)[2].Messages
+	if last := third[len(third)-1]; last.Content != "hello.txt" {
+		t.Errorf("list_files result = %q, want hello.txt", last.Content)
+	}
+}
+
+func TestHTTPProviderErrorStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "model not loaded", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	_, err := NewHTTPProvider("local", HTTPSpec{BaseURL: srv.URL}).Run(context.Background(), "hi", t.TempDir())
+	if err == nil || !strings.Contains(err.Error(), "503") || !strings.Contains(err.Error(), "model not loaded") {
+		t.Errorf("err = %v, want the status and body", err)
+	}
+}
+
+func TestHTTPProviderStaysInWorkDir(t *testing.T) {
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "work")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(parent, "secret"), []byte("hidden"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(parent, "secret"), filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	srv, bodies, _ := chatServer(t,
+		chatMessage{Role: "assistant", ToolCalls: []toolCall{
+			callTool("1", "read_file", `{"path": "../secret"}`),
+			callTool("2", "read_file", `{"path": "link"}`),
+		}},
+		chatMessage{Role: "assistant", Content: "done"},
+	)
+
+	if _, err := NewHTTPProvider("local", HTTPSpec{BaseURL: srv.URL + "/v1"}).Run(context.Background(), "hi", dir); err != nil {
+		t.Fatalf("Run = %v", err)
+	}
+	for _, m := range (*bodies)[1].Messages[3:] {
+		if strings.Contains(m.Content, "hidden") {
+			t.Errorf("tool %s read outside workDir: %q", m.ToolCallID, m.Content)
+		}
+	}
+}
+
+func TestHTTPProviderMaxTurns(t *testing.T) {
+	loop := chatMessage{Role: "assistant", ToolCalls: []toolCall{callTool("1", "list_files", `{}`)}}
+	srv, _, _ := chatServer(t, loop, loop, loop)
+
+	_, err := NewHTTPProvider("local", HTTPSpec{BaseURL: srv.URL + "/v1", MaxTurns: 2}).Run(context.Background(), "hi", t.TempDir())
+	if err == nil || !strings.Contains(err.Error(), "2 turns") {
+		t.Errorf("err = %v, want a turn limit error", err)
+	}
+}
+
+func TestHTTPProviderWithOptions(t *testing.T) {
+	p := NewHTTPProvider("local", HTTPSpec{BaseURL: "http://localhost", Model: "qwen"})
+	configured, err := p.WithOptions(RunOptions{Model: "llama"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := configured.(*HTTPProvider).Models(); len(got) != 1 || got[0] != "llama" {
+		t.Errorf("Models = %v, want [llama]", got)
+	}
+	if _, err := p.WithOptions(RunOptions{ExtraArgs: []string{"--x"}}); err == nil {
+		t.Error("expected error for extra args")
+	}
+	if err := (HTTPSpec{BaseURL: "http://x", Timeout: "soon"}).Validate(); err == nil {
+		t.Error("expected error for bad timeout")
+	}
+}
@@ -2,10 +2,15 @@ package provider
 
 import (
 	"context"
-	"fmt"
-	"os/exec"
+	"io"
 )
 
+var kimiCommand = CommandSpec{
+	Command:   "kimi",
+	Args:      []string{"--print", "-p", PromptPlaceholder, "--final-message-only"},
+	ModelArgs: []string{"--model", ModelPlaceholder},
+}
+
 type KimiProvider struct{}
 
 func (p *KimiProvider) Name() string {
@@ -13,11 +18,17 @@ func (p *KimiProvider) Name() string {
 }
 
 func (p *KimiProvider) Run(ctx context.Context, prompt string, workDir string) (string, error) {
-	cmd := exec.CommandContext(ctx, "kimi", "--print", "-p", prompt, "--final-message-only")
-	cmd.Dir = workDir
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return string(output), fmt.Errorf("kimi provider: %w\noutput: %s", err, output)
-	}
-	return string(output), nil
+	return kimiCommand.run(ctx, p.Name(), prompt, workDir, nil, nil)
+}
+
+func (p *KimiProvider) RunWithUsage(ctx context.Context, prompt string, workDir string, session string, out io.Writer) (Result, error) {
+	return kimiCommand.runSession(ctx, p.Name(), prompt, workDir, session, out)
+}
+
+func (p *KimiProvider) WithOptions(opts RunOptions) (Provider, error) {
+	return NewCommandProvider(p.Name(), kimiCommand).WithOptions(opts)
+}
+
+func (p *KimiProvider) Models() []string {
+	return kimiCommand.Models
 }
@@ -2,10 +2,14 @@ package provider
 
 import (
 	"context"
-	"fmt"
-	"os/exec"
+	"io"
 )
 
+var openCodeCommand = CommandSpec{
+	Command: "opencode",
+	Args:    []string{"-p", PromptPlaceholder, "-q", "-f", "text"},
+}
+
 type OpenCodeProvider struct{}
 
 func (p *OpenCodeProvider) Name() string {
@@ -13,11 +17,17 @@ func (p *OpenCodeProvider) Name() string {
 }
 
 func (p *OpenCodeProvider) Run(ctx context.Context, prompt string, workDir string) (string, error) {
-	cmd := exec.CommandContext(ctx, "opencode", "-p", prompt, "-q", "-f", "text")
-	cmd.Dir = workDir
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return string(output), fmt.Errorf("opencode provider: %w\noutput: %s", err, output)
-	}
-	return string(output), nil
+	return openCodeCommand.run(ctx, p.Name(), prompt, workDir, nil, nil)
+}
+
+func (p *OpenCodeProvider) RunWithUsage(ctx context.Context, prompt string, workDir string, session string, out io.Writer) (Result, error) {
+	return openCodeCommand.runSession(ctx, p.Name(), prompt, workDir, session, out)
+}
+
+func (p *OpenCodeProvider) WithOptions(opts RunOptions) (Provider, error) {
+	return NewCommandProvider(p.Name(), openCodeCommand).WithOptions(opts)
+}
+
+func (p *OpenCodeProvider) Models() []string {
+	return openCodeCommand.Models
 }
@@ -3,6 +3,7 @@ package provider
 import (
 	"context"
 	"fmt"
+	"slices"
 	"sort"
 	"strings"
 )
@@ -12,6 +13,22 @@ type Provider interface {
 	Run(ctx context.Context, prompt string, workDir string) (string, error)
 }
 
+// RunOptions are per-run settings passed on to a provider's command.
+type RunOptions struct {
+	Model     string
+	ExtraArgs []string
+}
+
+// ConfigurableProvider is a Provider whose model and command-line
+// arguments can be chosen.
+type ConfigurableProvider interface {
+	Provider
+	// WithOptions returns a copy of the provider that runs with opts.
+	WithOptions(opts RunOptions) (Provider, error)
+	// Models lists the model names the provider is known to accept.
+	Models() []string
+}
+
 type ProviderRegistry struct {
 	providers map[string]Provider
 }
@@ -40,13 +57,54 @@ func (r *ProviderRegistry) List() []string {
 	return names
 }
 
+// ProviderModels lists the models a provider is known to accept.
+type ProviderModels struct {
+	Provider string   `json:"provider"`
+	Models   []string `json:"models"`
+}
+
+// Models returns the known models of every registered provider, sorted by
+// provider name.
+func (r *ProviderRegistry) Models() []ProviderModels {
+	names := r.List()
+	out := make([]ProviderModels, len(names))
+	for i, name := range names {
+		out[i] = ProviderModels{Provider: name, Models: []string{}}
+		if cp, ok := r.providers[name].(ConfigurableProvider); ok && cp.Models() != nil {
+			out[i].Models = cp.Models()
+		}
+	}
+	return out
+}
+
 func FormatModels(available []string, configured string) string {
+	providers := make([]ProviderModels, len(available))
+	for i, name := range available {
+		providers[i] = ProviderModels{Provider: name}
+	}
+	return FormatProviderModels(providers, configured, "")
+}
+
+// FormatProviderModels is like FormatModels but also lists each provider's
+// known models, marking configuredModel under the configured provider.
+func FormatProviderModels(providers []ProviderModels, configured, configuredModel string) string {
 	var b strings.Builder
-	for _, name := range available {
-		if name == configured {
-			fmt.Fprintf(&b, "  * %s (configured)\n", name)
+	for _, p := range providers {
+		if p.Provider == configured {
+			fmt.Fprintf(&b, "  * %s (configured)\n", p.Provider)
 		} else {
-			fmt.Fprintf(&b, "  - %s\n", name)
+			fmt.Fprintf(&b, "  - %s\n", p.Provider)
+		}
+		models := p.Models
+		if p.Provider == configured && configuredModel != "" && !slices.Contains(models, configuredModel) {
+			models = append(slices.Clone(models), configuredModel)
+		}
+		for _, m := range models {
+			if p.Provider == configured && m == configuredModel {
+				fmt.Fprintf(&b, "      * %s (configured)\n", m)
+			} else {
+				fmt.Fprintf(&b, "      - %s\n", m)
+			}
 		}
 	}
 	return b.String()
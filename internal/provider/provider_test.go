@@ -83,3 +83,39 @@ func TestFormatModelsConfiguredNotInList(t *testing.T) {
 		t.Errorf("FormatModels() =\n%q\nwant\n%q", result, expected)
 	}
 }
+
+func TestRegistryModels(t *testing.T) {
+	registry := NewProviderRegistry()
+	registry.Register(&ClaudeProvider{})
+	registry.Register(&mockProvider{name: "mock"})
+
+	models := registry.Models()
+	if len(models) != 2 || models[0].Provider != "claude" || models[1].Provider != "mock" {
+		t.Fatalf("Models() = %+v", models)
+	}
+	if len(models[0].Models) == 0 {
+		t.Error("claude should list known models")
+	}
+	if models[1].Models == nil || len(models[1].Models) != 0 {
+		t.Errorf("mock models = %#v, want an empty list", models[1].Models)
+	}
+}
+
+func TestFormatProviderModels(t *testing.T) {
+	providers := []ProviderModels{
+		{Provider: "claude", Models: []string{"sonnet", "opus"}},
+		{Provider: "kimi"},
+	}
+	result := FormatProviderModels(providers, "claude", "opus")
+
+	expected := "  * claude (configured)\n      - sonnet\n      * opus (configured)\n  - kimi\n"
+	if result != expected {
+		t.Errorf("FormatProviderModels() =\n%q\nwant\n%q", result, expected)
+	}
+
+	result = FormatProviderModels(providers, "kimi", "kimi-latest")
+	expected = "  - claude\n      - sonnet\n      - opus\n  * kimi (configured)\n      * kimi-latest (configured)\n"
+	if result != expected {
+		t.Errorf("FormatProviderModels() =\n%q\nwant\n%q", result, expected)
+	}
+}
@@ -0,0 +1,530 @@
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/tmdgusya/do-more/internal/git"
+)
+
+// recording is one provider run kept in a cassette: what the provider was
+// asked, what it answered and what it changed in the work directory. The
+// changes are a diff when the work directory is a git repository, and the
+// final content of each changed file otherwise.
+type recording struct {
+	Provider string       `json:"provider"`
+	Prompt   string       `json:"prompt"`
+	Output   string       `json:"output"`
+	Error    string       `json:"error,omitempty"`
+	Session  string       `json:"session,omitempty"`
+	Usage    Usage        `json:"usage,omitzero"`
+	Diff     string       `json:"diff,omitempty"`
+	Changes  []fileChange `json:"changes,omitempty"`
+}
+
+// fileChange is the state a run left one file in, relative to the work
+// directory. Content that is not valid UTF-8 is stored base64-encoded.
+type fileChange struct {
+	Path       string `json:"path"`
+	Deleted    bool   `json:"deleted,omitempty"`
+	Content    string `json:"content,omitempty"`
+	Base64     bool   `json:"base64,omitempty"`
+	Executable bool   `json:"executable,omitempty"`
+}
+
+func newFileChange(path string, data []byte, executable bool) fileChange {
+	c := fileChange{Path: path, Executable: executable}
+	if utf8.Valid(data) {
+		c.Content = string(data)
+	} else {
+		c.Content = base64.StdEncoding.EncodeToString(data)
+		c.Base64 = true
+	}
+	return c
+}
+
+func (c fileChange) data() ([]byte, error) {
+	if c.Base64 {
+		return base64.StdEncoding.DecodeString(c.Content)
+	}
+	return []byte(c.Content), nil
+}
+
+// Recorder writes the runs of the providers it wraps to a cassette
+// directory, one numbered JSON file per run, for a Cassette to replay.
+type Recorder struct {
+	dir     string
+	exclude []string
+	mu      sync.Mutex
+	next    int
+}
+
+// NewRecorder returns a recorder that writes to dir, creating it if
+// needed. Runs already recorded there are kept and new ones follow them.
+// Changes to the files and directories in exclude, relative to the work
+// directory, are not recorded; neither are .git and .do-more.
+func NewRecorder(dir string, exclude ...string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating cassette: %w", err)
+	}
+	files, err := cassetteFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	exclude = append([]string{".do-more"}, exclude...)
+	for i, p := range exclude {
+		exclude[i] = filepath.ToSlash(filepath.Clean(p))
+	}
+	return &Recorder{dir: dir, exclude: exclude, next: len(files) + 1}, nil
+}
+
+// Wrap returns a provider that runs p and records each run.
+func (r *Recorder) Wrap(p Provider) Provider {
+	return &recordingProvider{inner: p, rec: r}
+}
+
+func (r *Recorder) save(rec recording) error {
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	name := filepath.Join(r.dir, fmt.Sprintf("%04d.json", r.next))
+	if err := os.WriteFile(name, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("recording run: %w", err)
+	}
+	r.next++
+	return nil
+}
+
+type recordingProvider struct {
+	inner Provider
+	rec   *Recorder
+}
+
+func (p *recordingProvider) Name() string {
+	return p.inner.Name()
+}
+
+func (p *recordingProvider) Run(ctx context.Context, prompt string, workDir string) (string, error) {
+	res, err := p.RunWithUsage(ctx, prompt, workDir, "", nil)
+	return res.Output, err
+}
+
+// RunWithUsage runs the wrapped provider and records the run along with
+// the files it changed in workDir. Runs cut short by ctx are not recorded,
+// since they would not happen the same way again.
+func (p *recordingProvider) RunWithUsage(ctx context.Context, prompt string, workDir string, session string, out io.Writer) (Result, error) {
+	before, err := p.rec.capture(ctx, workDir)
+	if err != nil {
+		return Result{}, fmt.Errorf("%s provider: %w", p.Name(), err)
+	}
+	res, runErr := Invoke(ctx, p.inner, prompt, workDir, session, out)
+	if ctx.Err() != nil {
+		return res, runErr
+	}
+	rec := recording{
+		Provider: p.Name(),
+		Prompt:   prompt,
+		Output:   res.Output,
+		Session:  res.Session,
+		Usage:    res.Usage,
+	}
+	if err := p.rec.changes(ctx, workDir, before, &rec); err != nil {
+		return res, fmt.Errorf("%s provider: %w", p.Name(), err)
+	}
+	if runErr != nil {
+		rec.Error = runErr.Error()
+	}
+	if err := p.rec.save(rec); err != nil {
+		return res, fmt.Errorf("%s provider: %w", p.Name(), err)
+	}
+	return res, runErr
+}
+
+// workState is the state of a work directory before a run: the tree git
+// would commit for it when it is in a repository, or the state of each of
+// its files otherwise.
+type workState struct {
+	tree  string
+	files map[string]fileState
+}
+
+func (r *Recorder) capture(ctx context.Context, dir string) (workState, error) {
+	if git.IsRepo(ctx, dir) {
+		tree, err := r.treeHash(ctx, dir)
+		return workState{tree: tree}, err
+	}
+	files, err := snapshot(dir, r.exclude)
+	return workState{files: files}, err
+}
+
+// changes fills in rec with what changed in dir since before: a diff
+// between the two trees in a repository, the changed files otherwise.
+func (r *Recorder) changes(ctx context.Context, dir string, before workState, rec *recording) error {
+	if before.tree == "" {
+		changes, err := changedFiles(dir, before.files, r.exclude)
+		rec.Changes = changes
+		return err
+	}
+	after, err := r.treeHash(ctx, dir)
+	if err != nil || after == before.tree {
+		return err
+	}
+	rec.Diff, err = git.DiffTrees(ctx, dir, before.tree, after)
+	return err
+}
+
+// treeHash returns the tree of dir, untracked files included, without the
+// excluded paths. It does not touch the index or the working tree.
+func (r *Recorder) treeHash(ctx context.Context, dir string) (string, error) {
+	prefix, err := git.Run(ctx, dir, "rev-parse", "--show-prefix")
+	if err != nil {
+		return "", err
+	}
+	exclude := make([]string, len(r.exclude))
+	for i, p := range r.exclude {
+		exclude[i] = path.Join(prefix, p)
+	}
+	return git.TreeHash(ctx, dir, exclude...)
+}
+
+// WithOptions configures the wrapped provider and keeps recording it.
+func (p *recordingProvider) WithOptions(opts RunOptions) (Provider, error) {
+	cp, ok := p.inner.(ConfigurableProvider)
+	if !ok {
+		if opts.Model == "" && len(opts.ExtraArgs) == 0 {
+			return p, nil
+		}
+		return nil, fmt.Errorf("%s provider does not take a model or extra arguments", p.Name())
+	}
+	configured, err := cp.WithOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingProvider{inner: configured, rec: p.rec}, nil
+}
+
+func (p *recordingProvider) Models() []string {
+	if cp, ok := p.inner.(ConfigurableProvider); ok {
+		return cp.Models()
+	}
+	return nil
+}
+
+// Cassette holds the runs recorded in a cassette directory. Each recorded
+// run is replayed at most once.
+type Cassette struct {
+	dir   string
+	mu    sync.Mutex
+	files []string
+	runs  []recording
+	used  []bool
+}
+
+// LoadCassette reads the runs a Recorder wrote to dir.
+func LoadCassette(dir string) (*Cassette, error) {
+	files, err := cassetteFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no recorded runs in %s", dir)
+	}
+	c := &Cassette{dir: dir, files: files, runs: make([]recording, len(files)), used: make([]bool, len(files))}
+	for i, name := range files {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("reading cassette: %w", err)
+		}
+		if err := json.Unmarshal(data, &c.runs[i]); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", name, err)
+		}
+	}
+	return c, nil
+}
+
+// Providers returns the names of the providers with recorded runs.
+func (c *Cassette) Providers() []string {
+	var names []string
+	for _, run := range c.runs {
+		if !slices.Contains(names, run.Provider) {
+			names = append(names, run.Provider)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Provider returns a provider called name that replays the runs recorded
+// for name.
+func (c *Cassette) Provider(name string) *ReplayProvider {
+	return &ReplayProvider{name: name, cassette: c}
+}
+
+// take claims the recorded run to replay for prompt: the first unused run
+// of provider with the same prompt or, failing that, the next unused run of
+// provider in recorded order. The returned note explains a mismatch.
+func (c *Cassette) take(provider, prompt string) (recording, string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	next := -1
+	for i, run := range c.runs {
+		if c.used[i] || run.Provider != provider {
+			continue
+		}
+		if run.Prompt == prompt {
+			c.used[i] = true
+			return run, "", true
+		}
+		if next < 0 {
+			next = i
+		}
+	}
+	if next < 0 {
+		return recording{}, "", false
+	}
+	c.used[next] = true
+	line := firstDifference(c.runs[next].Prompt, prompt)
+	return c.runs[next], fmt.Sprintf("[replay] prompt differs from recorded run %s at line %d", c.files[next], line), true
+}
+
+// ReplayProvider plays back runs recorded by a Recorder. Instead of asking
+// a model, it writes the recorded files into workDir and returns the
+// recorded output, session, usage and error.
+type ReplayProvider struct {
+	name     string
+	cassette *Cassette
+}
+
+func (p *ReplayProvider) Name() string {
+	return p.name
+}
+
+func (p *ReplayProvider) Run(ctx context.Context, prompt string, workDir string) (string, error) {
+	res, err := p.RunWithUsage(ctx, prompt, workDir, "", nil)
+	return res.Output, err
+}
+
+// RunWithUsage replays the recorded run that matches prompt. A prompt that
+// matches no recording replays the next run in order, with a note in the
+// output saying where the prompts part.
+func (p *ReplayProvider) RunWithUsage(ctx context.Context, prompt string, workDir string, session string, out io.Writer) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+	run, note, ok := p.cassette.take(p.name, prompt)
+	if !ok {
+		return Result{}, fmt.Errorf("%s provider: no recorded runs left in %s", p.name, p.cassette.dir)
+	}
+	if err := applyDiff(ctx, workDir, run.Diff); err != nil {
+		return Result{}, fmt.Errorf("%s provider: %w", p.name, err)
+	}
+	if err := applyChanges(workDir, run.Changes); err != nil {
+		return Result{}, fmt.Errorf("%s provider: %w", p.name, err)
+	}
+	res := Result{Output: run.Output, Session: run.Session, Usage: run.Usage}
+	if note != "" {
+		res.Output = note + "\n" + res.Output
+	}
+	if out != nil {
+		io.WriteString(out, res.Output)
+	}
+	if run.Error != "" {
+		return res, errors.New(run.Error)
+	}
+	return res, nil
+}
+
+// WithOptions returns p unchanged: the recorded runs already reflect the
+// options they were made with.
+func (p *ReplayProvider) WithOptions(opts RunOptions) (Provider, error) {
+	return p, nil
+}
+
+func (p *ReplayProvider) Models() []string {
+	return nil
+}
+
+// cassetteFiles lists the recorded runs in dir in order.
+func cassetteFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading cassette: %w", err)
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, e.Name())
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// fileState identifies the content of a file and whether it is executable.
+type fileState struct {
+	sum        [sha256.Size]byte
+	executable bool
+}
+
+// snapshot returns the state of every regular file under dir, leaving out
+// git metadata and the files and directories in exclude.
+func snapshot(dir string, exclude []string) (map[string]fileState, error) {
+	files := make(map[string]fileState)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.Name() == ".git" || slices.Contains(exclude, rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files[rel] = fileState{sum: sha256.Sum256(data), executable: info.Mode()&0111 != 0}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading work directory: %w", err)
+	}
+	return files, nil
+}
+
+// changedFiles compares dir with an earlier snapshot and returns the files
+// created, modified or deleted since, sorted by path.
+func changedFiles(dir string, before map[string]fileState, exclude []string) ([]fileChange, error) {
+	after, err := snapshot(dir, exclude)
+	if err != nil {
+		return nil, err
+	}
+	var changes []fileChange
+	for name, state := range after {
+		if old, ok := before[name]; ok && old == state {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			return nil, fmt.Errorf("reading work directory: %w", err)
+		}
+		changes = append(changes, newFileChange(name, data, state.executable))
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			changes = append(changes, fileChange{Path: name, Deleted: true})
+		}
+	}
+	slices.SortFunc(changes, func(a, b fileChange) int { return strings.Compare(a.Path, b.Path) })
+	return changes, nil
+}
+
+// applyDiff applies a diff recorded in a repository to dir, which need not
+// be one.
+func applyDiff(ctx context.Context, dir, diff string) error {
+	if diff == "" {
+		return nil
+	}
+	f, err := os.CreateTemp("", "do-more-replay-*.diff")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(diff); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return git.Apply(ctx, dir, f.Name())
+}
+
+// applyChanges brings the files in changes to their recorded state inside
+// dir. Paths cannot reach outside dir.
+func applyChanges(dir string, changes []fileChange) error {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	for _, c := range changes {
+		file := path.Clean("/" + c.Path)[1:]
+		if file == "" {
+			return fmt.Errorf("invalid path %q in recording", c.Path)
+		}
+		if c.Deleted {
+			if err := root.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+		data, err := c.data()
+		if err != nil {
+			return fmt.Errorf("decoding %s: %w", c.Path, err)
+		}
+		if dir := path.Dir(file); dir != "." {
+			if err := root.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+		}
+		mode := os.FileMode(0644)
+		if c.Executable {
+			mode = 0755
+		}
+		if err := root.WriteFile(file, data, mode); err != nil {
+			return err
+		}
+		if err := root.Chmod(file, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// firstDifference returns the number of the first line where a and b
+// differ.
+func firstDifference(a, b string) int {
+	al := strings.Split(a, "\n")
+	bl := strings.Split(b, "\n")
+	for i := range min(len(al), len(bl)) {
+		if al[i] != bl[i] {
+			return i + 1
+		}
+	}
+	return min(len(al), len(bl)) + 1
+}
+
+var _ UsageProvider = (*ReplayProvider)(nil)
+var _ ConfigurableProvider = (*ReplayProvider)(nil)
+var _ UsageProvider = (*recordingProvider)(nil)
+var _ ConfigurableProvider = (*recordingProvider)(nil)
@@ -0,0 +1,182 @@
+package provider
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tmdgusya/do-more/internal/git"
+)
+
+// editor is a provider that changes files in its work directory.
+var editor = CommandSpec{
+	Command: "sh",
+	Args: []string{"-c", `printf 'new\n' > added.txt
+printf 'changed\n' > edit.txt
+rm gone.txt
+mkdir -p bin && printf '#!/bin/sh\n' > bin/run && chmod +x bin/run
+printf '\377\000' > blob
+echo "did $1"`, "sh", PromptPlaceholder},
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	cassette := t.TempDir()
+	rec, err := NewRecorder(cassette)
+	if err != nil {
+		t.Fatalf("NewRecorder failed: %v", err)
+	}
+	recorded := t.TempDir()
+	writeFiles(t, recorded, map[string]string{"edit.txt": "old\n", "gone.txt": "x", "same.txt": "same"})
+	p := rec.Wrap(NewCommandProvider("editor", editor))
+	output, err := p.Run(context.Background(), "the task", recorded)
+	if err != nil || output != "did the task\n" {
+		t.Fatalf("Run = %q, %v", output, err)
+	}
+
+	c, err := LoadCassette(cassette)
+	if err != nil {
+		t.Fatalf("LoadCassette failed: %v", err)
+	}
+	if got := c.Providers(); len(got) != 1 || got[0] != "editor" {
+		t.Errorf("Providers = %v, want [editor]", got)
+	}
+	replayed := t.TempDir()
+	writeFiles(t, replayed, map[string]string{"edit.txt": "old\n", "gone.txt": "x", "same.txt": "same"})
+	var live strings.Builder
+	res, err := c.Provider("editor").RunWithUsage(context.Background(), "the task", replayed, "", &live)
+	if err != nil || res.Output != "did the task\n" || live.String() != res.Output {
+		t.Fatalf("replay = %+v, %v, streamed %q", res, err, live.String())
+	}
+
+	checkReplayed(t, recorded, replayed)
+
+	if _, err := c.Provider("editor").Run(context.Background(), "the task", replayed); err == nil {
+		t.Error("expected an error once the recorded runs are used up")
+	}
+}
+
+// checkReplayed checks that replayed holds what editor left in recorded.
+func checkReplayed(t *testing.T, recorded, replayed string) {
+	t.Helper()
+	for _, name := range []string{"added.txt", "edit.txt", "same.txt", "bin/run", "blob"} {
+		want, _ := os.ReadFile(filepath.Join(recorded, name))
+		got, err := os.ReadFile(filepath.Join(replayed, name))
+		if err != nil || string(got) != string(want) {
+			t.Errorf("%s = %q, %v, want %q", name, got, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(replayed, "gone.txt")); !os.IsNotExist(err) {
+		t.Errorf("gone.txt was not deleted: %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(replayed, "bin/run")); err != nil || info.Mode()&0111 == 0 {
+		t.Errorf("bin/run is not executable: %v", err)
+	}
+}
+
+func TestRecordInRepository(t *testing.T) {
+	ctx := context.Background()
+	recorded := t.TempDir()
+	files := map[string]string{"edit.txt": "old\n", "gone.txt": "x", "same.txt": "same", ".gitignore": "build/\n"}
+	writeFiles(t, recorded, files)
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "."},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "initial"},
+	} {
+		if _, err := git.Run(ctx, recorded, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFiles(t, recorded, map[string]string{"do-more.json": "{}"})
+
+	cassette := t.TempDir()
+	rec, err := NewRecorder(cassette, "do-more.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := editor
+	spec.Args = slices.Clone(editor.Args)
+	spec.Args[1] += "\necho '{\"changed\": true}' > do-more.json\nmkdir build && echo out > build/out"
+	if _, err := rec.Wrap(NewCommandProvider("editor", spec)).Run(ctx, "the task", recorded); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := LoadCassette(cassette)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := c.runs[0]
+	if run.Diff == "" || run.Changes != nil {
+		t.Fatalf("recorded diff %q and changes %v, want just a diff", run.Diff, run.Changes)
+	}
+	for _, name := range []string{"do-more.json", "build/out", "same.txt"} {
+		if strings.Contains(run.Diff, name) {
+			t.Errorf("diff mentions %s:\n%s", name, run.Diff)
+		}
+	}
+
+	replayed := t.TempDir()
+	writeFiles(t, replayed, files)
+	if _, err := c.Provider("editor").Run(ctx, "the task", replayed); err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+	checkReplayed(t, recorded, replayed)
+}
+
+func TestReplayPromptMismatch(t *testing.T) {
+	cassette := t.TempDir()
+	rec, err := NewRecorder(cassette)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing := rec.Wrap(NewCommandProvider("flaky", CommandSpec{Command: "sh", Args: []string{"-c", "echo first; exit 2", "sh"}}))
+	if _, err := failing.Run(context.Background(), "step one\nfix it", t.TempDir()); err == nil {
+		t.Fatal("expected the recorded run to fail")
+	}
+
+	c, err := LoadCassette(cassette)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := c.Provider("flaky").Run(context.Background(), "step one\nfix it now", t.TempDir())
+	if err == nil || !strings.Contains(err.Error(), "exit status 2") {
+		t.Errorf("error = %v, want the recorded failure", err)
+	}
+	want := "[replay] prompt differs from recorded run 0001.json at line 2\nfirst\n"
+	if output != want {
+		t.Errorf("output = %q, want %q", output, want)
+	}
+
+	if _, err := LoadCassette(t.TempDir()); err == nil {
+		t.Error("expected an error for an empty cassette")
+	}
+}
+
+func TestRecorderContinuesNumbering(t *testing.T) {
+	cassette := t.TempDir()
+	for range 2 {
+		rec, err := NewRecorder(cassette)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rec.Wrap(&mockProvider{name: "mock", output: "ok"}).Run(context.Background(), "x", t.TempDir()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := cassetteFiles(cassette)
+	if err != nil || strings.Join(files, " ") != "0001.json 0002.json" {
+		t.Errorf("cassette files = %v, %v", files, err)
+	}
+}
@@ -0,0 +1,109 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Usage is what one or more provider runs consumed. Providers that cannot
+// tell leave the token counts and cost at zero.
+type Usage struct {
+	InputTokens  int     `json:"inputTokens,omitempty"`
+	OutputTokens int     `json:"outputTokens,omitempty"`
+	CostUSD      float64 `json:"costUsd,omitempty"`
+	DurationMs   int64   `json:"durationMs,omitempty"`
+}
+
+// Add adds o to u.
+func (u *Usage) Add(o Usage) {
+	u.InputTokens += o.InputTokens
+	u.OutputTokens += o.OutputTokens
+	u.CostUSD += o.CostUSD
+	u.DurationMs += o.DurationMs
+}
+
+// Tokens returns the input and output tokens together.
+func (u Usage) Tokens() int {
+	return u.InputTokens + u.OutputTokens
+}
+
+// Reported reports whether a provider counted any tokens or cost, rather
+// than only the time it took.
+func (u Usage) Reported() bool {
+	return u.Tokens() > 0 || u.CostUSD > 0
+}
+
+// Duration returns the time spent running providers.
+func (u Usage) Duration() time.Duration {
+	return time.Duration(u.DurationMs) * time.Millisecond
+}
+
+// String renders u for the terminal, e.g.
+// "12,345 input / 678 output tokens, $0.42, 3m20s". Token counts and cost
+// are left out when no provider reported them.
+func (u Usage) String() string {
+	var parts []string
+	if u.Tokens() > 0 {
+		parts = append(parts, fmt.Sprintf("%s input / %s output tokens", groupDigits(u.InputTokens), groupDigits(u.OutputTokens)))
+	}
+	if u.CostUSD > 0 {
+		parts = append(parts, fmt.Sprintf("$%.2f", u.CostUSD))
+	}
+	parts = append(parts, u.Duration().Round(time.Second).String())
+	return strings.Join(parts, ", ")
+}
+
+// groupDigits formats n with a comma between each group of three digits.
+func groupDigits(n int) string {
+	s := strconv.Itoa(n)
+	start := 0
+	if n < 0 {
+		start = 1
+	}
+	for i := len(s) - 3; i > start; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
+
+// Result is the outcome of a provider run: its output, the session to
+// continue next time if any, and what the run consumed.
+type Result struct {
+	Output  string
+	Session string
+	Usage   Usage
+}
+
+// UsageProvider is a Provider that can stream its output, continue the
+// conversation of an earlier run and report what each run consumed.
+// RunWithUsage continues session, or starts a new one when session is
+// empty, and returns the session to continue next time in the result; that
+// is "" when the provider cannot resume. Output is copied to out as it
+// arrives when out is not nil.
+type UsageProvider interface {
+	Provider
+	RunWithUsage(ctx context.Context, prompt string, workDir string, session string, out io.Writer) (Result, error)
+}
+
+// Invoke runs p on prompt in workDir, through RunWithUsage when p is a
+// UsageProvider and through Run otherwise, in which case session and out
+// are unused. The result's usage always includes how long p ran, even when
+// p reports nothing else.
+func Invoke(ctx context.Context, p Provider, prompt, workDir, session string, out io.Writer) (Result, error) {
+	start := time.Now()
+	var res Result
+	var err error
+	if up, ok := p.(UsageProvider); ok {
+		res, err = up.RunWithUsage(ctx, prompt, workDir, session, out)
+	} else {
+		res.Output, err = p.Run(ctx, prompt, workDir)
+	}
+	if res.Usage.DurationMs == 0 {
+		res.Usage.DurationMs = time.Since(start).Milliseconds()
+	}
+	return res, err
+}
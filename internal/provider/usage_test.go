@@ -0,0 +1,18 @@
+package provider
+
+import "testing"
+
+func TestUsageString(t *testing.T) {
+	var u Usage
+	u.Add(Usage{InputTokens: 12000, OutputTokens: 345, CostUSD: 0.3, DurationMs: 60_000})
+	u.Add(Usage{InputTokens: 345, CostUSD: 0.12, DurationMs: 2_400})
+	if got, want := u.String(), "12,345 input / 345 output tokens, $0.42, 1m2s"; got != want {
+		t.Errorf("String = %q, want %q", got, want)
+	}
+	if got, want := (Usage{DurationMs: 5_000}).String(), "5s"; got != want {
+		t.Errorf("String without tokens = %q, want %q", got, want)
+	}
+	if got := groupDigits(1234567); got != "1,234,567" {
+		t.Errorf("groupDigits = %q", got)
+	}
+}
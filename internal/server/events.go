@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/tmdgusya/do-more/internal/loop"
+	"github.com/tmdgusya/do-more/internal/provider"
 )
 
 const (
@@ -19,9 +20,14 @@ const (
 	EventIterationStarted = "iteration_started"
 	EventProviderInvoked  = "provider_invoked"
 	EventProviderFinished = "provider_finished"
+	EventProviderSwitched = "provider_switched"
+	EventProviderOutput   = "provider_output"
+	EventUsage            = "usage"
+	EventBudgetReached    = "budget_reached"
 	EventGateResult       = "gate_result"
 	EventTaskDone         = "task_done"
 	EventTaskFailed       = "task_failed"
+	EventTaskBlocked      = "task_blocked"
 	EventLogMessage       = "log_message"
 )
 
@@ -57,9 +63,10 @@ func NewEventHub() *EventHub {
 }
 
 // Subscribe creates and returns a buffered channel that will receive
-// broadcast events. The caller must call Unsubscribe when done.
+// broadcast events. The caller must call Unsubscribe when done. The buffer
+// leaves room for bursts of provider output.
 func (h *EventHub) Subscribe() chan Event {
-	ch := make(chan Event, 64)
+	ch := make(chan Event, 256)
 	h.mu.Lock()
 	h.subscribers[ch] = struct{}{}
 	h.mu.Unlock()
@@ -88,7 +95,8 @@ func (h *EventHub) Broadcast(event Event) {
 	}
 }
 
-var _ loop.Logger = (*EventLogger)(nil)
+var _ loop.OutputLogger = (*EventLogger)(nil)
+var _ loop.UsageLogger = (*EventLogger)(nil)
 
 // EventLogger implements loop.Logger. It prints to stdout (preserving
 // CLI output) and emits structured events by parsing known log patterns.
@@ -109,6 +117,32 @@ func (l *EventLogger) Log(format string, args ...any) {
 	l.hub.Broadcast(event)
 }
 
+// ProviderOutput prints a line of provider output and emits it as a
+// provider_output event.
+func (l *EventLogger) ProviderOutput(taskID string, line string) {
+	fmt.Printf("  #%s │ %s\n", taskID, line)
+	l.hub.Broadcast(Event{
+		Type:      EventProviderOutput,
+		TaskID:    taskID,
+		Data:      map[string]any{"line": line},
+		Timestamp: time.Now(),
+	})
+}
+
+// Usage prints what a provider run consumed and emits it, with the run's
+// total so far, as a usage event.
+func (l *EventLogger) Usage(taskID string, used, runTotal provider.Usage) {
+	if used.Reported() {
+		fmt.Printf("[do-more] Task #%s: used %s (run total %s)\n", taskID, used, runTotal)
+	}
+	l.hub.Broadcast(Event{
+		Type:      EventUsage,
+		TaskID:    taskID,
+		Data:      map[string]any{"used": used, "run": runTotal},
+		Timestamp: time.Now(),
+	})
+}
+
 func parseLogMessage(msg string) Event {
 	var iter, maxIter int
 	var taskID, title string
@@ -129,9 +163,22 @@ func parseLogMessage(msg string) Event {
 
 	if strings.HasPrefix(msg, "Invoking ") && strings.HasSuffix(msg, "...") {
 		providerName := strings.TrimSuffix(strings.TrimPrefix(msg, "Invoking "), "...")
+		data := map[string]any{"provider": providerName}
+		if name, session, ok := strings.Cut(providerName, " (continuing session "); ok {
+			data["provider"] = name
+			data["session"] = strings.TrimSuffix(session, ")")
+		}
 		return Event{
 			Type: EventProviderInvoked,
-			Data: map[string]any{"provider": providerName},
+			Data: data,
+		}
+	}
+
+	if strings.HasPrefix(msg, "Budget reached (") {
+		reason, _, _ := strings.Cut(strings.TrimPrefix(msg, "Budget reached ("), "): ")
+		return Event{
+			Type: EventBudgetReached,
+			Data: map[string]any{"reason": reason, "message": msg},
 		}
 	}
 
@@ -155,6 +202,18 @@ func parseLogMessage(msg string) Event {
 		}
 	}
 
+	if strings.HasPrefix(msg, "Task #") && strings.HasSuffix(msg, ")") {
+		if id, rest, ok := strings.Cut(strings.TrimPrefix(msg, "Task #"), ": switching provider from "); ok {
+			from, rest, _ := strings.Cut(rest, " to ")
+			to, reason, _ := strings.Cut(rest, " (")
+			return Event{
+				Type:   EventProviderSwitched,
+				TaskID: id,
+				Data:   map[string]any{"from": from, "to": to, "reason": strings.TrimSuffix(reason, ")")},
+			}
+		}
+	}
+
 	if strings.HasPrefix(msg, "Task #") && strings.HasSuffix(msg, ": done") {
 		id := strings.TrimSuffix(strings.TrimPrefix(msg, "Task #"), ": done")
 		return Event{
@@ -163,10 +222,20 @@ func parseLogMessage(msg string) Event {
 		}
 	}
 
-	if strings.HasPrefix(msg, "Task #") && strings.HasSuffix(msg, ": failed (max iterations reached)") {
-		id := strings.TrimSuffix(strings.TrimPrefix(msg, "Task #"), ": failed (max iterations reached)")
+	if strings.HasPrefix(msg, "Task #") && strings.HasSuffix(msg, ")") {
+		if id, reason, ok := strings.Cut(strings.TrimPrefix(msg, "Task #"), ": failed ("); ok {
+			return Event{
+				Type:   EventTaskFailed,
+				TaskID: id,
+				Data:   map[string]any{"reason": strings.TrimSuffix(reason, ")")},
+			}
+		}
+	}
+
+	if strings.HasPrefix(msg, "Task #") && strings.HasSuffix(msg, ": blocked (dependency failed)") {
+		id := strings.TrimSuffix(strings.TrimPrefix(msg, "Task #"), ": blocked (dependency failed)")
 		return Event{
-			Type:   EventTaskFailed,
+			Type:   EventTaskBlocked,
 			TaskID: id,
 		}
 	}
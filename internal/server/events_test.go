@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"testing"
 	"time"
+
+	"github.com/tmdgusya/do-more/internal/provider"
 )
 
 func TestEventHubFanOut(t *testing.T) {
@@ -134,6 +136,16 @@ func TestEventLoggerParsing(t *testing.T) {
 				}
 			},
 		},
+		{
+			name:     "provider invoked with session",
+			msg:      "Invoking claude (continuing session 1b4e28ba-2fa1-4d2e-8b5c-0c3e4e0a6f9d)...",
+			wantType: EventProviderInvoked,
+			checkFn: func(t *testing.T, e Event) {
+				if e.Data["provider"] != "claude" || e.Data["session"] != "1b4e28ba-2fa1-4d2e-8b5c-0c3e4e0a6f9d" {
+					t.Errorf("data = %v", e.Data)
+				}
+			},
+		},
 		{
 			name:     "provider finished",
 			msg:      "Provider finished",
@@ -177,6 +189,36 @@ func TestEventLoggerParsing(t *testing.T) {
 			wantType: EventTaskFailed,
 			wantID:   "7",
 		},
+		{
+			name:     "provider switched",
+			msg:      "Task #4: switching provider from claude to opencode (provider error)",
+			wantType: EventProviderSwitched,
+			wantID:   "4",
+			checkFn: func(t *testing.T, e Event) {
+				if e.Data["from"] != "claude" || e.Data["to"] != "opencode" {
+					t.Errorf("from/to = %v/%v, want claude/opencode", e.Data["from"], e.Data["to"])
+				}
+				if e.Data["reason"] != "provider error" {
+					t.Errorf("reason = %v, want 'provider error'", e.Data["reason"])
+				}
+			},
+		},
+		{
+			name:     "budget reached",
+			msg:      "Budget reached (cost $5.02 of $5.00): no new iterations will start",
+			wantType: EventBudgetReached,
+			checkFn: func(t *testing.T, e Event) {
+				if e.Data["reason"] != "cost $5.02 of $5.00" {
+					t.Errorf("reason = %v, want 'cost $5.02 of $5.00'", e.Data["reason"])
+				}
+			},
+		},
+		{
+			name:     "task blocked",
+			msg:      "Task #8: blocked (dependency failed)",
+			wantType: EventTaskBlocked,
+			wantID:   "8",
+		},
 		{
 			name:     "provider error becomes log message",
 			msg:      "Provider error: context canceled",
@@ -220,6 +262,42 @@ func TestEventLoggerParsing(t *testing.T) {
 	}
 }
 
+func TestEventLoggerProviderOutput(t *testing.T) {
+	hub := NewEventHub()
+	ch := hub.Subscribe()
+	defer hub.Unsubscribe(ch)
+
+	NewEventLogger(hub).ProviderOutput("3", "Editing main.go")
+
+	select {
+	case got := <-ch:
+		if got.Type != EventProviderOutput || got.TaskID != "3" || got.Data["line"] != "Editing main.go" {
+			t.Errorf("event = %+v", got)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("timed out waiting for provider_output event")
+	}
+}
+
+func TestEventLoggerUsage(t *testing.T) {
+	hub := NewEventHub()
+	ch := hub.Subscribe()
+	defer hub.Unsubscribe(ch)
+
+	used := provider.Usage{InputTokens: 10, OutputTokens: 5, CostUSD: 0.1, DurationMs: 1000}
+	runTotal := provider.Usage{InputTokens: 30, OutputTokens: 15, CostUSD: 0.3, DurationMs: 3000}
+	NewEventLogger(hub).Usage("3", used, runTotal)
+
+	select {
+	case got := <-ch:
+		if got.Type != EventUsage || got.TaskID != "3" || got.Data["used"] != used || got.Data["run"] != runTotal {
+			t.Errorf("event = %+v", got)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("timed out waiting for usage event")
+	}
+}
+
 func TestEventJSON(t *testing.T) {
 	event := Event{
 		Type:      EventTaskDone,
@@ -4,14 +4,20 @@ import (
 	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"net/http"
+	"slices"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/tmdgusya/do-more/internal/config"
+	"github.com/tmdgusya/do-more/internal/gate"
+	"github.com/tmdgusya/do-more/internal/history"
 	"github.com/tmdgusya/do-more/internal/loop"
 	"github.com/tmdgusya/do-more/internal/provider"
 )
@@ -19,6 +25,8 @@ import (
 //go:embed static/*
 var staticFiles embed.FS
 
+var errSkipped = errors.New("skipped by user via dashboard")
+
 type Server struct {
 	mu          sync.Mutex
 	cfgPath     string
@@ -26,6 +34,8 @@ type Server struct {
 	registry    *provider.ProviderRegistry
 	loopRunning bool
 	loopCancel  context.CancelFunc
+	loopStart   time.Time
+	workers     map[string]context.CancelCauseFunc
 	loopWg      sync.WaitGroup
 	hub         *EventHub
 	mux         *http.ServeMux
@@ -52,9 +62,12 @@ func NewServer(cfgPath string, workDir string, registry *provider.ProviderRegist
 	mux.HandleFunc("GET /api/config", s.handleGetConfig)
 	mux.HandleFunc("PUT /api/config", s.handleUpdateConfig)
 	mux.HandleFunc("GET /api/providers", s.handleGetProviders)
+	mux.HandleFunc("GET /api/models", s.handleGetModels)
 	mux.HandleFunc("POST /api/tasks", s.handleCreateTask)
 	mux.HandleFunc("PUT /api/tasks/{id}", s.handleUpdateTask)
 	mux.HandleFunc("DELETE /api/tasks/{id}", s.handleDeleteTask)
+	mux.HandleFunc("GET /api/tasks/{id}/history", s.handleTaskHistory)
+	mux.HandleFunc("GET /api/runs", s.handleGetRuns)
 	mux.HandleFunc("GET /api/events", s.handleSSE)
 	mux.HandleFunc("POST /api/loop/start", s.handleLoopStart)
 	mux.HandleFunc("POST /api/loop/stop", s.handleLoopStop)
@@ -139,11 +152,21 @@ func (s *Server) handleGetProviders(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, s.registry.List())
 }
 
+func (s *Server) handleGetModels(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.registry.Models())
+}
+
 func (s *Server) handleCreateTask(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Title       string `json:"title"`
-		Description string `json:"description"`
-		Provider    string `json:"provider"`
+		Title        string              `json:"title"`
+		Description  string              `json:"description"`
+		Provider     config.ProviderList `json:"provider"`
+		DependsOn    []string            `json:"dependsOn"`
+		Gates        []gate.Gate         `json:"gates"`
+		GatesMode    string              `json:"gatesMode"`
+		FreshSession *bool               `json:"freshSession"`
+		Model        *string             `json:"model"`
+		ExtraArgs    []string            `json:"extraArgs"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
 		writeError(w, http.StatusBadRequest, "invalid JSON")
@@ -169,8 +192,22 @@ func (s *Server) handleCreateTask(w http.ResponseWriter, r *http.Request) {
 		Description: input.Description,
 		Status:      config.StatusPending,
 		Provider:    input.Provider,
+		DependsOn:   input.DependsOn,
+		Gates:       input.Gates,
+		GatesMode:   input.GatesMode,
+		ExtraArgs:   input.ExtraArgs,
+	}
+	if input.Model != nil {
+		task.Model = *input.Model
+	}
+	if input.FreshSession != nil {
+		task.FreshSession = *input.FreshSession
 	}
 	cfg.Tasks = append(cfg.Tasks, task)
+	if err := cfg.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	if err := config.SaveConfig(s.cfgPath, cfg); err != nil {
 		writeError(w, http.StatusInternalServerError, "failed to save config")
@@ -184,9 +221,15 @@ func (s *Server) handleUpdateTask(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 
 	var input struct {
-		Title       string `json:"title"`
-		Description string `json:"description"`
-		Provider    string `json:"provider"`
+		Title        string              `json:"title"`
+		Description  string              `json:"description"`
+		Provider     config.ProviderList `json:"provider"`
+		DependsOn    []string            `json:"dependsOn"`
+		Gates        []gate.Gate         `json:"gates"`
+		GatesMode    string              `json:"gatesMode"`
+		FreshSession *bool               `json:"freshSession"`
+		Model        *string             `json:"model"`
+		ExtraArgs    []string            `json:"extraArgs"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
 		writeError(w, http.StatusBadRequest, "invalid JSON")
@@ -214,9 +257,31 @@ func (s *Server) handleUpdateTask(w http.ResponseWriter, r *http.Request) {
 			if input.Description != "" {
 				cfg.Tasks[i].Description = input.Description
 			}
-			if input.Provider != "" {
+			if input.Provider != nil {
 				cfg.Tasks[i].Provider = input.Provider
 			}
+			if input.DependsOn != nil {
+				cfg.Tasks[i].DependsOn = input.DependsOn
+			}
+			if input.Gates != nil {
+				cfg.Tasks[i].Gates = input.Gates
+			}
+			if input.GatesMode != "" {
+				cfg.Tasks[i].GatesMode = input.GatesMode
+			}
+			if input.FreshSession != nil {
+				cfg.Tasks[i].FreshSession = *input.FreshSession
+			}
+			if input.Model != nil {
+				cfg.Tasks[i].Model = *input.Model
+			}
+			if input.ExtraArgs != nil {
+				cfg.Tasks[i].ExtraArgs = input.ExtraArgs
+			}
+			if err := cfg.Validate(); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
 			if err := config.SaveConfig(s.cfgPath, cfg); err != nil {
 				writeError(w, http.StatusInternalServerError, "failed to save config")
 				return
@@ -247,6 +312,12 @@ func (s *Server) handleDeleteTask(w http.ResponseWriter, r *http.Request) {
 				writeError(w, http.StatusConflict, "cannot delete in_progress task")
 				return
 			}
+			for _, t := range cfg.Tasks {
+				if slices.Contains(t.DependsOn, id) {
+					writeError(w, http.StatusConflict, fmt.Sprintf("task %s depends on this task", t.ID))
+					return
+				}
+			}
 			cfg.Tasks = append(cfg.Tasks[:i], cfg.Tasks[i+1:]...)
 			if err := config.SaveConfig(s.cfgPath, cfg); err != nil {
 				writeError(w, http.StatusInternalServerError, "failed to save config")
@@ -260,12 +331,55 @@ func (s *Server) handleDeleteTask(w http.ResponseWriter, r *http.Request) {
 	writeError(w, http.StatusNotFound, "task not found")
 }
 
+func (s *Server) handleTaskHistory(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	s.mu.Lock()
+	cfg, err := config.LoadConfig(s.cfgPath)
+	s.mu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load config")
+		return
+	}
+	if !slices.ContainsFunc(cfg.Tasks, func(t config.Task) bool { return t.ID == id }) {
+		writeError(w, http.StatusNotFound, "task not found")
+		return
+	}
+
+	attempts, err := history.Load(s.cfgPath, id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load history")
+		return
+	}
+	writeJSON(w, http.StatusOK, attempts)
+}
+
+func (s *Server) handleGetRuns(w http.ResponseWriter, r *http.Request) {
+	runs, err := history.LoadRuns(s.cfgPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load runs")
+		return
+	}
+	writeJSON(w, http.StatusOK, runs)
+}
+
 func (s *Server) handleUpdateConfig(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Provider      string   `json:"provider"`
-		Branch        string   `json:"branch"`
-		Gates         []string `json:"gates"`
-		MaxIterations *int     `json:"maxIterations"`
+		Provider        string                 `json:"provider"`
+		Branch          string                 `json:"branch"`
+		Gates           []gate.Gate            `json:"gates"`
+		MaxIterations   *int                   `json:"maxIterations"`
+		GateTimeout     *string                `json:"gateTimeout"`
+		GateConcurrency *int                   `json:"gateConcurrency"`
+		GateFailFast    *bool                  `json:"gateFailFast"`
+		OutputBudget    *int                   `json:"outputBudget"`
+		Baseline        string                 `json:"baseline"`
+		StagnationLimit *int                   `json:"stagnationLimit"`
+		ProviderSwitch  *config.ProviderSwitch `json:"providerSwitch"`
+		Budget          *config.Budget         `json:"budget"`
+		Model           *string                `json:"model"`
+		ExtraArgs       []string               `json:"extraArgs"`
+		OnFailure       string                 `json:"onFailure"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
 		writeError(w, http.StatusBadRequest, "invalid JSON")
@@ -293,6 +407,43 @@ func (s *Server) handleUpdateConfig(w http.ResponseWriter, r *http.Request) {
 	if input.MaxIterations != nil {
 		cfg.MaxIterations = *input.MaxIterations
 	}
+	if input.GateTimeout != nil {
+		cfg.GateTimeout = *input.GateTimeout
+	}
+	if input.GateConcurrency != nil {
+		cfg.GateConcurrency = *input.GateConcurrency
+	}
+	if input.GateFailFast != nil {
+		cfg.GateFailFast = *input.GateFailFast
+	}
+	if input.OutputBudget != nil {
+		cfg.OutputBudget = *input.OutputBudget
+	}
+	if input.Baseline != "" {
+		cfg.Baseline = input.Baseline
+	}
+	if input.StagnationLimit != nil {
+		cfg.StagnationLimit = *input.StagnationLimit
+	}
+	if input.ProviderSwitch != nil {
+		cfg.ProviderSwitch = input.ProviderSwitch
+	}
+	if input.Budget != nil {
+		cfg.Budget = input.Budget
+	}
+	if input.Model != nil {
+		cfg.Model = *input.Model
+	}
+	if input.ExtraArgs != nil {
+		cfg.ExtraArgs = input.ExtraArgs
+	}
+	if input.OnFailure != "" {
+		cfg.OnFailure = input.OnFailure
+	}
+	if err := cfg.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	if err := config.SaveConfig(s.cfgPath, cfg); err != nil {
 		writeError(w, http.StatusInternalServerError, "failed to save config")
@@ -313,6 +464,20 @@ func nextTaskID(tasks []config.Task) string {
 }
 
 func (s *Server) handleLoopStart(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Parallel int    `json:"parallel"`
+		Force    bool   `json:"force"`
+		Resume   string `json:"resume"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	if input.Parallel < 0 {
+		writeError(w, http.StatusBadRequest, "parallel must be >= 0")
+		return
+	}
+
 	s.mu.Lock()
 	if s.loopRunning {
 		s.mu.Unlock()
@@ -326,7 +491,13 @@ func (s *Server) handleLoopStart(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, "failed to load config")
 		return
 	}
-	if cfg.NextPendingTask() == nil {
+	if loop.RunLockHeld(s.cfgPath) {
+		s.mu.Unlock()
+		writeError(w, http.StatusConflict, "another do-more run is active")
+		return
+	}
+	// Tasks left in_progress by a dead run are recovered by the loop.
+	if cfg.NextPendingTask() == nil && len(cfg.TasksWithStatus(config.StatusInProgress)) == 0 {
 		s.mu.Unlock()
 		writeJSON(w, http.StatusOK, map[string]string{"status": "completed", "message": "no pending tasks"})
 		return
@@ -337,22 +508,43 @@ func (s *Server) handleLoopStart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	s.loopCancel = cancel
-	s.loopRunning = true
+	s.startLoopLocked(cfg.Provider, loop.Options{Parallel: input.Parallel, Force: input.Force, Resume: input.Resume})
 	s.mu.Unlock()
 
 	s.hub.Broadcast(Event{
 		Type:      EventLoopStarted,
-		Data:      map[string]any{"provider": cfg.Provider},
+		Data:      map[string]any{"provider": cfg.Provider, "parallel": input.Parallel},
 		Timestamp: time.Now(),
 	})
 
+	writeJSON(w, http.StatusOK, map[string]string{"status": "started"})
+}
+
+// startLoopLocked runs the loop in the background and tracks each in-flight
+// task so it can be skipped individually. The caller must hold s.mu.
+func (s *Server) startLoopLocked(providerName string, opts loop.Options) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.loopCancel = cancel
+	s.loopRunning = true
+	s.loopStart = time.Now()
+	s.workers = make(map[string]context.CancelCauseFunc)
+
+	opts.TaskStarted = func(taskID string, cancel context.CancelCauseFunc) {
+		s.mu.Lock()
+		s.workers[taskID] = cancel
+		s.mu.Unlock()
+	}
+	opts.TaskFinished = func(taskID string) {
+		s.mu.Lock()
+		delete(s.workers, taskID)
+		s.mu.Unlock()
+	}
+
 	s.loopWg.Add(1)
 	go func() {
 		defer s.loopWg.Done()
 		logger := NewEventLogger(s.hub)
-		err := loop.RunLoop(ctx, s.cfgPath, cfg.Provider, s.registry, s.workDir, logger)
+		err := loop.RunLoopWithOptions(ctx, s.cfgPath, providerName, s.registry, s.workDir, logger, opts)
 
 		s.mu.Lock()
 		s.loopRunning = false
@@ -372,8 +564,6 @@ func (s *Server) handleLoopStart(w http.ResponseWriter, r *http.Request) {
 			})
 		}
 	}()
-
-	writeJSON(w, http.StatusOK, map[string]string{"status": "started"})
 }
 
 func (s *Server) handleLoopStop(w http.ResponseWriter, r *http.Request) {
@@ -393,77 +583,52 @@ func (s *Server) handleLoopStop(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, map[string]string{"status": "stopped"})
 }
 
+// handleLoopSkip cancels the in-flight task given by the "task" query
+// parameter, or every in-flight task when it is omitted. The loop records
+// the skip and moves on to the next task.
 func (s *Server) handleLoopSkip(w http.ResponseWriter, r *http.Request) {
+	taskID := r.URL.Query().Get("task")
+
 	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if !s.loopRunning {
-		s.mu.Unlock()
 		writeError(w, http.StatusConflict, "no loop running")
 		return
 	}
 
-	cfg, err := config.LoadConfig(s.cfgPath)
-	if err != nil {
-		s.mu.Unlock()
-		writeError(w, http.StatusInternalServerError, "failed to load config")
-		return
-	}
-	for i := range cfg.Tasks {
-		if cfg.Tasks[i].Status == config.StatusInProgress {
-			cfg.Tasks[i].Status = config.StatusFailed
-			cfg.Tasks[i].Learnings += "\nSkipped by user via dashboard"
-
-			s.hub.Broadcast(Event{
-				Type:      EventTaskFailed,
-				TaskID:    cfg.Tasks[i].ID,
-				Data:      map[string]any{"reason": "skipped"},
-				Timestamp: time.Now(),
-			})
-			break
+	skipped := []string{}
+	for id, cancel := range s.workers {
+		if taskID == "" || id == taskID {
+			cancel(errSkipped)
+			skipped = append(skipped, id)
 		}
 	}
-	config.SaveConfig(s.cfgPath, cfg)
-
-	if s.loopCancel != nil {
-		s.loopCancel()
-	}
-	s.loopRunning = false
-	s.loopCancel = nil
-	s.mu.Unlock()
-
-	cfg2, _ := config.LoadConfig(s.cfgPath)
-	if cfg2 != nil && cfg2.NextPendingTask() != nil {
-		s.mu.Lock()
-		ctx, cancel := context.WithCancel(context.Background())
-		s.loopCancel = cancel
-		s.loopRunning = true
-		s.mu.Unlock()
-
-		s.loopWg.Add(1)
-		go func() {
-			defer s.loopWg.Done()
-			logger := NewEventLogger(s.hub)
-			err := loop.RunLoop(ctx, s.cfgPath, cfg2.Provider, s.registry, s.workDir, logger)
-			s.mu.Lock()
-			s.loopRunning = false
-			s.loopCancel = nil
-			s.mu.Unlock()
-			if err != nil {
-				s.hub.Broadcast(Event{Type: EventLoopError, Data: map[string]any{"error": err.Error()}, Timestamp: time.Now()})
-			} else {
-				s.hub.Broadcast(Event{Type: EventLoopCompleted, Timestamp: time.Now()})
-			}
-		}()
+	if len(skipped) == 0 {
+		writeError(w, http.StatusConflict, "no matching task running")
+		return
 	}
+	sort.Strings(skipped)
 
-	writeJSON(w, http.StatusOK, map[string]string{"status": "skipped"})
+	writeJSON(w, http.StatusOK, map[string]any{"status": "skipped", "tasks": skipped})
 }
 
 func (s *Server) handleLoopStatus(w http.ResponseWriter, r *http.Request) {
 	s.mu.Lock()
 	running := s.loopRunning
+	started := s.loopStart
+	tasks := make([]string, 0, len(s.workers))
+	for id := range s.workers {
+		tasks = append(tasks, id)
+	}
 	s.mu.Unlock()
+	sort.Strings(tasks)
 
-	writeJSON(w, http.StatusOK, map[string]any{"running": running})
+	status := map[string]any{"running": running, "tasks": tasks}
+	if running {
+		status["startedAt"] = started
+	}
+	writeJSON(w, http.StatusOK, status)
 }
 
 func writeJSON(w http.ResponseWriter, status int, v any) {
@@ -8,12 +8,15 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/tmdgusya/do-more/internal/config"
+	"github.com/tmdgusya/do-more/internal/gate"
+	"github.com/tmdgusya/do-more/internal/history"
 	"github.com/tmdgusya/do-more/internal/provider"
 )
 
@@ -33,7 +36,7 @@ func setupTestServer(t *testing.T) (*httptest.Server, *Server, string) {
 		Name:          "test-project",
 		Provider:      "claude",
 		Branch:        "main",
-		Gates:         []string{"go test ./..."},
+		Gates:         gate.Commands("go test ./..."),
 		MaxIterations: 5,
 		Tasks: []config.Task{
 			{ID: "1", Title: "First task", Description: "Do first thing", Status: config.StatusPending},
@@ -112,6 +115,28 @@ func TestGetProviders(t *testing.T) {
 	}
 }
 
+func TestGetModels(t *testing.T) {
+	registry := provider.NewProviderRegistry()
+	registry.Register(&provider.ClaudeProvider{})
+	registry.Register(&mockTestProvider{name: "mock"})
+	ts := httptest.NewServer(NewServer(filepath.Join(t.TempDir(), "do-more.json"), t.TempDir(), registry).Handler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/api/models")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var models []provider.ProviderModels
+	if err := json.NewDecoder(resp.Body).Decode(&models); err != nil {
+		t.Fatal(err)
+	}
+	if len(models) != 2 || models[0].Provider != "claude" || !slices.Contains(models[0].Models, "opus") {
+		t.Errorf("models = %+v, want claude with its known models", models)
+	}
+}
+
 func TestCreateTask(t *testing.T) {
 	ts, _, cfgPath := setupTestServer(t)
 
@@ -139,7 +164,7 @@ func TestCreateTask(t *testing.T) {
 	if task.Status != config.StatusPending {
 		t.Errorf("expected status pending, got %s", task.Status)
 	}
-	if task.Provider != "kimi" {
+	if task.EffectiveProvider("") != "kimi" {
 		t.Errorf("expected provider kimi, got %s", task.Provider)
 	}
 
@@ -152,6 +177,28 @@ func TestCreateTask(t *testing.T) {
 	}
 }
 
+func TestCreateTaskWithFallbackProviders(t *testing.T) {
+	ts, _, _ := setupTestServer(t)
+
+	body := `{"title":"New task","provider":["claude","opencode"]}`
+	resp, err := http.Post(ts.URL+"/api/tasks", "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+	var task config.Task
+	if err := json.NewDecoder(resp.Body).Decode(&task); err != nil {
+		t.Fatal(err)
+	}
+	if chain := task.ProviderChain(""); len(chain) != 2 || chain[0] != "claude" || chain[1] != "opencode" {
+		t.Errorf("expected providers [claude opencode], got %v", chain)
+	}
+}
+
 func TestCreateTaskEmptyTitle(t *testing.T) {
 	ts, _, _ := setupTestServer(t)
 
@@ -190,7 +237,7 @@ func TestCreateTaskInvalidJSON(t *testing.T) {
 func TestUpdateTask(t *testing.T) {
 	ts, _, cfgPath := setupTestServer(t)
 
-	body := `{"title":"Updated title","description":"Updated desc","provider":"opencode"}`
+	body := `{"title":"Updated title","description":"Updated desc","provider":"opencode","freshSession":true,"model":"opus"}`
 	req, _ := http.NewRequest(http.MethodPut, ts.URL+"/api/tasks/1", bytes.NewBufferString(body))
 	req.Header.Set("Content-Type", "application/json")
 
@@ -209,9 +256,15 @@ func TestUpdateTask(t *testing.T) {
 	if task.Title != "Updated title" {
 		t.Errorf("expected 'Updated title', got %s", task.Title)
 	}
-	if task.Provider != "opencode" {
+	if task.EffectiveProvider("") != "opencode" {
 		t.Errorf("expected provider opencode, got %s", task.Provider)
 	}
+	if !task.FreshSession {
+		t.Error("expected freshSession to be set")
+	}
+	if task.Model != "opus" {
+		t.Errorf("expected model opus, got %s", task.Model)
+	}
 
 	cfg, _ := config.LoadConfig(cfgPath)
 	if cfg.Tasks[0].Title != "Updated title" {
@@ -301,6 +354,123 @@ func TestDeleteTaskInProgress(t *testing.T) {
 	}
 }
 
+func TestCreateTaskWithDependencies(t *testing.T) {
+	ts, _, cfgPath := setupTestServer(t)
+
+	body := `{"title":"Dependent","dependsOn":["1","2"]}`
+	resp, err := http.Post(ts.URL+"/api/tasks", "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+
+	cfg, _ := config.LoadConfig(cfgPath)
+	last := cfg.Tasks[len(cfg.Tasks)-1]
+	if len(last.DependsOn) != 2 || last.DependsOn[0] != "1" {
+		t.Errorf("expected dependsOn [1 2], got %v", last.DependsOn)
+	}
+}
+
+func TestCreateTaskWithGates(t *testing.T) {
+	ts, _, cfgPath := setupTestServer(t)
+
+	body := `{"title":"Docs","gates":["markdownlint docs"],"gatesMode":"replace"}`
+	resp, err := http.Post(ts.URL+"/api/tasks", "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+
+	cfg, _ := config.LoadConfig(cfgPath)
+	last := cfg.Tasks[len(cfg.Tasks)-1]
+	if len(last.Gates) != 1 || last.Gates[0].Run != "markdownlint docs" || last.GatesMode != config.GatesReplace {
+		t.Errorf("unexpected task gates: %v (%s)", last.Gates, last.GatesMode)
+	}
+}
+
+func TestCreateTaskInvalidGatesMode(t *testing.T) {
+	ts, _, _ := setupTestServer(t)
+
+	body := `{"title":"Docs","gates":["true"],"gatesMode":"merge"}`
+	resp, err := http.Post(ts.URL+"/api/tasks", "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestCreateTaskUnknownDependency(t *testing.T) {
+	ts, _, _ := setupTestServer(t)
+
+	body := `{"title":"Dependent","dependsOn":["42"]}`
+	resp, err := http.Post(ts.URL+"/api/tasks", "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestUpdateTaskDependencyCycle(t *testing.T) {
+	ts, _, _ := setupTestServer(t)
+
+	body := `{"title":"Dependent","dependsOn":["1"]}`
+	resp, err := http.Post(ts.URL+"/api/tasks", "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, ts.URL+"/api/tasks/1", bytes.NewBufferString(`{"dependsOn":["4"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestDeleteTaskWithDependents(t *testing.T) {
+	ts, _, _ := setupTestServer(t)
+
+	body := `{"title":"Dependent","dependsOn":["1"]}`
+	resp, err := http.Post(ts.URL+"/api/tasks", "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/api/tasks/1", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409, got %d", resp.StatusCode)
+	}
+}
+
 func TestDeleteTaskNotFound(t *testing.T) {
 	ts, _, _ := setupTestServer(t)
 
@@ -316,6 +486,74 @@ func TestDeleteTaskNotFound(t *testing.T) {
 	}
 }
 
+func TestTaskHistory(t *testing.T) {
+	ts, _, cfgPath := setupTestServer(t)
+
+	resp, err := http.Get(ts.URL + "/api/tasks/1/history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var empty []history.Attempt
+	json.NewDecoder(resp.Body).Decode(&empty)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || empty == nil || len(empty) != 0 {
+		t.Fatalf("expected 200 with empty list, got %d %v", resp.StatusCode, empty)
+	}
+
+	if err := history.Append(cfgPath, "1", history.Attempt{Iteration: 1, Provider: "claude"}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = http.Get(ts.URL + "/api/tasks/1/history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var attempts []history.Attempt
+	if err := json.NewDecoder(resp.Body).Decode(&attempts); err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 1 || attempts[0].Provider != "claude" {
+		t.Errorf("unexpected history: %+v", attempts)
+	}
+}
+
+func TestGetRuns(t *testing.T) {
+	ts, _, cfgPath := setupTestServer(t)
+
+	run := history.Run{Tasks: []string{"1"}, Usage: provider.Usage{InputTokens: 10, CostUSD: 0.2}}
+	if err := history.AppendRun(cfgPath, run); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(ts.URL + "/api/runs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var runs []history.Run
+	if err := json.NewDecoder(resp.Body).Decode(&runs); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || len(runs) != 1 || runs[0].Usage != run.Usage {
+		t.Errorf("got %d %+v, want the recorded run", resp.StatusCode, runs)
+	}
+}
+
+func TestTaskHistoryNotFound(t *testing.T) {
+	ts, _, _ := setupTestServer(t)
+
+	resp, err := http.Get(ts.URL + "/api/tasks/999/history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", resp.StatusCode)
+	}
+}
+
 func TestUpdateConfig(t *testing.T) {
 	ts, _, cfgPath := setupTestServer(t)
 
@@ -407,6 +645,23 @@ func TestUpdateConfigInvalidJSON(t *testing.T) {
 	}
 }
 
+func TestUpdateConfigInvalidOnFailure(t *testing.T) {
+	ts, _, _ := setupTestServer(t)
+
+	req, _ := http.NewRequest(http.MethodPut, ts.URL+"/api/config", bytes.NewBufferString(`{"onFailure":"explode"}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", resp.StatusCode)
+	}
+}
+
 func TestMutationPersists(t *testing.T) {
 	ts, _, _ := setupTestServer(t)
 
@@ -687,7 +942,7 @@ func setupLoopTestServer(t *testing.T, tasks []config.Task) (*httptest.Server, *
 		Name:          "loop-test",
 		Provider:      "slow",
 		Branch:        "main",
-		Gates:         []string{},
+		Gates:         gate.Commands(),
 		MaxIterations: 3,
 		Tasks:         tasks,
 	}
@@ -761,6 +1016,25 @@ func TestLoopStartNoPendingTasks(t *testing.T) {
 	}
 }
 
+func TestLoopStartRecoversStaleTask(t *testing.T) {
+	tasks := []config.Task{
+		{ID: "1", Title: "Interrupted", Description: "Left over", Status: config.StatusInProgress},
+	}
+	ts, _, _ := setupLoopTestServer(t, tasks)
+
+	resp, err := http.Post(ts.URL+"/api/loop/start", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var result map[string]string
+	json.NewDecoder(resp.Body).Decode(&result)
+	if result["status"] != "started" {
+		t.Errorf("expected status started, got %s", result["status"])
+	}
+}
+
 func TestLoopDoubleStart(t *testing.T) {
 	tasks := []config.Task{
 		{ID: "1", Title: "Task one", Description: "Do it", Status: config.StatusPending},
@@ -897,4 +1171,98 @@ func TestLoopStatus(t *testing.T) {
 	if result2["running"] != true {
 		t.Errorf("expected running=true after start, got %v", result2["running"])
 	}
+	if _, ok := result2["startedAt"].(string); !ok {
+		t.Errorf("expected startedAt while running, got %v", result2["startedAt"])
+	}
+}
+
+func TestLoopSkipCancelsTask(t *testing.T) {
+	tasks := []config.Task{
+		{ID: "1", Title: "Task one", Description: "Do it", Status: config.StatusPending},
+	}
+	ts, srv, cfgPath := setupLoopTestServer(t, tasks)
+
+	resp, err := http.Post(ts.URL+"/api/loop/start", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		srv.mu.Lock()
+		n := len(srv.workers)
+		srv.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("task never started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	statusResp, err := http.Get(ts.URL + "/api/loop/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status map[string]any
+	json.NewDecoder(statusResp.Body).Decode(&status)
+	statusResp.Body.Close()
+	if running, _ := status["tasks"].([]any); len(running) != 1 || running[0] != "1" {
+		t.Errorf("expected tasks [1], got %v", status["tasks"])
+	}
+
+	resp, err = http.Post(ts.URL+"/api/loop/skip?task=1", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	srv.loopWg.Wait()
+
+	cfg, _ := config.LoadConfig(cfgPath)
+	if cfg.Tasks[0].Status != config.StatusFailed {
+		t.Errorf("expected status failed, got %s", cfg.Tasks[0].Status)
+	}
+	if !strings.Contains(cfg.Tasks[0].Learnings, "skipped by user") {
+		t.Errorf("expected skip recorded in learnings, got %q", cfg.Tasks[0].Learnings)
+	}
+}
+
+func TestLoopSkipNotRunning(t *testing.T) {
+	tasks := []config.Task{
+		{ID: "1", Title: "Task one", Description: "Do it", Status: config.StatusPending},
+	}
+	ts, _, _ := setupLoopTestServer(t, tasks)
+
+	resp, err := http.Post(ts.URL+"/api/loop/skip", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409, got %d", resp.StatusCode)
+	}
+}
+
+func TestLoopStartInvalidParallel(t *testing.T) {
+	tasks := []config.Task{
+		{ID: "1", Title: "Task one", Description: "Do it", Status: config.StatusPending},
+	}
+	ts, _, _ := setupLoopTestServer(t, tasks)
+
+	resp, err := http.Post(ts.URL+"/api/loop/start", "application/json", bytes.NewBufferString(`{"parallel":-1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", resp.StatusCode)
+	}
 }
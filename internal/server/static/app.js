@@ -3,8 +3,13 @@
 // State
 let config = null;
 let providers = [];
+let models = {};
 let tasks = [];
 let loopRunning = false;
+let runUsage = null;
+let runUsageLabel = 'Last run';
+let loopStartedAt = null;
+let budgetReached = '';
 let eventSource = null;
 
 // Event type constants (must match server events.go)
@@ -16,21 +21,28 @@ const EventTaskStarted = 'task_started';
 const EventIterationStarted = 'iteration_started';
 const EventProviderInvoked = 'provider_invoked';
 const EventProviderFinished = 'provider_finished';
+const EventProviderSwitched = 'provider_switched';
+const EventProviderOutput = 'provider_output';
 const EventGateResult = 'gate_result';
 const EventTaskDone = 'task_done';
 const EventTaskFailed = 'task_failed';
+const EventTaskBlocked = 'task_blocked';
 const EventLogMessage = 'log_message';
+const EventUsage = 'usage';
+const EventBudgetReached = 'budget_reached';
 
 // Status constants (must match config.go)
 const StatusPending = 'pending';
 const StatusInProgress = 'in_progress';
 const StatusDone = 'done';
 const StatusFailed = 'failed';
+const StatusBlocked = 'blocked';
 
 // Initialize on page load
 document.addEventListener('DOMContentLoaded', function() {
     loadInitialData();
     connectEventSource();
+    setInterval(() => { if (loopRunning) renderBudget(); }, 1000);
 });
 
 // Load all initial data
@@ -38,10 +50,29 @@ async function loadInitialData() {
     await Promise.all([
         loadConfig(),
         loadProviders(),
-        loadLoopStatus()
+        loadModels(),
+        loadLoopStatus(),
+        loadRuns()
     ]);
 }
 
+// Load the last recorded run's usage
+async function loadRuns() {
+    try {
+        const response = await fetch('/api/runs');
+        if (!response.ok) {
+            throw new Error('Failed to load runs');
+        }
+        const runs = await response.json();
+        if (runs.length && !runUsage) {
+            runUsage = runs[runs.length - 1].usage || {};
+            renderProjectInfo();
+        }
+    } catch (error) {
+        console.error('Error loading runs:', error);
+    }
+}
+
 // Load config and tasks
 async function loadConfig() {
     try {
@@ -79,6 +110,22 @@ async function loadProviders() {
     }
 }
 
+// Load the known models of each provider
+async function loadModels() {
+    try {
+        const response = await fetch('/api/models');
+        if (!response.ok) {
+            throw new Error('Failed to load models');
+        }
+        const list = await response.json();
+        models = {};
+        list.forEach(p => { models[p.provider] = p.models || []; });
+        populateModelOptions('task');
+    } catch (error) {
+        console.error('Error loading models:', error);
+    }
+}
+
 // Load loop status
 async function loadLoopStatus() {
     try {
@@ -88,7 +135,9 @@ async function loadLoopStatus() {
         }
         const data = await response.json();
         loopRunning = data.running;
+        loopStartedAt = data.startedAt ? new Date(data.startedAt) : null;
         updateLoopControls();
+        renderBudget();
     } catch (error) {
         console.error('Error loading loop status:', error);
     }
@@ -129,24 +178,61 @@ function handleSSEEvent(event) {
     switch (event.type) {
         case EventLoopStarted:
             loopRunning = true;
+            loopStartedAt = event.timestamp ? new Date(event.timestamp) : new Date();
+            budgetReached = '';
+            runUsage = {};
+            runUsageLabel = 'This run';
             updateLoopControls();
+            renderProjectInfo();
+            break;
+        case EventBudgetReached:
+            budgetReached = event.data.reason;
+            renderBudget();
+            break;
+        case EventUsage:
+            addTaskUsage(event.taskId, event.data.used);
+            runUsage = event.data.run;
+            runUsageLabel = 'This run';
+            renderProjectInfo();
+            renderTasks();
             break;
         case EventLoopStopped:
         case EventLoopCompleted:
         case EventLoopError:
             loopRunning = false;
             updateLoopControls();
+            renderBudget();
             break;
         case EventTaskDone:
         case EventTaskFailed:
+        case EventTaskBlocked:
             loadConfig();
             break;
     }
 }
 
+// Append a line of provider output to the log, continuing the output
+// block of the same task when it is the latest entry
+function appendProviderOutput(event) {
+    const eventLog = document.getElementById('event-log');
+    let block = eventLog.lastElementChild;
+    if (!block || !block.classList.contains('event-output') || block.dataset.taskId !== event.taskId) {
+        block = document.createElement('pre');
+        block.className = 'event-item event-output';
+        block.dataset.taskId = event.taskId || '';
+        eventLog.appendChild(block);
+    }
+    block.textContent += (block.textContent ? '\n' : '') + (event.data.line || '');
+    eventLog.scrollTop = eventLog.scrollHeight;
+}
+
 // Append event to event log
 function appendEventToLog(event) {
     const eventLog = document.getElementById('event-log');
+    if (event.type === EventProviderOutput) {
+        appendProviderOutput(event);
+        return;
+    }
     
     const eventItem = document.createElement('div');
     eventItem.className = 'event-item';
@@ -162,6 +248,12 @@ function appendEventToLog(event) {
                 '<span class="event-pass">✓ PASS</span>' : 
                 '<span class="event-fail">✗ FAIL</span>';
             dataHtml = `<span class="event-data">${escapeHtml(event.data.command || '')} ${passFail}</span>`;
+        } else if (event.type === EventBudgetReached) {
+            dataHtml = `<span class="event-data event-fail">${escapeHtml(event.data.message)}</span>`;
+        } else if (event.type === EventUsage) {
+            dataHtml = `<span class="event-data">used ${escapeHtml(formatUsage(event.data.used))} (run total ${escapeHtml(formatUsage(event.data.run))})</span>`;
+        } else if (event.type === EventProviderSwitched) {
+            dataHtml = `<span class="event-data">${escapeHtml(event.data.from)} → ${escapeHtml(event.data.to)} (${escapeHtml(event.data.reason)})</span>`;
         } else if (event.data.message) {
             dataHtml = `<span class="event-data">${escapeHtml(event.data.message)}</span>`;
         } else if (dataStr !== '{}') {
@@ -194,6 +286,60 @@ function formatTimestamp(timestamp) {
     });
 }
 
+// Add a provider run's usage to the task's total while the loop runs;
+// the saved total arrives with the next config reload
+function addTaskUsage(taskId, used) {
+    const task = tasks.find(t => t.id === taskId);
+    if (!task || !used) return;
+    const u = task.usage || {};
+    task.usage = {
+        inputTokens: (u.inputTokens || 0) + (used.inputTokens || 0),
+        outputTokens: (u.outputTokens || 0) + (used.outputTokens || 0),
+        costUsd: (u.costUsd || 0) + (used.costUsd || 0),
+        durationMs: (u.durationMs || 0) + (used.durationMs || 0)
+    };
+}
+
+// Sum the usage of all tasks
+function totalUsage() {
+    const total = { inputTokens: 0, outputTokens: 0, costUsd: 0, durationMs: 0 };
+    for (const task of tasks) {
+        const u = task.usage || {};
+        total.inputTokens += u.inputTokens || 0;
+        total.outputTokens += u.outputTokens || 0;
+        total.costUsd += u.costUsd || 0;
+        total.durationMs += u.durationMs || 0;
+    }
+    return total;
+}
+
+// Format usage like the CLI: tokens and cost when reported, then time
+function formatUsage(u) {
+    if (!u) return '';
+    const parts = [];
+    const input = u.inputTokens || 0;
+    const output = u.outputTokens || 0;
+    if (input + output > 0) {
+        parts.push(`${input.toLocaleString('en-US')} input / ${output.toLocaleString('en-US')} output tokens`);
+    }
+    if (u.costUsd > 0) {
+        parts.push(`$${u.costUsd.toFixed(2)}`);
+    }
+    parts.push(formatDuration(u.durationMs || 0));
+    return parts.join(', ');
+}
+
+// Format milliseconds as e.g. 1h2m3s
+function formatDuration(ms) {
+    let seconds = Math.round(ms / 1000);
+    const hours = Math.floor(seconds / 3600);
+    const minutes = Math.floor((seconds % 3600) / 60);
+    seconds %= 60;
+    if (hours) return `${hours}h${minutes}m${seconds}s`;
+    if (minutes) return `${minutes}m${seconds}s`;
+    return `${seconds}s`;
+}
+
 // Escape HTML to prevent XSS
 function escapeHtml(text) {
     if (!text) return '';
@@ -207,7 +353,7 @@ function renderProjectInfo() {
     if (!config) return;
     
     const gatesHtml = config.gates && config.gates.length > 0 
-        ? `<div class="gates-list">${config.gates.map(g => `<span class="gate-tag">${escapeHtml(g)}</span>`).join('')}</div>`
+        ? `<div class="gates-list">${config.gates.map(renderGateTag).join('')}</div>`
         : '<span class="text-muted">No gates configured</span>';
     
     document.getElementById('project-info').innerHTML = `
@@ -223,6 +369,10 @@ function renderProjectInfo() {
             <span class="project-info-label">Provider:</span>
             <span class="project-info-value">${escapeHtml(config.provider || 'Unknown')}</span>
         </div>
+        ${config.model ? `<div class="project-info-item">
+            <span class="project-info-label">Model:</span>
+            <span class="project-info-value">${escapeHtml(config.model)}</span>
+        </div>` : ''}
         <div class="project-info-item">
             <span class="project-info-label">Max Iterations:</span>
             <span class="project-info-value">${config.maxIterations || 'N/A'}</span>
@@ -231,9 +381,78 @@ function renderProjectInfo() {
             <span class="project-info-label">Gates:</span>
             ${gatesHtml}
         </div>
+        <div class="project-info-item">
+            <span class="project-info-label">Usage (all tasks):</span>
+            <span class="project-info-value">${escapeHtml(formatUsage(totalUsage()))}</span>
+        </div>
+        ${runUsage ? `<div class="project-info-item">
+            <span class="project-info-label">${runUsageLabel}:</span>
+            <span class="project-info-value">${escapeHtml(formatUsage(runUsage))}</span>
+        </div>` : ''}
+    `;
+    renderBudget();
+}
+
+// Render how much of each budget cap the current or last run used
+function renderBudget() {
+    const el = document.getElementById('budget-info');
+    const budget = config && config.budget;
+    if (!budget) {
+        el.innerHTML = '';
+        return;
+    }
+    const used = runUsage || {};
+    const meters = [];
+    if (budget.maxCostUsd) {
+        meters.push(renderBudgetMeter('Cost', used.costUsd || 0, budget.maxCostUsd,
+            `$${(used.costUsd || 0).toFixed(2)} of $${budget.maxCostUsd.toFixed(2)}`));
+    }
+    if (budget.maxTokens) {
+        const tokens = (used.inputTokens || 0) + (used.outputTokens || 0);
+        meters.push(renderBudgetMeter('Tokens', tokens, budget.maxTokens,
+            `${tokens.toLocaleString('en-US')} of ${budget.maxTokens.toLocaleString('en-US')}`));
+    }
+    const maxRun = parseDuration(budget.maxRunDuration);
+    if (maxRun) {
+        const elapsed = loopRunning && loopStartedAt ? Date.now() - loopStartedAt : 0;
+        meters.push(renderBudgetMeter('Run time', elapsed, maxRun,
+            `${formatDuration(elapsed)} of ${formatDuration(maxRun)}`));
+    }
+    const maxTask = budget.maxTaskDuration
+        ? `<span class="text-muted">Each task: at most ${escapeHtml(budget.maxTaskDuration)}</span>`
+        : '';
+    const reached = budgetReached
+        ? `<span class="budget-reached">Budget reached (${escapeHtml(budgetReached)})</span>`
+        : '';
+    el.innerHTML = `
+        <span class="project-info-label">Budget (${escapeHtml(runUsageLabel.toLowerCase())}):</span>
+        ${meters.join('')}
+        ${maxTask}
+        ${reached}
     `;
 }
 
+function renderBudgetMeter(label, value, max, text) {
+    const percent = Math.min(100, Math.round(value / max * 100));
+    const level = percent >= 100 ? 'full' : percent >= 80 ? 'high' : '';
+    return `<div class="budget-meter" title="${escapeHtml(text)}">
+        <span class="budget-meter-label">${label}</span>
+        <div class="budget-meter-bar"><div class="budget-meter-fill ${level}" style="width: ${percent}%"></div></div>
+        <span class="budget-meter-text">${escapeHtml(text)}</span>
+    </div>`;
+}
+
+// Parse a Go duration such as "1h30m" or "45s" into milliseconds
+function parseDuration(value) {
+    if (!value) return 0;
+    const units = { h: 3600000, m: 60000, s: 1000, ms: 1 };
+    let ms = 0;
+    for (const [, n, unit] of value.matchAll(/([\d.]+)(ms|h|m|s)/g)) {
+        ms += parseFloat(n) * units[unit];
+    }
+    return ms;
+}
+
 // Render providers list
 function renderProviders() {
     if (!config || !providers.length) return;
@@ -261,6 +480,61 @@ function populateProviderDropdowns() {
     document.getElementById('edit-task-provider').innerHTML = options;
 }
 
+// Suggest the known models of the provider chosen in a task form
+function populateModelOptions(prefix) {
+    const chosen = document.getElementById(`${prefix}-provider`).value || (config && config.provider);
+    document.getElementById(`${prefix}-model-options`).innerHTML =
+        (models[chosen] || []).map(m => `<option value="${escapeHtml(m)}"></option>`).join('');
+}
+
+// Parse a comma-separated list of task IDs
+function parseDependsOn(value) {
+    return (value || '').split(',').map(s => s.trim().replace(/^#/, '')).filter(s => s !== '');
+}
+
+// Combine the chosen provider and comma-separated fallbacks into the
+// task's provider field: a plain name, or an ordered list when there are
+// fallbacks.
+function parseProviders(primary, fallbacks) {
+    const names = (fallbacks || '').split(',').map(s => s.trim()).filter(s => s !== '');
+    if (!names.length) return primary || '';
+    return [primary || config.provider, ...names];
+}
+
+// Task provider as a list, whether stored as a string or an array
+function taskProviders(task) {
+    if (!task.provider) return [];
+    return Array.isArray(task.provider) ? task.provider : [task.provider];
+}
+
+// Parse one gate per line: a plain command, or a JSON gate object
+function parseGates(value) {
+    return (value || '').split('\n').map(s => s.trim()).filter(s => s !== '').map(line => {
+        if (!line.startsWith('{')) return line;
+        try {
+            return JSON.parse(line);
+        } catch (e) {
+            return line;
+        }
+    });
+}
+
+// Format gates for the one-per-line textarea
+function formatGates(gates) {
+    return (gates || []).map(g => typeof g === 'string' ? g : JSON.stringify(g)).join('\n');
+}
+
+// Gates are plain command strings or objects with a name and command
+function gateLabel(g) {
+    return typeof g === 'string' ? g : (g.name || g.run);
+}
+
+function renderGateTag(g) {
+    const advisory = typeof g === 'object' && g.required === false;
+    const title = typeof g === 'string' ? g : g.run;
+    return `<span class="gate-tag${advisory ? ' gate-advisory' : ''}" title="${escapeHtml(title)}">${escapeHtml(gateLabel(g))}${advisory ? ' (advisory)' : ''}</span>`;
+}
+
 // Render tasks list
 function renderTasks() {
     if (!tasks.length) {
@@ -270,7 +544,7 @@ function renderTasks() {
     
     const html = tasks.map(task => {
         const statusClass = `status-${task.status}`;
-        const providerDisplay = task.provider || `Default (${config.provider})`;
+        const providerDisplay = (taskProviders(task).join(' → ') || `Default (${config.provider})`) + (task.model ? ` · ${task.model}` : '');
         
         return `
             <div class="task-item" data-task-id="${escapeHtml(task.id)}">
@@ -282,13 +556,18 @@ function renderTasks() {
                     <div class="task-meta">
                         <span class="status-badge ${statusClass}">${escapeHtml(task.status)}</span>
                         <span class="task-provider">Provider: ${escapeHtml(providerDisplay)}</span>
+                        ${task.session && !task.freshSession ? `<span class="task-provider" title="Session ${escapeHtml(task.session.id)}">Continuing ${escapeHtml(task.session.provider)} session</span>` : ''}
+                        ${task.usage ? `<span class="task-provider" title="Provider usage for this task">${escapeHtml(formatUsage(task.usage))}</span>` : ''}
+                        ${task.dependsOn && task.dependsOn.length ? `<span class="task-provider">Depends on: ${task.dependsOn.map(d => '#' + escapeHtml(d)).join(', ')}</span>` : ''}
                         <div class="task-actions">
+                            <button class="btn btn-secondary btn-small" onclick="openHistoryModal('${escapeHtml(task.id)}')">History</button>
                             <button class="btn btn-edit btn-small" onclick="openEditModal('${escapeHtml(task.id)}')" ${task.status === StatusInProgress ? 'disabled' : ''}>Edit</button>
                             <button class="btn btn-delete btn-small" onclick="deleteTask('${escapeHtml(task.id)}')" ${task.status === StatusInProgress ? 'disabled' : ''}>Delete</button>
                         </div>
                     </div>
                 </div>
                 ${task.description ? `<div class="task-description">${escapeHtml(task.description)}</div>` : ''}
+                ${task.gates && task.gates.length ? `<div class="gates-list"><span class="task-provider">Gates (${escapeHtml(task.gatesMode || 'extend')}):</span>${task.gates.map(renderGateTag).join('')}</div>` : ''}
             </div>
         `;
     }).join('');
@@ -309,12 +588,14 @@ function updateLoopControls() {
         btnStart.disabled = true;
         btnStop.disabled = false;
         btnSkip.disabled = false;
+        document.getElementById('loop-parallel').disabled = true;
     } else {
         statusIndicator.textContent = 'Stopped';
         statusIndicator.className = 'status-badge status-stopped';
         btnStart.disabled = false;
         btnStop.disabled = true;
         btnSkip.disabled = true;
+        document.getElementById('loop-parallel').disabled = false;
     }
 }
 
@@ -323,7 +604,12 @@ async function startLoop() {
     clearError('loop-error');
     
     try {
-        const response = await fetch('/api/loop/start', { method: 'POST' });
+        const parallel = parseInt(document.getElementById('loop-parallel').value, 10) || 0;
+        const response = await fetch('/api/loop/start', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ parallel: parallel })
+        });
         const data = await response.json();
         
         if (!response.ok) {
@@ -386,7 +672,12 @@ async function createTask(event) {
     const taskData = {
         title: formData.get('title'),
         description: formData.get('description'),
-        provider: formData.get('provider') || ''
+        provider: parseProviders(formData.get('provider'), formData.get('fallbackProviders')),
+        dependsOn: parseDependsOn(formData.get('dependsOn')),
+        gates: parseGates(formData.get('gates')),
+        gatesMode: formData.get('gatesMode') || '',
+        freshSession: formData.get('freshSession') === 'on',
+        model: formData.get('model') || ''
     };
     
     try {
@@ -418,7 +709,15 @@ function openEditModal(taskId) {
     document.getElementById('edit-task-id').value = task.id;
     document.getElementById('edit-task-title').value = task.title;
     document.getElementById('edit-task-description').value = task.description || '';
-    document.getElementById('edit-task-provider').value = task.provider || '';
+    const taskProviderList = taskProviders(task);
+    document.getElementById('edit-task-provider').value = taskProviderList[0] || '';
+    document.getElementById('edit-task-fallback-providers').value = taskProviderList.slice(1).join(', ');
+    document.getElementById('edit-task-depends-on').value = (task.dependsOn || []).join(', ');
+    document.getElementById('edit-task-gates').value = formatGates(task.gates);
+    document.getElementById('edit-task-gates-mode').value = task.gatesMode || 'extend';
+    document.getElementById('edit-task-fresh-session').checked = !!task.freshSession;
+    document.getElementById('edit-task-model').value = task.model || '';
+    populateModelOptions('edit-task');
     
     clearError('edit-task-error');
     document.getElementById('edit-modal').style.display = 'flex';
@@ -441,7 +740,12 @@ async function updateTask(event) {
     const taskData = {
         title: formData.get('title'),
         description: formData.get('description'),
-        provider: formData.get('provider') || ''
+        provider: parseProviders(formData.get('provider'), formData.get('fallbackProviders')),
+        dependsOn: parseDependsOn(formData.get('dependsOn')),
+        gates: parseGates(formData.get('gates')),
+        gatesMode: formData.get('gatesMode') || '',
+        freshSession: formData.get('freshSession') === 'on',
+        model: formData.get('model') || ''
     };
     
     try {
@@ -465,6 +769,63 @@ async function updateTask(event) {
     }
 }
 
+// Open attempt history modal
+async function openHistoryModal(taskId) {
+    const list = document.getElementById('history-list');
+    document.getElementById('history-title').textContent = `Attempt History: Task #${taskId}`;
+    list.innerHTML = '<span class="loading">Loading...</span>';
+    document.getElementById('history-modal').style.display = 'flex';
+
+    try {
+        const response = await fetch(`/api/tasks/${encodeURIComponent(taskId)}/history`);
+        const attempts = await response.json();
+        if (!response.ok) {
+            list.innerHTML = `<span class="error-message">${escapeHtml(attempts.error || 'Failed to load history')}</span>`;
+            return;
+        }
+        if (!attempts.length) {
+            list.innerHTML = '<div class="empty-state">No attempts recorded yet.</div>';
+            return;
+        }
+        list.innerHTML = attempts.map(renderAttempt).join('');
+    } catch (error) {
+        list.innerHTML = `<span class="error-message">Network error: ${escapeHtml(error.message)}</span>`;
+    }
+}
+
+// Render a single attempt record
+function renderAttempt(attempt) {
+    const result = attempt.passed ?
+        '<span class="event-pass">✓ PASS</span>' :
+        '<span class="event-fail">✗ FAIL</span>';
+    const seconds = Math.round((new Date(attempt.endedAt) - new Date(attempt.startedAt)) / 1000);
+    const gates = (attempt.gates || []).map(g =>
+        `<div>${g.passed ? '<span class="event-pass">✓</span>' : '<span class="event-fail">✗</span>'} ${escapeHtml(g.name || g.command)}${g.exitCode ? ` <span class="task-provider">exit ${g.exitCode}</span>` : ''}${g.advisory ? ' <span class="task-provider">advisory</span>' : ''}</div>`
+    ).join('');
+    const error = attempt.providerError ?
+        `<div class="event-fail">Provider error: ${escapeHtml(attempt.providerError)}</div>` : '';
+    const summary = attempt.failureSummary ?
+        `<pre class="history-output">${escapeHtml(attempt.failureSummary)}</pre>` : '';
+
+    return `
+        <div class="history-item">
+            <div class="history-header">
+                <strong>Iteration ${attempt.iteration}</strong>
+                <span class="task-provider">${escapeHtml(attempt.provider)} · ${formatTimestamp(attempt.startedAt)} · ${seconds}s${attempt.usage && (attempt.usage.inputTokens || attempt.usage.outputTokens || attempt.usage.costUsd) ? ' · ' + escapeHtml(formatUsage(attempt.usage)) : ''}</span>
+                ${result}
+            </div>
+            ${error}
+            ${gates}
+            ${summary}
+        </div>
+    `;
+}
+
+// Close attempt history modal
+function closeHistoryModal() {
+    document.getElementById('history-modal').style.display = 'none';
+}
+
 // Delete task
 async function deleteTask(taskId) {
     if (!confirm('Are you sure you want to delete this task?')) {
@@ -510,4 +871,7 @@ document.addEventListener('click', function(event) {
     if (event.target === modal) {
         closeEditModal();
     }
+    if (event.target === document.getElementById('history-modal')) {
+        closeHistoryModal();
+    }
 });